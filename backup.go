@@ -0,0 +1,459 @@
+package simplekv
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var (
+	// ErrBackupNotFound is returned for backup ids the engine doesn't hold.
+	ErrBackupNotFound = errors.New("backup not found")
+	// ErrBackupCorrupted is returned when a backup file doesn't match the
+	// size or checksum recorded when it was taken.
+	ErrBackupCorrupted = errors.New("backup corrupted")
+)
+
+const (
+	backupMetaDir    = "meta/"
+	backupSharedDir  = "shared/"
+	backupPrivateDir = "private/"
+)
+
+// BackupEngine keeps numbered backups of a tree in a backup directory.
+// Segments are shared between backups: a segment is copied only when no
+// earlier backup holds the same name, size and checksum. The WAL, metadata
+// and OPTIONS file are private to each backup.
+//
+// Layout of the backup directory:
+// - meta/<id>           description of backup <id>, written last
+// - shared/<segment>_<crc32>_<size>
+// - private/<id>/       WAL, metadata and OPTIONS of backup <id>
+type BackupEngine struct {
+	mu      sync.Mutex
+	fs      FS
+	dir     string
+	backups map[uint32]*backupMetadata
+}
+
+// BackupInfo describes a backup held by a BackupEngine.
+type BackupInfo struct {
+	ID        uint32
+	Timestamp time.Time
+	Size      int64
+	NumFiles  int
+}
+
+type backupFile struct {
+	// Name of the file in the database directory
+	Name string
+	// Path of the copy relative to the backup directory
+	Path     string
+	Size     int64
+	Checksum uint32
+}
+
+type backupMetadata struct {
+	ID        uint32
+	Timestamp int64
+	Files     []*backupFile
+}
+
+// OpenBackupEngine opens the backups kept in dir, creating it when missing.
+func OpenBackupEngine(dir string) (*BackupEngine, error) {
+	return OpenBackupEngineFS(OSFS, dir)
+}
+
+// OpenBackupEngineFS opens the backups kept in dir of fs, creating it when
+// missing.
+func OpenBackupEngineFS(fs FS, dir string) (*BackupEngine, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("%w: empty backup directory", ErrInvalidOptions)
+	}
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	for _, sub := range []string{backupMetaDir, backupSharedDir, backupPrivateDir} {
+		err := fs.MkdirAll(dir+sub, 0777)
+		if err != nil {
+			return nil, fmt.Errorf("make dir: %s err: %s", dir+sub, err)
+		}
+	}
+
+	engine := &BackupEngine{
+		fs:      fs,
+		dir:     dir,
+		backups: map[uint32]*backupMetadata{},
+	}
+	entries, err := fs.ReadDir(dir + backupMetaDir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %s err: %s", dir+backupMetaDir, err)
+	}
+	for _, entry := range entries {
+		id, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if err != nil {
+			// a meta file being written
+			continue
+		}
+		bytes, err := readFile(fs, dir+backupMetaDir+entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("read backup meta err: %s", err)
+		}
+		meta := &backupMetadata{}
+		err = jsoniter.Unmarshal(bytes, meta)
+		if err != nil {
+			return nil, fmt.Errorf("%w: backup %d meta: %s", ErrBackupCorrupted, id, err)
+		}
+		engine.backups[uint32(id)] = meta
+	}
+	return engine, nil
+}
+
+// CreateNewBackup stores the current state of t as a new backup. Writes are
+// held while it is taken: the segments no earlier backup holds are copied
+// straight from the directory of t, the WAL, metadata and OPTIONS files to
+// the private directory of the backup.
+func (e *BackupEngine) CreateNewBackup(t *Tree) (uint32, error) {
+	if t.secondary != nil {
+		return 0, fmt.Errorf("%w: back up a secondary", ErrReadOnly)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := uint32(1)
+	for existing := range e.backups {
+		if existing >= id {
+			id = existing + 1
+		}
+	}
+
+	privateDir := backupPrivateDir + strconv.FormatUint(uint64(id), 10) + "/"
+	err := e.fs.RemoveAll(e.dir + privateDir)
+	if err == nil {
+		err = e.fs.MkdirAll(e.dir+privateDir, 0777)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("make dir: %s err: %s", privateDir, err)
+	}
+
+	meta := &backupMetadata{
+		ID:        id,
+		Timestamp: time.Now().UnixNano(),
+	}
+	t.mu.RLock()
+	err = e.backupTree(t, "", privateDir, meta)
+	t.mu.RUnlock()
+	if err != nil {
+		e.fs.RemoveAll(e.dir + privateDir)
+		return 0, err
+	}
+
+	// the meta file makes the backup visible, it is written last
+	bytes, err := jsoniter.Marshal(meta)
+	if err != nil {
+		return 0, fmt.Errorf("json marshal err: %s", err)
+	}
+	metaPath := e.dir + backupMetaDir + strconv.FormatUint(uint64(id), 10)
+	err = writeFile(e.fs, metaPath+".tmp", bytes)
+	if err != nil {
+		return 0, fmt.Errorf("write file err: %s", err)
+	}
+	err = e.fs.Rename(metaPath+".tmp", metaPath)
+	if err != nil {
+		return 0, fmt.Errorf("rename file err: %s", err)
+	}
+	e.backups[id] = meta
+	return id, nil
+}
+
+// GetBackupInfo lists the backups, oldest first.
+func (e *BackupEngine) GetBackupInfo() []BackupInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	infos := make([]BackupInfo, 0, len(e.backups))
+	for _, id := range e.sortedIDs() {
+		meta := e.backups[id]
+		info := BackupInfo{
+			ID:        id,
+			Timestamp: time.Unix(0, meta.Timestamp),
+			NumFiles:  len(meta.Files),
+		}
+		for _, file := range meta.Files {
+			info.Size += file.Size
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// RestoreDBFromBackup restores backup id into dir, which must not exist.
+// Every file is verified against its checksum while it is copied.
+func (e *BackupEngine) RestoreDBFromBackup(id uint32, dir string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	meta, ok := e.backups[id]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrBackupNotFound, id)
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	if fileExists(e.fs, dir) {
+		return fmt.Errorf("restore dir: %s already exists", dir)
+	}
+
+	tempDir := dir + ".tmp/"
+	err := e.fs.RemoveAll(tempDir)
+	if err == nil {
+		err = e.fs.MkdirAll(tempDir, 0777)
+	}
+	if err != nil {
+		return fmt.Errorf("make dir: %s err: %s", tempDir, err)
+	}
+	for _, file := range meta.Files {
+		err = e.verifyFile(file)
+		if err == nil {
+			err = e.fs.MkdirAll(filepath.Dir(tempDir+file.Name), 0777)
+		}
+		if err == nil {
+			err = copyFile(e.fs, e.dir+file.Path, e.fs, tempDir+file.Name)
+		}
+		if err != nil {
+			e.fs.RemoveAll(tempDir)
+			return err
+		}
+	}
+	err = e.fs.Rename(tempDir, dir)
+	if err != nil {
+		e.fs.RemoveAll(tempDir)
+		return fmt.Errorf("rename restore dir err: %s", err)
+	}
+	return nil
+}
+
+// VerifyBackup checks the size and checksum of every file of backup id.
+func (e *BackupEngine) VerifyBackup(id uint32) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	meta, ok := e.backups[id]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrBackupNotFound, id)
+	}
+	for _, file := range meta.Files {
+		err := e.verifyFile(file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeOldBackups deletes all but the keep newest backups, and the shared
+// segments no remaining backup references.
+func (e *BackupEngine) PurgeOldBackups(keep int) error {
+	if keep < 0 {
+		return fmt.Errorf("%w: negative number of backups to keep", ErrInvalidOptions)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ids := e.sortedIDs()
+	for len(ids) > keep {
+		id := ids[0]
+		ids = ids[1:]
+		name := strconv.FormatUint(uint64(id), 10)
+		// once its meta file is gone the backup no longer exists
+		err := e.fs.Remove(e.dir + backupMetaDir + name)
+		if err != nil {
+			return fmt.Errorf("remove backup meta err: %s", err)
+		}
+		delete(e.backups, id)
+		err = e.fs.RemoveAll(e.dir + backupPrivateDir + name)
+		if err != nil {
+			return fmt.Errorf("remove backup dir err: %s", err)
+		}
+	}
+
+	referenced := map[string]struct{}{}
+	for _, meta := range e.backups {
+		for _, file := range meta.Files {
+			referenced[file.Path] = struct{}{}
+		}
+	}
+	entries, err := e.fs.ReadDir(e.dir + backupSharedDir)
+	if err != nil {
+		return fmt.Errorf("read dir: %s err: %s", e.dir+backupSharedDir, err)
+	}
+	for _, entry := range entries {
+		path := backupSharedDir + entry.Name()
+		if _, ok := referenced[path]; ok {
+			continue
+		}
+		err = e.fs.Remove(e.dir + path)
+		if err != nil {
+			return fmt.Errorf("remove shared file err: %s", err)
+		}
+	}
+	return nil
+}
+
+func (e *BackupEngine) sortedIDs() []uint32 {
+	ids := make([]uint32, 0, len(e.backups))
+	for id := range e.backups {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (e *BackupEngine) verifyFile(file *backupFile) error {
+	size, checksum, err := fileChecksum(e.fs, e.dir+file.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %s is missing", ErrBackupCorrupted, file.Path)
+		}
+		return err
+	}
+	if size != file.Size || checksum != file.Checksum {
+		return fmt.Errorf("%w: %s has size %d checksum %d, expected %d and %d",
+			ErrBackupCorrupted, file.Path, size, checksum, file.Size, file.Checksum)
+	}
+	return nil
+}
+
+// fileChecksum returns the size and the CRC-32 of path.
+func fileChecksum(fs FS, path string) (int64, uint32, error) {
+	file, err := fs.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("open file err: %w", err)
+	}
+	defer file.Close()
+
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, 0, fmt.Errorf("read file %s err: %s", path, err)
+	}
+	return size, hash.Sum32(), nil
+}
+
+// backupTree adds the files of t, below prefix in the backup, and of its
+// column families to meta. t.mu must be held.
+func (e *BackupEngine) backupTree(t *Tree, prefix, privateDir string, meta *backupMetadata) error {
+	fs := t.opts.FS
+	for _, segment := range t.segments {
+		name := prefix + segment
+		size, checksum, err := fileChecksum(fs, t.segmentPath(segment))
+		if err != nil {
+			return err
+		}
+		// segments of the column families are named alike
+		shared := strings.ReplaceAll(name, "/", "_")
+		file := &backupFile{
+			Name:     name,
+			Path:     fmt.Sprintf("%s%s_%d_%d", backupSharedDir, shared, checksum, size),
+			Size:     size,
+			Checksum: checksum,
+		}
+		if !fileExists(e.fs, e.dir+file.Path) {
+			err = copyFileAtomically(fs, t.segmentPath(segment), e.fs, e.dir+file.Path)
+			if err != nil {
+				return err
+			}
+		}
+		meta.Files = append(meta.Files, file)
+	}
+	for _, name := range []string{t.walBasename, optionsFilename} {
+		if !fileExists(fs, t.segmentsDirectory+name) {
+			continue
+		}
+		path := privateDir + prefix + name
+		err := copyFileAtomically(fs, t.segmentsDirectory+name, e.fs, e.dir+path)
+		if err != nil {
+			return err
+		}
+		err = e.addPrivateFile(meta, prefix+name, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	bytes, err := t.dumpMetadata()
+	if err == nil {
+		bytes, err = t.sealFile(bytes)
+	}
+	if err != nil {
+		return err
+	}
+	path := privateDir + prefix + metadataFilename
+	err = e.fs.MkdirAll(filepath.Dir(e.dir+path), 0777)
+	if err == nil {
+		err = writeFile(e.fs, e.dir+path, bytes)
+	}
+	if err != nil {
+		return fmt.Errorf("write file err: %s", err)
+	}
+	err = e.addPrivateFile(meta, prefix+metadataFilename, path)
+	if err != nil {
+		return err
+	}
+
+	for _, tree := range t.familyTrees()[1:] {
+		familyPrefix := prefix + strings.TrimPrefix(tree.segmentsDirectory, t.segmentsDirectory)
+		err = e.backupTree(tree, familyPrefix, privateDir, meta)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addPrivateFile adds the file name of the database, copied to path of the
+// backup, to meta.
+func (e *BackupEngine) addPrivateFile(meta *backupMetadata, name, path string) error {
+	size, checksum, err := fileChecksum(e.fs, e.dir+path)
+	if err != nil {
+		return err
+	}
+	meta.Files = append(meta.Files, &backupFile{
+		Name:     name,
+		Path:     path,
+		Size:     size,
+		Checksum: checksum,
+	})
+	return nil
+}
+
+// copyFileAtomically copies src to dst through a temporary file, so dst
+// only ever appears complete.
+func copyFileAtomically(srcFS FS, src string, dstFS FS, dst string) error {
+	temp := dst + ".tmp"
+	err := dstFS.Remove(temp)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove file err: %s", err)
+	}
+	err = dstFS.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return fmt.Errorf("make dir err: %s", err)
+	}
+	err = copyFile(srcFS, src, dstFS, temp)
+	if err != nil {
+		return err
+	}
+	err = dstFS.Rename(temp, dst)
+	if err != nil {
+		return fmt.Errorf("rename file err: %s", err)
+	}
+	return nil
+}
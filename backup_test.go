@@ -0,0 +1,158 @@
+package simplekv
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupEngineBackupsAndRestores(t *testing.T) {
+	assert := assert.New(t)
+	backupDir := testBasePath + "backups/"
+	db, err := NewTree(testFilename, testBasePath+"db/", bkupName)
+	defer cleanup()
+	assert.Nil(err)
+	db.threshold = 40
+	for i := 0; i < 20; i++ {
+		err = db.Set("key"+strconv.Itoa(i), "v1")
+		assert.Nil(err)
+	}
+
+	engine, err := OpenBackupEngine(backupDir)
+	assert.Nil(err)
+	id1, err := engine.CreateNewBackup(db)
+	assert.Nil(err)
+	for i := 20; i < 40; i++ {
+		err = db.Set("key"+strconv.Itoa(i), "v2")
+		assert.Nil(err)
+	}
+	id2, err := engine.CreateNewBackup(db)
+	assert.Nil(err)
+	assert.Equal(id2, id1+1)
+
+	// the segments untouched between both backups are stored once
+	shared, err := ioutil.ReadDir(backupDir + backupSharedDir)
+	assert.Nil(err)
+	assert.Less(len(shared), len(engine.backups[id1].Files)+len(engine.backups[id2].Files))
+
+	engine, err = OpenBackupEngine(backupDir)
+	assert.Nil(err)
+	assert.Equal(len(engine.GetBackupInfo()), 2)
+	assert.Nil(engine.VerifyBackup(id1))
+	assert.Nil(engine.VerifyBackup(id2))
+
+	err = engine.RestoreDBFromBackup(id1, testBasePath+"restored1")
+	assert.Nil(err)
+	restored, err := NewTree(testFilename, testBasePath+"restored1/", bkupName)
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		val, err := restored.Get("key" + strconv.Itoa(i))
+		assert.Nil(err)
+		assert.Equal(val, "v1")
+	}
+	val, err := restored.Get("key30")
+	assert.Equal(err, ErrNotFound)
+	assert.Equal(val, "")
+	assert.Nil(restored.Close())
+
+	err = engine.PurgeOldBackups(1)
+	assert.Nil(err)
+	assert.Equal(len(engine.GetBackupInfo()), 1)
+	err = engine.RestoreDBFromBackup(id1, testBasePath+"purged")
+	assert.True(errors.Is(err, ErrBackupNotFound))
+
+	err = engine.RestoreDBFromBackup(id2, testBasePath+"restored2")
+	assert.Nil(err)
+	restored, err = NewTree(testFilename, testBasePath+"restored2/", bkupName)
+	assert.Nil(err)
+	for i := 0; i < 40; i++ {
+		val, err := restored.Get("key" + strconv.Itoa(i))
+		assert.Nil(err)
+		assert.NotEqual(val, "")
+	}
+	assert.Nil(restored.Close())
+	assert.Nil(db.Close())
+}
+
+func TestBackupEngineVerifyDetectsCorruption(t *testing.T) {
+	assert := assert.New(t)
+	db, err := NewTree(testFilename, testBasePath+"db/", bkupName)
+	defer cleanup()
+	assert.Nil(err)
+	db.threshold = 40
+	for i := 0; i < 20; i++ {
+		err = db.Set("key"+strconv.Itoa(i), "v1")
+		assert.Nil(err)
+	}
+	engine, err := OpenBackupEngine(testBasePath + "backups")
+	assert.Nil(err)
+	id, err := engine.CreateNewBackup(db)
+	assert.Nil(err)
+
+	file := engine.backups[id].Files[0]
+	err = os.WriteFile(engine.dir+file.Path, []byte("garbage\n"), 0666)
+	assert.Nil(err)
+	assert.True(errors.Is(engine.VerifyBackup(id), ErrBackupCorrupted))
+	err = engine.RestoreDBFromBackup(id, testBasePath+"restored")
+	assert.True(errors.Is(err, ErrBackupCorrupted))
+	assert.False(exists(testBasePath + "restored"))
+	assert.True(errors.Is(engine.VerifyBackup(id+1), ErrBackupNotFound))
+	assert.Nil(db.Close())
+}
+
+// creationCountingFS counts the files created through it.
+type creationCountingFS struct {
+	FS
+	created []string
+}
+
+func (fs *creationCountingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&os.O_CREATE != 0 {
+		fs.created = append(fs.created, name)
+	}
+	return fs.FS.OpenFile(name, flag, perm)
+}
+
+func TestBackupEngineOnAnotherFSCopiesOnlyNewSegments(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	dbFS := &creationCountingFS{FS: NewMemFS()}
+	db, err := Open("db", &Options{FS: dbFS, MemtableSize: 40, SparsityFactor: 2})
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "v1"))
+	}
+	fs := &creationCountingFS{FS: NewMemFS()}
+	engine, err := OpenBackupEngineFS(fs, "backups")
+	assert.Nil(err)
+	_, err = engine.CreateNewBackup(db)
+	assert.Nil(err)
+	assert.True(len(db.segments) > 0)
+
+	// nothing but the private files is copied while the segments don't
+	// change, and the tree's FS gets no copy either
+	assert.Nil(db.Set("key0", "v2"))
+	fs.created, dbFS.created = nil, nil
+	id, err := engine.CreateNewBackup(db)
+	assert.Nil(err)
+	for _, name := range fs.created {
+		assert.NotContains(name, backupSharedDir)
+	}
+	assert.Empty(dbFS.created)
+	assert.Nil(db.Close())
+
+	assert.Nil(engine.RestoreDBFromBackup(id, "restored"))
+	restored, err := Open("restored", &Options{FS: fs})
+	assert.Nil(err)
+	val, err := restored.Get("key0")
+	assert.Nil(err)
+	assert.Equal(val, "v2")
+	val, err = restored.Get("key19")
+	assert.Nil(err)
+	assert.Equal(val, "v1")
+	assert.Nil(restored.Close())
+}
@@ -43,7 +43,11 @@ func (f *BloomFilter) Add(item string) {
 }
 
 func (f *BloomFilter) Check(item string) bool {
-	data := []byte(item)
+	return f.CheckBytes([]byte(item))
+}
+
+// CheckBytes Check for a key held in a byte slice
+func (f *BloomFilter) CheckBytes(data []byte) bool {
 	for i := 0; i < f.hashCount; i++ {
 		digest := int(Murmur332(data, uint32(i))) % f.bitArraySize
 		if !f.bit.Has(digest) {
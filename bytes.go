@@ -0,0 +1,132 @@
+package simplekv
+
+import (
+	"sync"
+	"time"
+)
+
+var pinnableSlicePool = sync.Pool{
+	New: func() any { return &PinnableSlice{} },
+}
+
+// PinnableSlice value read by GetPinned. A value read from a cached segment
+// borrows the cached bytes instead of copying them, so Data is only valid
+// until Release.
+type PinnableSlice struct {
+	data  []byte
+	block *segmentBlock
+}
+
+// Data returns the value, it must not be modified.
+func (p *PinnableSlice) Data() []byte {
+	return p.data
+}
+
+// Pinned tells whether Data borrows a cached segment.
+func (p *PinnableSlice) Pinned() bool {
+	return p.block != nil
+}
+
+// Release hands the borrowed bytes back, p must not be used afterwards.
+func (p *PinnableSlice) Release() {
+	p.data, p.block = nil, nil
+	pinnableSlicePool.Put(p)
+}
+
+// Put sets key to value, both are copied.
+func (t *Tree) Put(key, value []byte) error {
+	return t.Set(string(key), string(value))
+}
+
+// GetBytes returns a copy of the value of key.
+func (t *Tree) GetBytes(key []byte) ([]byte, error) {
+	val, err := t.Get(string(key))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(val), nil
+}
+
+// GetPinned returns the value of key without copying it out of the segment
+// cache, or ErrNotFound. The returned slice must be released once read.
+func (t *Tree) GetPinned(key []byte) (*PinnableSlice, error) {
+	defer t.observeRead("get_pinned", time.Now())
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	p := pinnableSlicePool.Get().(*PinnableSlice)
+	k := string(key)
+	t.stats.gets.add(1)
+	if got := t.memtable.Get(k); got != nil {
+		t.stats.memtableHits.add(1)
+		val, found, err := t.resolve(k, got)
+		if err != nil || !found {
+			p.Release()
+			return nil, notFound(err)
+		}
+		p.data = []byte(val)
+		return p, nil
+	}
+	if t.rangeDeleted(k) {
+		p.Release()
+		return nil, ErrNotFound
+	}
+	if !t.bloomFilter.CheckBytes(key) {
+		t.stats.bloomUseful.add(1)
+		p.Release()
+		return nil, ErrNotFound
+	}
+	for i := len(t.segments) - 1; i >= 0; i-- {
+		t.stats.segmentReads.add(1)
+		block, cached, err := t.cachedSegmentBlock(t.segments[i])
+		if err != nil {
+			p.Release()
+			return nil, err
+		}
+		line, err := block.search(k, t.opts.Comparator)
+		if err != nil {
+			p.Release()
+			return nil, err
+		}
+		if line == nil {
+			if coveredBy(t.segmentTombstones[t.segments[i]], k, t.opts.Comparator) {
+				// a range tombstone masks the older segments
+				p.Release()
+				return nil, ErrNotFound
+			}
+			continue
+		}
+		_, value, attrs, _ := splitLine(line)
+		if attrs == nil {
+			p.data = value
+			if cached {
+				p.block = block
+			}
+			return p, nil
+		}
+		// escaped or expiring values are decoded into a copy
+		rec, err := decodeRecord(string(line))
+		if err != nil {
+			p.Release()
+			return nil, err
+		}
+		val, found := t.liveValue(rec)
+		if !found {
+			p.Release()
+			return nil, ErrNotFound
+		}
+		p.data = []byte(val)
+		return p, nil
+	}
+	t.stats.bloomFalsePositives.add(1)
+	p.Release()
+	return nil, ErrNotFound
+}
+
+// notFound returns err, or ErrNotFound when err is nil.
+func notFound(err error) error {
+	if err == nil {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+package simplekv
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPutAndGetBytes(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, &Options{MemtableSize: 40, SparsityFactor: 4})
+	defer cleanup()
+	assert.Nil(err)
+
+	key := []byte("bin,key")
+	value := []byte{0, 1, ',', '\n', '%', 255}
+	assert.Nil(db.Put(key, value))
+	// the tree keeps its own copy
+	value[0] = 9
+	for i := 0; i < 10; i++ {
+		assert.Nil(db.Put([]byte(fmt.Sprintf("k%d", i)), []byte("v")))
+	}
+	assert.True(len(db.segments) > 0)
+
+	got, err := db.GetBytes(key)
+	assert.Nil(err)
+	assert.Equal(got, []byte{0, 1, ',', '\n', '%', 255})
+
+	p, err := db.GetPinned(key)
+	assert.Nil(err)
+	assert.Equal(p.Data(), []byte{0, 1, ',', '\n', '%', 255})
+	assert.False(p.Pinned())
+	p.Release()
+	assert.Nil(db.Close())
+}
+
+func TestGetPinnedBorrowsCachedSegment(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	db, err := Open(testBasePath, &Options{MemtableSize: 40, SparsityFactor: 4, Clock: clock})
+	defer cleanup()
+	assert.Nil(err)
+
+	assert.Nil(db.SetWithTTL("expiring", "v", time.Minute))
+	for i := 0; i < 10; i++ {
+		assert.Nil(db.Set(fmt.Sprintf("k%d", i), fmt.Sprint(i)))
+	}
+	assert.Nil(db.memtable.Get("k0"))
+
+	// the first read loads the segment, the second one borrows it
+	for _, pinned := range []bool{false, true} {
+		p, err := db.GetPinned([]byte("k0"))
+		assert.Nil(err)
+		assert.Equal(string(p.Data()), "0")
+		assert.Equal(p.Pinned(), pinned)
+		p.Release()
+	}
+
+	p, err := db.GetPinned([]byte("k9"))
+	assert.Nil(err)
+	assert.Equal(string(p.Data()), "9")
+	assert.False(p.Pinned())
+	p.Release()
+
+	_, err = db.GetPinned([]byte("missing"))
+	assert.Equal(err, ErrNotFound)
+
+	clock.Advance(time.Hour)
+	_, err = db.GetPinned([]byte("expiring"))
+	assert.Equal(err, ErrNotFound)
+	assert.Nil(db.Close())
+}
+
+func TestGetPinnedCopiesSegmentsTooLargeToCache(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open("db", &Options{CacheSize: 1, FS: NewMemFS()})
+	assert.Nil(err)
+	assert.Nil(db.Set("key", "value"))
+	assert.Nil(db.flush())
+	for i := 0; i < 2; i++ {
+		p, err := db.GetPinned([]byte("key"))
+		assert.Nil(err)
+		assert.Equal(string(p.Data()), "value")
+		assert.False(p.Pinned())
+		p.Release()
+	}
+	assert.Nil(db.Close())
+}
+
+// benchTree returns a tree whose keys all live in cached segments.
+func benchTree(b *testing.B) *Tree {
+	db, err := Open(testBasePath, &Options{MemtableSize: 4096})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		err = db.Set(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%04d", i))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return db
+}
+
+func BenchmarkGet(b *testing.B) {
+	db := benchTree(b)
+	defer cleanup()
+	defer db.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get("key0042"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetBytes(b *testing.B) {
+	db := benchTree(b)
+	defer cleanup()
+	defer db.Close()
+	key := []byte("key0042")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.GetBytes(key); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetPinned(b *testing.B) {
+	db := benchTree(b)
+	defer cleanup()
+	defer db.Close()
+	key := []byte("key0042")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p, err := db.GetPinned(key)
+		if err != nil {
+			b.Fatal(err)
+		}
+		p.Release()
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	db, err := Open(testBasePath, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer cleanup()
+	defer db.Close()
+	key, value := []byte("key"), []byte("value")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.Put(key, value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
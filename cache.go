@@ -0,0 +1,156 @@
+package simplekv
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+)
+
+// segmentCache LRU cache of segment file contents keyed by path, so that
+// binarySearchSegment does not read the whole file on every miss.
+type segmentCache struct {
+	mu       sync.Mutex
+	capacity int
+	size     int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type cacheEntry struct {
+	path  string
+	block *segmentBlock
+}
+
+// segmentBlock content of a segment with the offsets its lines start at,
+// it is never modified so readers may borrow it after it is evicted
+type segmentBlock struct {
+	data  []byte
+	lines []int
+	// start is the first line holding a key, the range tombstones at the
+	// head of the segment come before it
+	start int
+}
+
+func newSegmentBlock(data []byte) *segmentBlock {
+	b := &segmentBlock{data: data}
+	for start := 0; start < len(data); {
+		b.lines = append(b.lines, start)
+		end := bytes.IndexByte(data[start:], '\n')
+		if end < 0 {
+			break
+		}
+		start += end + 1
+	}
+	for b.start < len(b.lines) {
+		_, _, attrs, err := splitLine(b.line(b.start))
+		if err != nil || !hasAttr(attrs, "k", recordKindNames[kindRangeDelete]) {
+			break
+		}
+		b.start++
+	}
+	return b
+}
+
+// line returns the i-th line without its newline.
+func (b *segmentBlock) line(i int) []byte {
+	end := len(b.data)
+	if i+1 < len(b.lines) {
+		end = b.lines[i+1]
+	}
+	return bytes.TrimSuffix(b.data[b.lines[i]:end], []byte("\n"))
+}
+
+// search binary searches the lines of the block, sorted by cmp, for key and
+// returns its line, nil when absent. It doesn't allocate unless keys are
+// escaped or the comparator is not bytewise.
+func (b *segmentBlock) search(key string, cmp Comparator) ([]byte, error) {
+	lo, hi := b.start, len(b.lines)
+	for lo < hi {
+		ptr := lo + (hi-lo-1)/2
+		line := b.line(ptr)
+		raw, _, attrs, err := splitLine(line)
+		if err != nil {
+			return nil, err
+		}
+		switch c := compareField(raw, hasAttr(attrs, "f", "1"), key, cmp); {
+		case c == 0:
+			return line, nil
+		case c > 0:
+			hi = ptr
+		default:
+			lo = ptr + 1
+		}
+	}
+	return nil, nil
+}
+
+// newSegmentCache new cache holding at most capacity bytes
+func newSegmentCache(capacity int) *segmentCache {
+	return &segmentCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+// Get returns the cached contents of path.
+func (c *segmentCache) Get(path string) ([]byte, bool) {
+	block, ok := c.GetBlock(path)
+	if !ok {
+		return nil, false
+	}
+	return block.data, true
+}
+
+// GetBlock returns the cached block of path.
+func (c *segmentCache) GetBlock(path string) (*segmentBlock, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[path]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).block, true
+}
+
+// Put caches data for path, files larger than the whole cache are skipped.
+func (c *segmentCache) Put(path string, data []byte) {
+	c.PutBlock(path, newSegmentBlock(data))
+}
+
+// PutBlock caches block for path.
+func (c *segmentCache) PutBlock(path string, block *segmentBlock) {
+	if len(block.data) > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[path]; ok {
+		c.removeElement(elem)
+	}
+	c.items[path] = c.ll.PushFront(&cacheEntry{path: path, block: block})
+	c.size += len(block.data)
+	for c.size > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Evict drops path from the cache, it must be called whenever a segment
+// file is rewritten or removed.
+func (c *segmentCache) Evict(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[path]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *segmentCache) removeElement(elem *list.Element) {
+	entry := c.ll.Remove(elem).(*cacheEntry)
+	delete(c.items, entry.path)
+	c.size -= len(entry.block.data)
+}
@@ -0,0 +1,34 @@
+package simplekv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegmentCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newSegmentCache(10)
+	c.Put("a", []byte("1234"))
+	c.Put("b", []byte("5678"))
+	_, ok := c.Get("a")
+	assert.True(ok)
+
+	c.Put("c", []byte("90"))
+	c.Put("d", []byte("12"))
+	_, ok = c.Get("b")
+	assert.False(ok)
+	data, ok := c.Get("a")
+	assert.True(ok)
+	assert.Equal(string(data), "1234")
+
+	c.Evict("a")
+	_, ok = c.Get("a")
+	assert.False(ok)
+	assert.Equal(c.size, 4)
+
+	c.Put("big", make([]byte, 11))
+	_, ok = c.Get("big")
+	assert.False(ok)
+}
@@ -0,0 +1,142 @@
+package simplekv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrCheckpointExists is returned by Checkpoint when the target directory
+// already exists.
+var ErrCheckpointExists = errors.New("checkpoint directory already exists")
+
+// Checkpoint writes a point-in-time copy of the tree to dir, which must not
+// exist yet. Writes are held while the copy is taken: segments are never
+// modified once written, so they are hard linked (copied when dir is on
+// another filesystem), while the WAL and the metadata are copied so that
+// NewTree on dir opens exactly what the tree held.
+func (t *Tree) Checkpoint(dir string) error {
+	if t.secondary != nil {
+		return fmt.Errorf("%w: checkpoint a secondary", ErrReadOnly)
+	}
+	if dir == "" {
+		return fmt.Errorf("%w: empty checkpoint directory", ErrInvalidOptions)
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	fs := t.opts.FS
+	if fileExists(fs, dir) {
+		return fmt.Errorf("%w: %s", ErrCheckpointExists, dir)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// build the checkpoint aside so a failure never leaves a partial one
+	tempDir := dir + ".tmp/"
+	err := fs.RemoveAll(tempDir)
+	if err != nil {
+		return fmt.Errorf("remove dir: %s err: %s", tempDir, err)
+	}
+	err = fs.MkdirAll(tempDir, 0777)
+	if err != nil {
+		return fmt.Errorf("make dir: %s err: %s", tempDir, err)
+	}
+	err = t.checkpointTo(tempDir)
+	if err != nil {
+		fs.RemoveAll(tempDir)
+		return err
+	}
+	err = fs.Rename(tempDir, dir)
+	if err != nil {
+		fs.RemoveAll(tempDir)
+		return fmt.Errorf("rename checkpoint dir err: %s", err)
+	}
+	return nil
+}
+
+func (t *Tree) checkpointTo(dir string) error {
+	fs := t.opts.FS
+	for _, segment := range t.segments {
+		err := linkOrCopyFile(fs, t.segmentPath(segment), dir+segment)
+		if err != nil {
+			return err
+		}
+	}
+	if fileExists(fs, t.memtableWalPath()) {
+		err := copyFile(fs, t.memtableWalPath(), fs, dir+t.walBasename)
+		if err != nil {
+			return err
+		}
+	}
+	if fileExists(fs, t.optionsPath()) {
+		err := copyFile(fs, t.optionsPath(), fs, dir+optionsFilename)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, tree := range t.familyTrees()[1:] {
+		familyDir := dir + strings.TrimPrefix(tree.segmentsDirectory, t.segmentsDirectory)
+		err := fs.MkdirAll(familyDir, 0777)
+		if err != nil {
+			return fmt.Errorf("make dir: %s err: %s", familyDir, err)
+		}
+		err = tree.checkpointTo(familyDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	bytes, err := t.dumpMetadata()
+	if err == nil {
+		bytes, err = t.sealFile(bytes)
+	}
+	if err != nil {
+		return err
+	}
+	err = writeFile(fs, dir+metadataFilename, bytes)
+	if err != nil {
+		return fmt.Errorf("write file err: %s", err)
+	}
+	return nil
+}
+
+// linkOrCopyFile hard links src to dst, falling back to a copy when linking
+// is not possible, e.g. across filesystems.
+func linkOrCopyFile(fs FS, src, dst string) error {
+	if err := fs.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(fs, src, fs, dst)
+}
+
+// copyFile copies src of srcFS to a new file dst of dstFS and syncs it.
+func copyFile(srcFS FS, src string, dstFS FS, dst string) error {
+	in, err := srcFS.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("open file err: %s", err)
+	}
+	defer in.Close()
+
+	out, err := dstFS.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("create file err: %s", err)
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return fmt.Errorf("copy file %s err: %s", src, err)
+	}
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+		return fmt.Errorf("flush file err: %s", err)
+	}
+	err = out.Close()
+	if err != nil {
+		return fmt.Errorf("close file err: %s", err)
+	}
+	return nil
+}
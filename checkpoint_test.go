@@ -0,0 +1,51 @@
+package simplekv
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpointOpensPointInTimeCopy(t *testing.T) {
+	assert := assert.New(t)
+	checkpointDir := testBasePath + "checkpoint/"
+	db, err := NewTree(testFilename, testBasePath+"db/", bkupName)
+	defer cleanup()
+	assert.Nil(err)
+	db.threshold = 40
+	for i := 0; i < 20; i++ {
+		err = db.Set("key"+strconv.Itoa(i), "v1")
+		assert.Nil(err)
+	}
+	assert.NotEqual(len(db.segments), 0)
+
+	err = db.Checkpoint(checkpointDir)
+	assert.Nil(err)
+	err = db.Checkpoint(checkpointDir)
+	assert.True(errors.Is(err, ErrCheckpointExists))
+
+	// later writes, flushes and compactions don't reach the checkpoint
+	for i := 0; i < 30; i++ {
+		err = db.Set("key"+strconv.Itoa(i), "v2")
+		assert.Nil(err)
+	}
+
+	copied, err := NewTree(testFilename, checkpointDir, bkupName)
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		val, err := copied.Get("key" + strconv.Itoa(i))
+		assert.Nil(err)
+		assert.Equal(val, "v1")
+	}
+	val, err := copied.Get("key25")
+	assert.Equal(err, ErrNotFound)
+	assert.Equal(val, "")
+
+	val, err = db.Get("key0")
+	assert.Nil(err)
+	assert.Equal(val, "v2")
+	assert.Nil(copied.Close())
+	assert.Nil(db.Close())
+}
@@ -0,0 +1,432 @@
+package simplekv
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrColumnFamilyExists is returned by CreateColumnFamily for a taken name.
+	ErrColumnFamilyExists = errors.New("column family already exists")
+	// ErrColumnFamilyNotFound is returned for names the tree doesn't hold.
+	ErrColumnFamilyNotFound = errors.New("column family not found")
+	// ErrColumnFamilyDropped is returned by the handle of a dropped family.
+	ErrColumnFamilyDropped = errors.New("column family dropped")
+)
+
+// DefaultColumnFamilyName names the column family of the tree itself.
+const DefaultColumnFamilyName = "default"
+
+// ColumnFamily handle of a column family: a keyspace with its own memtable,
+// segments and options, stored in the cf-<id> directory of the tree. All
+// the families of a tree share its WAL and lock.
+type ColumnFamily struct {
+	name    string
+	id      uint32
+	tree    *Tree
+	dropped int32
+}
+
+type columnFamilyMetadata struct {
+	ID   uint32
+	Name string
+}
+
+// columnFamilies the column families of a tree, held by its default family
+type columnFamilies struct {
+	defaultFamily *ColumnFamily
+	byName        map[string]*ColumnFamily
+	byID          map[uint32]*ColumnFamily
+	nextID        uint32
+	// families listed by the metadata, opened by openColumnFamilies
+	loaded []*columnFamilyMetadata
+}
+
+func newColumnFamilies(t *Tree) *columnFamilies {
+	return &columnFamilies{
+		defaultFamily: &ColumnFamily{name: DefaultColumnFamilyName, tree: t},
+		byName:        map[string]*ColumnFamily{},
+		byID:          map[uint32]*ColumnFamily{},
+		nextID:        1,
+	}
+}
+
+func (f *columnFamilies) load(meta *treeMetadata) {
+	f.loaded = meta.ColumnFamilies
+	if meta.NextColumnFamilyID > f.nextID {
+		f.nextID = meta.NextColumnFamilyID
+	}
+}
+
+func (f *columnFamilies) dump(meta *treeMetadata) {
+	for _, cf := range f.sorted() {
+		meta.ColumnFamilies = append(meta.ColumnFamilies,
+			&columnFamilyMetadata{ID: cf.id, Name: cf.name})
+	}
+	meta.NextColumnFamilyID = f.nextID
+}
+
+func (f *columnFamilies) add(cf *ColumnFamily) {
+	f.byName[cf.name] = cf
+	f.byID[cf.id] = cf
+}
+
+func (f *columnFamilies) remove(cf *ColumnFamily) {
+	delete(f.byName, cf.name)
+	delete(f.byID, cf.id)
+}
+
+// sorted returns the families other than the default one by id.
+func (f *columnFamilies) sorted() []*ColumnFamily {
+	families := make([]*ColumnFamily, 0, len(f.byID))
+	for _, cf := range f.byID {
+		families = append(families, cf)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].id < families[j].id })
+	return families
+}
+
+// root returns the tree of the default column family.
+func (t *Tree) root() *Tree {
+	if t.parent != nil {
+		return t.parent
+	}
+	return t
+}
+
+// familyTrees returns the trees of every column family, default first.
+func (t *Tree) familyTrees() []*Tree {
+	trees := []*Tree{t}
+	if t.families != nil {
+		for _, cf := range t.families.sorted() {
+			trees = append(trees, cf.tree)
+		}
+	}
+	return trees
+}
+
+// columnFamilyName returns the name of the column family of t.
+func (t *Tree) columnFamilyName() string {
+	if t.parent == nil {
+		return DefaultColumnFamilyName
+	}
+	if cf, ok := t.parent.families.byID[t.cfID]; ok {
+		return cf.name
+	}
+	return ""
+}
+
+// familyTree returns the tree of the column family id, nil when unknown.
+func (t *Tree) familyTree(id uint32) *Tree {
+	if id == t.cfID {
+		return t
+	}
+	if t.families == nil {
+		return nil
+	}
+	if cf, ok := t.families.byID[id]; ok {
+		return cf.tree
+	}
+	return nil
+}
+
+// openColumnFamilies opens the families listed by the metadata.
+func (t *Tree) openColumnFamilies() error {
+	for _, meta := range t.families.loaded {
+		opts, err := t.columnFamilyOptions(meta)
+		if err != nil {
+			return err
+		}
+		cf, err := t.openColumnFamily(meta, opts)
+		if err != nil {
+			return fmt.Errorf("open column family: %s err: %w", meta.Name, err)
+		}
+		t.families.add(cf)
+	}
+	t.families.loaded = nil
+	return nil
+}
+
+// columnFamilyOptions returns the options to reopen a family with: the ones
+// of Options.ColumnFamilyOptions, else its OPTIONS file completed with the
+// fields of the tree options that are not persisted.
+func (t *Tree) columnFamilyOptions(meta *columnFamilyMetadata) (*Options, error) {
+	if opts, ok := t.opts.ColumnFamilyOptions[meta.Name]; ok {
+		return t.inheritOptions(opts), nil
+	}
+	path := t.columnFamilyDir(meta.ID) + optionsFilename
+	if !fileExists(t.opts.FS, path) {
+		return t.inheritOptions(nil), nil
+	}
+	opts, err := loadOptions(t.opts.FS, path)
+	if err != nil {
+		return nil, err
+	}
+	return t.inheritOptions(opts), nil
+}
+
+// inheritOptions returns a copy of opts whose unset non persisted fields
+// are taken from the tree options, nil opts means the tree options.
+func (t *Tree) inheritOptions(opts *Options) *Options {
+	if opts == nil {
+		inherited := *t.opts
+		inherited.ColumnFamilyOptions = nil
+		return &inherited
+	}
+	inherited := *opts
+	if inherited.Comparator == nil {
+		inherited.Comparator = t.opts.Comparator
+	}
+	if inherited.MergeOperator == nil {
+		inherited.MergeOperator = t.opts.MergeOperator
+	}
+	if inherited.CompactionFilter == nil {
+		inherited.CompactionFilter = t.opts.CompactionFilter
+	}
+	if inherited.Logger == nil {
+		inherited.Logger = t.opts.Logger
+	}
+	if inherited.Clock == nil {
+		inherited.Clock = t.opts.Clock
+	}
+	if inherited.KeyProvider == nil {
+		inherited.KeyProvider = t.opts.KeyProvider
+	}
+	if inherited.EventListeners == nil {
+		inherited.EventListeners = t.opts.EventListeners
+	}
+	// families live in the directory of the tree
+	inherited.FS = t.opts.FS
+	return &inherited
+}
+
+// openColumnFamily opens the segments of a family, its memtable is filled
+// by the WAL replay of the tree.
+func (t *Tree) openColumnFamily(meta *columnFamilyMetadata, opts *Options) (*ColumnFamily, error) {
+	dir := t.columnFamilyDir(meta.ID)
+	child, err := newTree(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	child.mu = t.mu
+	child.parent = t
+	child.cfID = meta.ID
+	child.appendLog = t.appendLog
+	child.stats = t.stats
+	child.readOnly = t.readOnly
+
+	if !t.readOnly {
+		err = t.opts.FS.MkdirAll(dir, 0777)
+		if err != nil {
+			return nil, fmt.Errorf("make dir: %s err: %s", dir, err)
+		}
+	}
+	err = child.loadMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if !t.readOnly {
+		err = child.opts.save(child.opts.FS, child.optionsPath())
+		if err != nil {
+			return nil, err
+		}
+	}
+	child.family = &ColumnFamily{name: meta.Name, id: meta.ID, tree: child}
+	return child.family, nil
+}
+
+// Returns the directory of the column family id.
+func (t *Tree) columnFamilyDir(id uint32) string {
+	return t.segmentsDirectory + "cf-" + strconv.FormatUint(uint64(id), 10) + "/"
+}
+
+// CreateColumnFamily creates the column family name, tuned by opts. A nil
+// opts means the options of the tree.
+func (t *Tree) CreateColumnFamily(name string, opts *Options) (*ColumnFamily, error) {
+	if t.readOnly || t.families == nil {
+		return nil, ErrReadOnly
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w: empty column family name", ErrInvalidOptions)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.families.byName[name]; ok || name == DefaultColumnFamilyName {
+		return nil, fmt.Errorf("%w: %s", ErrColumnFamilyExists, name)
+	}
+	meta := &columnFamilyMetadata{ID: t.families.nextID, Name: name}
+	cf, err := t.openColumnFamily(meta, t.inheritOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	err = cf.tree.saveMetadata()
+	if err != nil {
+		return nil, err
+	}
+	t.families.add(cf)
+	t.families.nextID++
+	// the family exists once the metadata of the tree lists it
+	err = t.saveMetadata()
+	if err != nil {
+		t.families.remove(cf)
+		return nil, err
+	}
+	t.opts.Logger.Info("column family created", "name", name, "id", meta.ID)
+	return cf, nil
+}
+
+// DropColumnFamily drops cf and deletes its files, the other families are
+// left untouched. The handle returns ErrColumnFamilyDropped afterwards.
+func (t *Tree) DropColumnFamily(cf *ColumnFamily) error {
+	if t.readOnly || t.families == nil {
+		return ErrReadOnly
+	}
+	if cf.tree == t {
+		return fmt.Errorf("%w: the default column family can't be dropped", ErrInvalidOptions)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.families.byID[cf.id] != cf {
+		return fmt.Errorf("%w: %s", ErrColumnFamilyNotFound, cf.name)
+	}
+	t.families.remove(cf)
+	err := t.saveMetadata()
+	if err != nil {
+		t.families.add(cf)
+		return err
+	}
+	atomic.StoreInt32(&cf.dropped, 1)
+	// records of the family left in the WAL are skipped by the replay
+	err = t.opts.FS.RemoveAll(t.columnFamilyDir(cf.id))
+	if err != nil {
+		return fmt.Errorf("remove dir: %s err: %s", t.columnFamilyDir(cf.id), err)
+	}
+	t.opts.Logger.Info("column family dropped", "name", cf.name, "id", cf.id)
+	return nil
+}
+
+// ColumnFamily returns the handle of the column family name.
+func (t *Tree) ColumnFamily(name string) (*ColumnFamily, error) {
+	if name == DefaultColumnFamilyName {
+		return t.DefaultColumnFamily(), nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.families != nil {
+		if cf, ok := t.families.byName[name]; ok {
+			return cf, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrColumnFamilyNotFound, name)
+}
+
+// DefaultColumnFamily returns the handle of the tree itself.
+func (t *Tree) DefaultColumnFamily() *ColumnFamily {
+	if t.families == nil {
+		return &ColumnFamily{name: DefaultColumnFamilyName, tree: t}
+	}
+	return t.families.defaultFamily
+}
+
+// ListColumnFamilies returns the names of the column families, default
+// first.
+func (t *Tree) ListColumnFamilies() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	names := []string{DefaultColumnFamilyName}
+	if t.families != nil {
+		for _, cf := range t.families.sorted() {
+			names = append(names, cf.name)
+		}
+	}
+	return names
+}
+
+// Name returns the name of the column family.
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+func (cf *ColumnFamily) check() error {
+	if atomic.LoadInt32(&cf.dropped) != 0 {
+		return fmt.Errorf("%w: %s", ErrColumnFamilyDropped, cf.name)
+	}
+	return nil
+}
+
+// checkFamily fails once the column family of t is dropped. Writes check it
+// holding t.mu, like DropColumnFamily does, so that none is acknowledged
+// and then lost with the family.
+func (t *Tree) checkFamily() error {
+	if t.family == nil {
+		return nil
+	}
+	return t.family.check()
+}
+
+// Get returns the value of key in the column family, or ErrNotFound.
+func (cf *ColumnFamily) Get(key string) (string, error) {
+	if err := cf.check(); err != nil {
+		return "", err
+	}
+	return cf.tree.Get(key)
+}
+
+// Has tells whether key is present in the column family.
+func (cf *ColumnFamily) Has(key string) (bool, error) {
+	if err := cf.check(); err != nil {
+		return false, err
+	}
+	return cf.tree.Has(key)
+}
+
+// Set sets key to value in the column family.
+func (cf *ColumnFamily) Set(key, value string) error {
+	return cf.tree.Set(key, value)
+}
+
+// SetWithTTL sets key to value in the column family for ttl.
+func (cf *ColumnFamily) SetWithTTL(key, value string, ttl time.Duration) error {
+	return cf.tree.SetWithTTL(key, value, ttl)
+}
+
+// Delete removes key from the column family.
+func (cf *ColumnFamily) Delete(key string) error {
+	return cf.tree.Delete(key)
+}
+
+// DeleteRange deletes the keys of the column family from start, inclusive,
+// to end, exclusive.
+func (cf *ColumnFamily) DeleteRange(start, end string) error {
+	return cf.tree.DeleteRange(start, end)
+}
+
+// Merge records operand for key in the column family.
+func (cf *ColumnFamily) Merge(key, operand string) error {
+	return cf.tree.Merge(key, operand)
+}
+
+// NewIterator returns an iterator over the column family.
+func (cf *ColumnFamily) NewIterator() (*Iterator, error) {
+	if err := cf.check(); err != nil {
+		return nil, err
+	}
+	return cf.tree.NewIterator()
+}
+
+// GetProperty returns the value of the property name of the column family,
+// see Tree.GetProperty.
+func (cf *ColumnFamily) GetProperty(name string) (string, bool) {
+	if err := cf.check(); err != nil {
+		return "", false
+	}
+	return cf.tree.GetProperty(name)
+}
@@ -0,0 +1,251 @@
+package simplekv
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestColumnFamiliesKeepSeparateKeyspaces(t *testing.T) {
+	assert := assert.New(t)
+	defer cleanup()
+	db, err := Open(testBasePath, &Options{MemtableSize: 200, SparsityFactor: 4})
+	assert.Nil(err)
+
+	users, err := db.CreateColumnFamily("users", &Options{MemtableSize: 60, SparsityFactor: 2})
+	assert.Nil(err)
+	_, err = db.CreateColumnFamily("users", nil)
+	assert.True(errors.Is(err, ErrColumnFamilyExists))
+	_, err = db.CreateColumnFamily(DefaultColumnFamilyName, nil)
+	assert.True(errors.Is(err, ErrColumnFamilyExists))
+	orders, err := db.CreateColumnFamily("orders", nil)
+	assert.Nil(err)
+	assert.Equal(db.ListColumnFamilies(), []string{"default", "users", "orders"})
+
+	for i := 0; i < 30; i++ {
+		k := "key" + strconv.Itoa(i)
+		assert.Nil(db.Set(k, "default"))
+		assert.Nil(users.Set(k, "user"))
+	}
+	assert.Nil(orders.Set("key0", "order"))
+	assert.Nil(users.Delete("key1"))
+	assert.True(len(users.tree.segments) > 0)
+
+	val, err := db.Get("key0")
+	assert.Nil(err)
+	assert.Equal(val, "default")
+	val, err = users.Get("key0")
+	assert.Nil(err)
+	assert.Equal(val, "user")
+	val, err = orders.Get("key0")
+	assert.Nil(err)
+	assert.Equal(val, "order")
+	_, err = orders.Get("key2")
+	assert.Equal(err, ErrNotFound)
+	_, err = users.Get("key1")
+	assert.Equal(err, ErrNotFound)
+
+	iter, err := orders.NewIterator()
+	assert.Nil(err)
+	var keys []string
+	for iter.Next() {
+		keys = append(keys, iter.Key())
+	}
+	assert.Equal(keys, []string{"key0"})
+	assert.Nil(db.Close())
+
+	// the families and their options come back on reopen
+	db, err = Open(testBasePath, &Options{MemtableSize: 200, SparsityFactor: 4})
+	assert.Nil(err)
+	assert.Equal(db.ListColumnFamilies(), []string{"default", "users", "orders"})
+	users, err = db.ColumnFamily("users")
+	assert.Nil(err)
+	assert.Equal(users.tree.threshold, 60)
+	orders, err = db.ColumnFamily("orders")
+	assert.Nil(err)
+	for i := 2; i < 30; i++ {
+		val, err := users.Get("key" + strconv.Itoa(i))
+		assert.Nil(err)
+		assert.Equal(val, "user")
+	}
+	_, err = users.Get("key1")
+	assert.Equal(err, ErrNotFound)
+	val, err = orders.Get("key0")
+	assert.Nil(err)
+	assert.Equal(val, "order")
+	_, err = db.ColumnFamily("missing")
+	assert.True(errors.Is(err, ErrColumnFamilyNotFound))
+	assert.Nil(db.Close())
+}
+
+func TestWriteBatchIsAtomicAcrossColumnFamilies(t *testing.T) {
+	assert := assert.New(t)
+	defer cleanup()
+	db, err := Open(testBasePath, nil)
+	assert.Nil(err)
+	accounts, err := db.CreateColumnFamily("accounts", nil)
+	assert.Nil(err)
+	assert.Nil(db.Set("stale", "v"))
+
+	b := NewWriteBatch()
+	b.Set("a", "1")
+	b.Delete("stale")
+	b.SetCF(accounts, "alice", "10")
+	b.SetCF(accounts, "bob", "20")
+	assert.Equal(b.Count(), 4)
+	assert.Nil(db.Write(b))
+
+	val, err := accounts.Get("bob")
+	assert.Nil(err)
+	assert.Equal(val, "20")
+	_, err = db.Get("stale")
+	assert.Equal(err, ErrNotFound)
+
+	// a batch torn by a crash is dropped entirely by the replay
+	b = NewWriteBatch()
+	b.SetCF(accounts, "alice", "0")
+	b.SetCF(accounts, "carol", "30")
+	assert.Nil(db.Write(b))
+	assert.Nil(db.appendLog.Sync())
+	info, err := os.Stat(db.memtableWalPath())
+	assert.Nil(err)
+	assert.Nil(os.Truncate(db.memtableWalPath(), info.Size()-5))
+	assert.Nil(db.lock.release())
+	db.appendLog.Close()
+
+	db, err = Open(testBasePath, nil)
+	assert.Nil(err)
+	accounts, err = db.ColumnFamily("accounts")
+	assert.Nil(err)
+	val, err = accounts.Get("alice")
+	assert.Nil(err)
+	assert.Equal(val, "10")
+	_, err = accounts.Get("carol")
+	assert.Equal(err, ErrNotFound)
+	val, err = db.Get("a")
+	assert.Nil(err)
+	assert.Equal(val, "1")
+	assert.Nil(db.Close())
+}
+
+func TestReplaySkipsTornBatchFollowedByRecords(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	assert.Nil(fs.MkdirAll("db", 0777))
+	// the batch ending at sequence number 2 lost its last record, the
+	// records written after it must not complete it
+	wal := "x,1,b=2;s=1\n" + "y,2,b=4;s=3\n" + "z,3,b=4;s=4\n" + "w,4,s=5\n"
+	assert.Nil(writeFile(fs, "db/wal", []byte(wal)))
+
+	db, err := Open("db", &Options{FS: fs})
+	assert.Nil(err)
+	_, err = db.Get("x")
+	assert.Equal(err, ErrNotFound)
+	for key, value := range map[string]string{"y": "2", "z": "3", "w": "4"} {
+		val, err := db.Get(key)
+		assert.Nil(err, key)
+		assert.Equal(val, value, key)
+	}
+	assert.Equal(db.lastSequence, uint64(5))
+
+	// the batch is dropped again once new writes follow it
+	assert.Nil(db.Set("v", "5"))
+	assert.Nil(db.Close())
+	db, err = Open("db", &Options{FS: fs})
+	assert.Nil(err)
+	_, err = db.Get("x")
+	assert.Equal(err, ErrNotFound)
+	val, err := db.Get("v")
+	assert.Nil(err)
+	assert.Equal(val, "5")
+	assert.Nil(db.Close())
+}
+
+func TestDropColumnFamilyDeletesItsFiles(t *testing.T) {
+	assert := assert.New(t)
+	defer cleanup()
+	db, err := Open(testBasePath, &Options{MemtableSize: 60, SparsityFactor: 2})
+	assert.Nil(err)
+	logs, err := db.CreateColumnFamily("logs", nil)
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(logs.Set("key"+strconv.Itoa(i), "log"))
+	}
+	assert.Nil(db.Set("kept", "v"))
+	dir := db.columnFamilyDir(logs.id)
+	assert.True(exists(dir))
+	segments := len(db.segments)
+
+	assert.Nil(db.DropColumnFamily(logs))
+	assert.False(exists(dir))
+	assert.Equal(len(db.segments), segments)
+	assert.Equal(db.ListColumnFamilies(), []string{"default"})
+	_, err = logs.Get("key0")
+	assert.True(errors.Is(err, ErrColumnFamilyDropped))
+	assert.True(errors.Is(logs.Set("key0", "v"), ErrColumnFamilyDropped))
+	assert.True(errors.Is(logs.DeleteRange("a", "z"), ErrColumnFamilyDropped))
+	b := NewWriteBatch()
+	b.Set("kept", "lost")
+	b.SetCF(logs, "key0", "v")
+	assert.True(errors.Is(db.Write(b), ErrColumnFamilyDropped))
+	assert.True(errors.Is(db.DropColumnFamily(logs), ErrColumnFamilyNotFound))
+	assert.NotNil(db.DropColumnFamily(db.DefaultColumnFamily()))
+	assert.Nil(db.Close())
+
+	// the records of the dropped family left in the WAL are skipped
+	db, err = Open(testBasePath, &Options{MemtableSize: 60, SparsityFactor: 2})
+	assert.Nil(err)
+	assert.Equal(db.ListColumnFamilies(), []string{"default"})
+	val, err := db.Get("kept")
+	assert.Nil(err)
+	assert.Equal(val, "v")
+	_, err = db.Get("key19")
+	assert.Equal(err, ErrNotFound)
+
+	// ids are not reused
+	metrics, err := db.CreateColumnFamily("logs", nil)
+	assert.Nil(err)
+	assert.NotEqual(metrics.id, logs.id)
+	_, err = metrics.Get("key19")
+	assert.Equal(err, ErrNotFound)
+	assert.Nil(db.Close())
+}
+
+func TestBackupRestoresColumnFamilies(t *testing.T) {
+	assert := assert.New(t)
+	defer cleanup()
+	opts := &Options{MemtableSize: 60, SparsityFactor: 2}
+	db, err := Open(testBasePath+"db/", opts)
+	assert.Nil(err)
+	users, err := db.CreateColumnFamily("users", nil)
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(users.Set("key"+strconv.Itoa(i), "user"))
+	}
+	assert.Nil(db.Set("key0", "default"))
+
+	engine, err := OpenBackupEngine(testBasePath + "backups/")
+	assert.Nil(err)
+	id, err := engine.CreateNewBackup(db)
+	assert.Nil(err)
+	assert.Nil(engine.RestoreDBFromBackup(id, testBasePath+"restored"))
+
+	restored, err := Open(testBasePath+"restored/", opts)
+	assert.Nil(err)
+	users, err = restored.ColumnFamily("users")
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		val, err := users.Get("key" + strconv.Itoa(i))
+		assert.Nil(err)
+		assert.Equal(val, "user")
+	}
+	val, err := restored.Get("key0")
+	assert.Nil(err)
+	assert.Equal(val, "default")
+	assert.Nil(restored.Close())
+	assert.Nil(db.Close())
+}
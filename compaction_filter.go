@@ -0,0 +1,67 @@
+package simplekv
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CompactionDecision tells what compaction does with a record.
+type CompactionDecision int
+
+const (
+	// CompactionKeep keeps the record as it is.
+	CompactionKeep CompactionDecision = iota
+	// CompactionRemove drops the record.
+	CompactionRemove
+	// CompactionChangeValue keeps the record with the returned value.
+	CompactionChangeValue
+)
+
+// CompactionFilter drops or rewrites records while segments are compacted,
+// i.e. when keys are deleted from older segments on flush and when segments
+// are merged. Expired records are dropped before the filter sees them.
+type CompactionFilter interface {
+	// Name identifies the filter in logs.
+	Name() string
+	// Filter decides the fate of key. level is the depth of the segment
+	// being compacted: 0 for the newest segment, growing with age.
+	Filter(level int, key, value string) (decision CompactionDecision, newValue string)
+}
+
+// compactRecord applies expiry and the compaction filter to rec, it returns
+// the record to write or nil to drop it.
+func (t *Tree) compactRecord(rec *record, level int, now time.Time) (*record, error) {
+	if rec.expired(now) {
+		return nil, nil
+	}
+	filter := t.opts.CompactionFilter
+	if filter == nil {
+		return rec, nil
+	}
+	decision, newValue := filter.Filter(level, rec.key, rec.value)
+	switch decision {
+	case CompactionKeep:
+		return rec, nil
+	case CompactionRemove:
+		return nil, nil
+	case CompactionChangeValue:
+		changed := *rec
+		changed.value = newValue
+		return &changed, nil
+	default:
+		return nil, fmt.Errorf("compaction filter %s returned unknown decision %d",
+			filter.Name(), decision)
+	}
+}
+
+// segmentLevel returns the depth of segment, 0 for the newest one.
+func (t *Tree) segmentLevel(segment string) int {
+	segment = strings.TrimPrefix(segment, t.segmentsDirectory)
+	for i, s := range t.segments {
+		if s == segment {
+			return len(t.segments) - 1 - i
+		}
+	}
+	return 0
+}
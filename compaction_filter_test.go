@@ -0,0 +1,111 @@
+package simplekv
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type tenantFilter struct {
+	levels map[int]int
+}
+
+func (f *tenantFilter) Name() string {
+	return "tenant-filter"
+}
+
+func (f *tenantFilter) Filter(level int, key, value string) (CompactionDecision, string) {
+	f.levels[level]++
+	if strings.HasPrefix(key, "tenant42/") {
+		return CompactionRemove, ""
+	}
+	if strings.HasPrefix(key, "old/") {
+		return CompactionChangeValue, "downgraded"
+	}
+	return CompactionKeep, ""
+}
+
+func TestCompactionFilterDropsAndRewritesRecords(t *testing.T) {
+	assert := assert.New(t)
+	for _, strategy := range []CompactionStrategy{CompactionDeleteKeys, CompactionMergeSegments} {
+		filter := &tenantFilter{levels: map[int]int{}}
+		db, err := Open(testBasePath, &Options{
+			MemtableSize:       60,
+			SparsityFactor:     10,
+			CompactionStrategy: strategy,
+			CompactionFilter:   filter,
+		})
+		assert.Nil(err)
+		for i := 0; i < 5; i++ {
+			assert.Nil(db.Set(fmt.Sprintf("tenant42/%d", i), "v"))
+			assert.Nil(db.Set(fmt.Sprintf("tenant7/%d", i), "v"))
+			assert.Nil(db.Set(fmt.Sprintf("old/%d", i), "v"))
+		}
+		// enough writes for every segment to be compacted at least once
+		for i := 0; i < 40; i++ {
+			assert.Nil(db.Set(fmt.Sprintf("pad/%02d", i), "v"))
+		}
+
+		for i := 0; i < 5; i++ {
+			val, err := db.Get(fmt.Sprintf("tenant42/%d", i))
+			assert.Equal(err, ErrNotFound, strategy.String())
+			assert.Equal(val, "", strategy.String())
+			val, err = db.Get(fmt.Sprintf("tenant7/%d", i))
+			assert.Nil(err)
+			assert.Equal(val, "v", strategy.String())
+			val, err = db.Get(fmt.Sprintf("old/%d", i))
+			assert.Nil(err)
+			assert.Equal(val, "downgraded", strategy.String())
+		}
+		assert.NotEqual(len(filter.levels), 0)
+		assert.Nil(db.Close())
+		cleanup()
+	}
+}
+
+func TestSegmentLevelCountsFromNewest(t *testing.T) {
+	assert := assert.New(t)
+	db, err := NewTree(testFilename, testBasePath, bkupName)
+	defer cleanup()
+	assert.Nil(err)
+	db.segments = []string{"test_file-1", "test_file-2", "test_file-3"}
+
+	assert.Equal(db.segmentLevel("test_file-3"), 0)
+	assert.Equal(db.segmentLevel(testBasePath+"test_file-1"), 2)
+	assert.Equal(db.segmentLevel("unknown"), 0)
+	assert.Nil(db.Close())
+}
+
+type levelFilter struct {
+	levels map[string]int
+}
+
+func (f *levelFilter) Name() string {
+	return "level-filter"
+}
+
+func (f *levelFilter) Filter(level int, key, value string) (CompactionDecision, string) {
+	f.levels[key] = level
+	return CompactionKeep, ""
+}
+
+func TestMergeFiltersRecordsAtTheLevelOfTheirSegment(t *testing.T) {
+	assert := assert.New(t)
+	defer cleanup()
+	filter := &levelFilter{levels: map[string]int{}}
+	db, err := Open(testBasePath, &Options{
+		CompactionStrategy: CompactionMergeSegments,
+		CompactionFilter:   filter,
+	})
+	assert.Nil(err)
+	assert.Nil(db.Set("old", "v"))
+	assert.Nil(db.flush())
+	assert.Nil(db.Set("new", "v"))
+	assert.Nil(db.flush())
+
+	assert.Equal(len(db.segments), 1)
+	assert.Equal(filter.levels, map[string]int{"old": 1, "new": 0})
+	assert.Nil(db.Close())
+}
@@ -0,0 +1,84 @@
+package simplekv
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ErrComparatorMismatch is returned by Open when the tree was written with
+// another comparator than the one of the options.
+var ErrComparatorMismatch = errors.New("comparator mismatch")
+
+// Comparator orders the keys of a tree. Only identical keys may compare
+// equal, the bloom filter hashes the raw key.
+type Comparator interface {
+	// Compare returns a negative number, 0 or a positive number when a
+	// sorts before, as or after b.
+	Compare(a, b string) int
+	// Name identifies the ordering, it is persisted in the metadata and
+	// checked when the tree is opened again.
+	Name() string
+}
+
+// BytewiseComparator orders keys by their bytes, it is the default.
+type BytewiseComparator struct{}
+
+func (BytewiseComparator) Compare(a, b string) int {
+	return strings.Compare(a, b)
+}
+
+func (BytewiseComparator) Name() string {
+	return "simplekv.BytewiseComparator"
+}
+
+// ReverseBytewiseComparator orders keys by their bytes, largest first.
+type ReverseBytewiseComparator struct{}
+
+func (ReverseBytewiseComparator) Compare(a, b string) int {
+	return strings.Compare(b, a)
+}
+
+func (ReverseBytewiseComparator) Name() string {
+	return "simplekv.ReverseBytewiseComparator"
+}
+
+// CaseInsensitiveComparator orders keys ignoring case, keys differing only
+// in case stay distinct and are ordered by their bytes.
+type CaseInsensitiveComparator struct{}
+
+func (CaseInsensitiveComparator) Compare(a, b string) int {
+	if c := strings.Compare(strings.ToLower(a), strings.ToLower(b)); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+func (CaseInsensitiveComparator) Name() string {
+	return "simplekv.CaseInsensitiveComparator"
+}
+
+// NumericComparator orders keys holding decimal integers by value. Keys
+// that are not integers sort after them by their bytes, as do integers of
+// equal value written differently, such as "7" and "07".
+type NumericComparator struct{}
+
+func (NumericComparator) Compare(a, b string) int {
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+	switch {
+	case errA == nil && errB == nil && x < y:
+		return -1
+	case errA == nil && errB == nil && x > y:
+		return 1
+	case errA == nil && errB != nil:
+		return -1
+	case errA != nil && errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func (NumericComparator) Name() string {
+	return "simplekv.NumericComparator"
+}
@@ -0,0 +1,93 @@
+package simplekv
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComparatorOrderings(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tt := range []struct {
+		cmp  Comparator
+		keys []string
+		want []string
+	}{
+		{BytewiseComparator{}, []string{"b", "a", "B"}, []string{"B", "a", "b"}},
+		{ReverseBytewiseComparator{}, []string{"b", "a", "c"}, []string{"c", "b", "a"}},
+		{CaseInsensitiveComparator{}, []string{"b", "a", "B"}, []string{"a", "B", "b"}},
+		{NumericComparator{}, []string{"10", "x", "9", "-1", "09"}, []string{"-1", "09", "9", "10", "x"}},
+	} {
+		keys := append([]string(nil), tt.keys...)
+		sort.Slice(keys, func(i, j int) bool { return tt.cmp.Compare(keys[i], keys[j]) < 0 })
+		assert.Equal(keys, tt.want, tt.cmp.Name())
+	}
+}
+
+func TestTreeUsesComparator(t *testing.T) {
+	assert := assert.New(t)
+	for _, strategy := range []CompactionStrategy{CompactionDeleteKeys, CompactionMergeSegments} {
+		opts := &Options{
+			MemtableSize:       40,
+			SparsityFactor:     4,
+			CompactionStrategy: strategy,
+			Comparator:         NumericComparator{},
+		}
+		db, err := Open(testBasePath, opts)
+		assert.Nil(err)
+
+		for i := 0; i < 30; i++ {
+			assert.Nil(db.Set(strconv.Itoa(i*7%30), strconv.Itoa(i)))
+		}
+		assert.True(len(db.segments) > 0)
+		for i := 0; i < 30; i++ {
+			_, err := db.Get(strconv.Itoa(i))
+			assert.Nil(err, strconv.Itoa(i))
+		}
+
+		assert.Nil(db.DeleteRange("5", "20"))
+		it, err := db.NewIterator()
+		assert.Nil(err)
+		var keys []int
+		for it.Next() {
+			k, err := strconv.Atoi(it.Key())
+			assert.Nil(err)
+			keys = append(keys, k)
+		}
+		assert.Nil(it.Close())
+		assert.Equal(len(keys), 15, strategy.String())
+		assert.True(sort.IntsAreSorted(keys), strategy.String())
+		assert.Nil(db.Close())
+
+		_, err = Open(testBasePath, nil)
+		assert.True(errors.Is(err, ErrComparatorMismatch))
+		db, err = Open(testBasePath, opts)
+		assert.Nil(err)
+		assert.Nil(db.Close())
+		cleanup()
+	}
+}
+
+func TestComparatorIsPersistedBeforeTheFirstFlush(t *testing.T) {
+	assert := assert.New(t)
+	fs := NewFaultFS()
+	opts := &Options{FS: fs, SyncWrites: true, Comparator: NumericComparator{}}
+	db, err := Open("db", opts)
+	assert.Nil(err)
+	assert.Nil(db.Set("10", "v"))
+	assert.Equal(len(db.segments), 0)
+	fs.Crash()
+
+	_, err = Open("db", &Options{FS: fs})
+	assert.True(errors.Is(err, ErrComparatorMismatch))
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	val, err := db.Get("10")
+	assert.Nil(err)
+	assert.Equal(val, "v")
+	assert.Nil(db.Close())
+}
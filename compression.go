@@ -0,0 +1,186 @@
+package simplekv
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrUnknownCodec is returned for a codec name or id that is not registered.
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// Ids of the built-in codecs, custom codecs pick theirs from
+// CustomCodecID up.
+const (
+	CodecNone  uint8 = 0
+	CodecFlate uint8 = 1
+	CodecZlib  uint8 = 2
+
+	CustomCodecID uint8 = 128
+)
+
+// Codec compresses the blocks of a segment. Its id is written in front of
+// every block, so a codec must stay registered under the same id for as
+// long as segments written with it exist.
+type Codec interface {
+	// Name selects the codec in Options.Compression.
+	Name() string
+	// Compress returns the compressed form of src.
+	Compress(src []byte) ([]byte, error)
+	// Decompress returns the rawLen bytes src was compressed from.
+	Decompress(src []byte, rawLen int) ([]byte, error)
+}
+
+var codecs = struct {
+	sync.RWMutex
+	byID   map[uint8]Codec
+	byName map[string]uint8
+}{
+	byID:   map[uint8]Codec{},
+	byName: map[string]uint8{},
+}
+
+func init() {
+	mustRegisterCodec(CodecNone, noneCodec{})
+	mustRegisterCodec(CodecFlate, flateCodec{})
+	mustRegisterCodec(CodecZlib, zlibCodec{})
+}
+
+func mustRegisterCodec(id uint8, codec Codec) {
+	if err := registerCodec(id, codec); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterCodec makes codec available under id, which must be at least
+// CustomCodecID. Neither the id nor the name may be taken already.
+func RegisterCodec(id uint8, codec Codec) error {
+	if id < CustomCodecID {
+		return fmt.Errorf("codec id %d is reserved for built-in codecs", id)
+	}
+	return registerCodec(id, codec)
+}
+
+func registerCodec(id uint8, codec Codec) error {
+	codecs.Lock()
+	defer codecs.Unlock()
+
+	if _, ok := codecs.byID[id]; ok {
+		return fmt.Errorf("codec id %d already registered", id)
+	}
+	if _, ok := codecs.byName[codec.Name()]; ok {
+		return fmt.Errorf("codec %s already registered", codec.Name())
+	}
+	codecs.byID[id] = codec
+	codecs.byName[codec.Name()] = id
+	return nil
+}
+
+// codecByName returns the codec registered as name, with its id.
+func codecByName(name string) (uint8, Codec, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	id, ok := codecs.byName[name]
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+	}
+	return id, codecs.byID[id], nil
+}
+
+// codecByID returns the codec registered under id.
+func codecByID(id uint8) (Codec, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	codec, ok := codecs.byID[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: id %d", ErrUnknownCodec, id)
+	}
+	return codec, nil
+}
+
+// codecName returns the name of the codec id, or its number when unknown.
+func codecName(id uint8) string {
+	if codec, err := codecByID(id); err == nil {
+		return codec.Name()
+	}
+	return fmt.Sprintf("codec-%d", id)
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string {
+	return "none"
+}
+
+func (noneCodec) Compress(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+func (noneCodec) Decompress(src []byte, rawLen int) ([]byte, error) {
+	return src, nil
+}
+
+type flateCodec struct{}
+
+func (flateCodec) Name() string {
+	return "flate"
+}
+
+func (flateCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	return finishCompress(&buf, w, src)
+}
+
+func (flateCodec) Decompress(src []byte, rawLen int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return readDecompressed(r, rawLen)
+}
+
+type zlibCodec struct{}
+
+func (zlibCodec) Name() string {
+	return "zlib"
+}
+
+func (zlibCodec) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	return finishCompress(&buf, zlib.NewWriter(&buf), src)
+}
+
+func (zlibCodec) Decompress(src []byte, rawLen int) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readDecompressed(r, rawLen)
+}
+
+func finishCompress(buf *bytes.Buffer, w io.WriteCloser, src []byte) ([]byte, error) {
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func readDecompressed(r io.Reader, rawLen int) ([]byte, error) {
+	raw := make([]byte, rawLen)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
@@ -0,0 +1,134 @@
+package simplekv
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	src := []byte(strings.Repeat("key,value\n", 100))
+	for _, name := range []string{"none", "flate", "zlib"} {
+		_, codec, err := codecByName(name)
+		assert.Nil(err)
+		data, err := codec.Compress(src)
+		assert.Nil(err)
+		raw, err := codec.Decompress(data, len(src))
+		assert.Nil(err)
+		assert.Equal(raw, src, name)
+	}
+	_, _, err := codecByName("snappy")
+	assert.True(errors.Is(err, ErrUnknownCodec))
+}
+
+func TestCompressedSegmentsStayReadableAcrossCodecs(t *testing.T) {
+	assert := assert.New(t)
+	defer cleanup()
+	value := strings.Repeat("v", 40)
+	opts := &Options{MemtableSize: 400, SparsityFactor: 4, BlockSize: 128}
+	for round, codec := range []string{"none", "flate", "zlib", "flate"} {
+		opts.Compression = codec
+		db, err := Open(testBasePath, opts)
+		assert.Nil(err)
+		for i := 0; i < 40; i++ {
+			k := strconv.Itoa(round) + "-key" + strconv.Itoa(i)
+			assert.Nil(db.Set(k, value))
+		}
+		assert.Nil(db.Close())
+	}
+
+	for _, strategy := range []CompactionStrategy{CompactionDeleteKeys, CompactionMergeSegments} {
+		opts.CompactionStrategy = strategy
+		db, err := Open(testBasePath, opts)
+		assert.Nil(err)
+		for round := 0; round < 4; round++ {
+			for i := 0; i < 40; i++ {
+				val, err := db.Get(strconv.Itoa(round) + "-key" + strconv.Itoa(i))
+				assert.Nil(err)
+				assert.Equal(val, value)
+			}
+		}
+		iter, err := db.NewIterator()
+		assert.Nil(err)
+		n := 0
+		for iter.Next() {
+			n++
+		}
+		assert.Nil(iter.Err())
+		assert.Nil(iter.Close())
+		assert.Equal(n, 160)
+		// rewriting segments recompresses them with the current codec
+		assert.Nil(db.Set("0-key0", "new"))
+		assert.Nil(db.flush())
+		val, err := db.Get("0-key0")
+		assert.Nil(err)
+		assert.Equal(val, "new")
+		assert.Nil(db.Set("0-key0", value))
+		assert.Nil(db.Close())
+	}
+}
+
+func TestCompressionStats(t *testing.T) {
+	assert := assert.New(t)
+	defer cleanup()
+	db, err := Open(testBasePath, &Options{MemtableSize: 2000, SparsityFactor: 4, Compression: "zlib"})
+	assert.Nil(err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), strings.Repeat("value", 10)))
+	}
+	assert.True(len(db.segments) > 0)
+	stats, err := db.CompressionStats()
+	assert.Nil(err)
+	assert.True(stats.Blocks["zlib"] > 0)
+	assert.True(stats.Ratio() > 2, stats.Ratio())
+	assert.Nil(db.Close())
+}
+
+type upperCodec struct{}
+
+func (upperCodec) Name() string {
+	return "test-upper"
+}
+
+func (upperCodec) Compress(src []byte) ([]byte, error) {
+	// shorter, so that the block isn't stored raw
+	return []byte(strings.ToUpper(string(src[:len(src)-1]))), nil
+}
+
+func (upperCodec) Decompress(src []byte, rawLen int) ([]byte, error) {
+	return []byte(strings.ToLower(string(src)) + "\n"), nil
+}
+
+func TestCustomCodec(t *testing.T) {
+	assert := assert.New(t)
+	defer cleanup()
+	assert.NotNil(RegisterCodec(CodecZlib, upperCodec{}))
+	if _, _, err := codecByName("test-upper"); err != nil {
+		assert.Nil(RegisterCodec(CustomCodecID+1, upperCodec{}))
+	}
+	assert.NotNil(RegisterCodec(CustomCodecID+2, upperCodec{}))
+
+	_, err := Open(testBasePath, &Options{Compression: "missing"})
+	assert.True(errors.Is(err, ErrInvalidOptions))
+
+	// a single line per block
+	db, err := Open(testBasePath, &Options{MemtableSize: 40, SparsityFactor: 2,
+		Compression: "test-upper", BlockSize: 1})
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+	}
+	for i := 0; i < 10; i++ {
+		val, err := db.Get("key" + strconv.Itoa(i))
+		assert.Nil(err)
+		assert.Equal(val, "value")
+	}
+	stats, err := db.CompressionStats()
+	assert.Nil(err)
+	assert.True(stats.Blocks["test-upper"] > 0)
+	assert.Nil(db.Close())
+}
@@ -0,0 +1,49 @@
+package simplekv
+
+// CompareAndSet sets key to value when its current value is expected, an
+// absent key never matches. It reports whether the write was applied.
+func (t *Tree) CompareAndSet(key, expected, value string) (bool, error) {
+	return t.putIf(&record{key: key, value: value}, func(current string, found bool) bool {
+		return found && current == expected
+	})
+}
+
+// SetIfAbsent sets key to value unless key is present. It reports whether
+// the write was applied.
+func (t *Tree) SetIfAbsent(key, value string) (bool, error) {
+	return t.putIf(&record{key: key, value: value}, func(current string, found bool) bool {
+		return !found
+	})
+}
+
+// DeleteIfEquals deletes key when its current value is expected. It reports
+// whether the deletion was applied.
+func (t *Tree) DeleteIfEquals(key, expected string) (bool, error) {
+	return t.putIf(&record{key: key, kind: kindDelete}, func(current string, found bool) bool {
+		return found && current == expected
+	})
+}
+
+// putIf writes rec when cond holds for the current value of its key, the
+// read and the write happen under the same lock so no other writer of the
+// tree can slip in between.
+func (t *Tree) putIf(rec *record, cond func(current string, found bool) bool) (bool, error) {
+	if t.readOnly {
+		return false, ErrReadOnly
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current, found, err := t.get(rec.key)
+	if err != nil {
+		return false, err
+	}
+	if !cond(current, found) {
+		return false, nil
+	}
+	err = t.putLocked(rec)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
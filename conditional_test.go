@@ -0,0 +1,140 @@
+package simplekv
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelete(t *testing.T) {
+	assert := assert.New(t)
+	for _, strategy := range []CompactionStrategy{CompactionDeleteKeys, CompactionMergeSegments} {
+		db, err := Open(testBasePath, &Options{
+			MemtableSize:       30,
+			SparsityFactor:     3,
+			CompactionStrategy: strategy,
+		})
+		assert.Nil(err)
+
+		assert.Nil(db.Set("gone", "v"))
+		assert.Nil(db.Set("kept", "v"))
+		for i := 0; i < 10; i++ {
+			assert.Nil(db.Set("a"+strconv.Itoa(i), "v"))
+		}
+		assert.Nil(db.Delete("gone"))
+		assert.Nil(db.Delete("missing"))
+		val, err := db.Get("gone")
+		assert.Equal(err, ErrNotFound)
+		assert.Equal(val, "")
+
+		it, err := db.NewIterator()
+		assert.Nil(err)
+		for it.Next() {
+			assert.NotEqual(it.Key(), "gone")
+			assert.NotEqual(it.Key(), "missing")
+		}
+		assert.Nil(it.Close())
+
+		// the deletion is flushed away with the deleted key
+		for i := 0; i < 10; i++ {
+			assert.Nil(db.Set("b"+strconv.Itoa(i), "v"))
+		}
+		assert.Nil(db.memtable.Get("gone"))
+		for _, segment := range db.segments {
+			val, err := db.searchSegment("gone", segment)
+			assert.Nil(err)
+			assert.Equal(val, "", strategy.String())
+		}
+		val, err = db.Get("kept")
+		assert.Nil(err)
+		assert.Equal(val, "v")
+		assert.Nil(db.Close())
+		cleanup()
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, nil)
+	defer cleanup()
+	assert.Nil(err)
+
+	ok, err := db.CompareAndSet("leader", "", "node1")
+	assert.Nil(err)
+	assert.False(ok)
+
+	ok, err = db.SetIfAbsent("leader", "node1")
+	assert.Nil(err)
+	assert.True(ok)
+	ok, err = db.SetIfAbsent("leader", "node2")
+	assert.Nil(err)
+	assert.False(ok)
+
+	ok, err = db.CompareAndSet("leader", "node2", "node3")
+	assert.Nil(err)
+	assert.False(ok)
+	ok, err = db.CompareAndSet("leader", "node1", "node3")
+	assert.Nil(err)
+	assert.True(ok)
+
+	ok, err = db.DeleteIfEquals("leader", "node1")
+	assert.Nil(err)
+	assert.False(ok)
+	ok, err = db.DeleteIfEquals("leader", "node3")
+	assert.Nil(err)
+	assert.True(ok)
+	val, err := db.Get("leader")
+	assert.Equal(err, ErrNotFound)
+	assert.Equal(val, "")
+
+	// a deleted key is absent again
+	ok, err = db.SetIfAbsent("leader", "node4")
+	assert.Nil(err)
+	assert.True(ok)
+	assert.Nil(db.Close())
+
+	readOnly, err := OpenReadOnly(testBasePath, nil)
+	assert.Nil(err)
+	_, err = readOnly.SetIfAbsent("other", "v")
+	assert.Equal(err, ErrReadOnly)
+	assert.Nil(readOnly.Close())
+}
+
+func TestCompareAndSetIsAtomic(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, nil)
+	defer cleanup()
+	assert.Nil(err)
+	assert.Nil(db.Set("counter", "0"))
+
+	const workers, increments = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; {
+				val, err := db.Get("counter")
+				if err != nil {
+					return
+				}
+				n, _ := strconv.Atoi(val)
+				ok, err := db.CompareAndSet("counter", val, strconv.Itoa(n+1))
+				if err != nil {
+					return
+				}
+				if ok {
+					i++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := db.Get("counter")
+	assert.Nil(err)
+	assert.Equal(val, strconv.Itoa(workers*increments))
+	assert.Nil(db.Close())
+}
@@ -0,0 +1,470 @@
+package simplekv
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultFSDropsUnsyncedWrites(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewFaultFS()
+	assert.Nil(writeFile(fs, "synced", []byte("synced")))
+	file, err := fs.OpenFile("synced", os.O_APPEND|os.O_WRONLY, 0666)
+	assert.Nil(err)
+	_, err = file.Write([]byte(" lost"))
+	assert.Nil(err)
+	unsynced, err := fs.OpenFile("unsynced", os.O_CREATE|os.O_WRONLY, 0666)
+	assert.Nil(err)
+	_, err = unsynced.Write([]byte("lost"))
+	assert.Nil(err)
+
+	fs.FailAfter(2)
+	_, err = file.Write([]byte("ab"))
+	assert.Nil(err)
+	_, err = file.Write([]byte("torn"))
+	assert.True(errors.Is(err, ErrInjected))
+	assert.True(errors.Is(file.Sync(), ErrInjected))
+	data, err := readFile(fs.mem, "synced")
+	assert.Nil(err)
+	assert.Equal(string(data), "synced lostabto")
+
+	fs.Crash()
+	data, err = readFile(fs, "synced")
+	assert.Nil(err)
+	assert.Equal(string(data), "synced")
+	data, err = readFile(fs, "unsynced")
+	assert.Nil(err)
+	assert.Equal(string(data), "")
+	// handles of before the crash are lost
+	_, err = file.Write([]byte("x"))
+	assert.True(errors.Is(err, ErrInjected))
+}
+
+func TestFaultFSKeepsTornWrite(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewFaultFS()
+	assert.Nil(writeFile(fs, "torn", []byte("synced")))
+	assert.Nil(writeFile(fs, "other", []byte("synced")))
+	torn, err := fs.OpenFile("torn", os.O_APPEND|os.O_WRONLY, 0666)
+	assert.Nil(err)
+	other, err := fs.OpenFile("other", os.O_APPEND|os.O_WRONLY, 0666)
+	assert.Nil(err)
+	_, err = other.Write([]byte(" lost"))
+	assert.Nil(err)
+
+	fs.FailAfter(1)
+	_, err = torn.Write([]byte(" torn"))
+	assert.True(errors.Is(err, ErrInjected))
+	fs.CrashTorn()
+	data, err := readFile(fs, "torn")
+	assert.Nil(err)
+	assert.Equal(string(data), "synced t")
+	data, err = readFile(fs, "other")
+	assert.Nil(err)
+	assert.Equal(string(data), "synced")
+}
+
+// crashTest runs a random workload of sets, merges, deletes, range deletes
+// and write batches on a tree on a FaultFS, kills it at a random operation,
+// keeping the torn write or not, then checks after every restart, and after
+// a write and a reopen, that the tree holds what a model of the
+// acknowledged operations does.
+type crashTest struct {
+	t       *testing.T
+	fs      *FaultFS
+	opts    *Options
+	rng     *rand.Rand
+	keys    int
+	written map[string]string
+	// pending applies the operation that failed to the model, it may or
+	// may not have been kept
+	pending func(model map[string]string)
+	next    int
+}
+
+func newCrashTest(t *testing.T, opts *Options, keys int) *crashTest {
+	seed := rand.Int63()
+	t.Logf("seed: %d", seed)
+	fs := NewFaultFS()
+	opts.FS = fs
+	opts.SyncWrites = true
+	opts.MergeOperator = UInt64AddOperator{}
+	return &crashTest{
+		t:       t,
+		fs:      fs,
+		opts:    opts,
+		rng:     rand.New(rand.NewSource(seed)),
+		keys:    keys,
+		written: map[string]string{},
+	}
+}
+
+func (c *crashTest) run(rounds int) {
+	for round := 0; round < rounds; round++ {
+		db, err := Open("db", c.opts)
+		if !assert.Nil(c.t, err, "round %d", round) {
+			return
+		}
+		if !c.check(db, round) {
+			return
+		}
+		// the tree keeps working after the crash
+		apply, model := c.operation()
+		if !assert.Nil(c.t, apply(db), "round %d", round) || !assert.Nil(c.t, db.Close(), "round %d", round) {
+			return
+		}
+		model(c.written)
+		db, err = Open("db", c.opts)
+		if !assert.Nil(c.t, err, "round %d reopened", round) || !c.check(db, round) {
+			return
+		}
+
+		c.fs.FailAfter(1 + c.rng.Intn(300))
+		c.write(db)
+		if c.rng.Intn(2) == 0 {
+			c.fs.CrashTorn()
+		} else {
+			c.fs.Crash()
+		}
+	}
+}
+
+// write runs operations until the file system fails.
+func (c *crashTest) write(db *Tree) {
+	for {
+		apply, model := c.operation()
+		if err := apply(db); err != nil {
+			c.pending = model
+			return
+		}
+		model(c.written)
+	}
+}
+
+// key picks the key of an operation, a new one each time when keys is 0.
+func (c *crashTest) key() string {
+	c.next++
+	if c.keys > 0 {
+		return "key" + strconv.Itoa(c.rng.Intn(c.keys))
+	}
+	return "key" + strconv.Itoa(c.next)
+}
+
+// operation returns a random operation, and how it changes the model.
+func (c *crashTest) operation() (func(db *Tree) error, func(model map[string]string)) {
+	key := c.key()
+	value := strconv.Itoa(c.next)
+	switch n := c.rng.Intn(10); {
+	case n < 4:
+		return func(db *Tree) error { return db.Set(key, value) },
+			func(model map[string]string) { model[key] = value }
+	case n < 6:
+		return func(db *Tree) error { return db.Merge(key, "1") },
+			func(model map[string]string) {
+				sum, _ := strconv.Atoi(model[key])
+				model[key] = strconv.Itoa(sum + 1)
+			}
+	case n < 7:
+		return func(db *Tree) error { return db.Delete(key) },
+			func(model map[string]string) { delete(model, key) }
+	case n < 8:
+		start, end := key, c.key()
+		if end < start {
+			start, end = end, start
+		} else if end == start {
+			end += "\x00"
+		}
+		return func(db *Tree) error { return db.DeleteRange(start, end) },
+			func(model map[string]string) {
+				for key := range model {
+					if start <= key && key < end {
+						delete(model, key)
+					}
+				}
+			}
+	}
+	b := &WriteBatch{}
+	var models []func(model map[string]string)
+	for i := 0; i < 1+c.rng.Intn(3); i++ {
+		key, value := c.key(), strconv.Itoa(c.next)
+		if c.rng.Intn(3) == 0 {
+			b.Delete(key)
+			models = append(models, func(model map[string]string) { delete(model, key) })
+		} else {
+			b.Set(key, value)
+			models = append(models, func(model map[string]string) { model[key] = value })
+		}
+	}
+	return func(db *Tree) error { return db.Write(b) },
+		func(model map[string]string) {
+			for _, apply := range models {
+				apply(model)
+			}
+		}
+}
+
+func (c *crashTest) check(db *Tree, round int) bool {
+	if c.pending != nil {
+		// either outcome of the failed operation is fine
+		after := make(map[string]string, len(c.written))
+		for key, value := range c.written {
+			after[key] = value
+		}
+		c.pending(after)
+		if content, err := treeContent(db); err == nil && reflect.DeepEqual(content, after) {
+			c.written = after
+		}
+		c.pending = nil
+	}
+	label := "round " + strconv.Itoa(round)
+	return checkNoOrphans(c.t, db, label) && checkWritten(c.t, db, c.written, label)
+}
+
+// treeContent returns the keys and values of db.
+func treeContent(db *Tree) (map[string]string, error) {
+	iter, err := db.NewIterator()
+	if err != nil {
+		return nil, err
+	}
+	content := map[string]string{}
+	for iter.Next() {
+		content[iter.Key()] = iter.Value()
+	}
+	if err := iter.Err(); err != nil {
+		iter.Close()
+		return nil, err
+	}
+	return content, iter.Close()
+}
+
+// checkNoOrphans tells whether the directory of db only holds the segments
+// its metadata references, no temporary file and no other segment.
+func checkNoOrphans(t *testing.T, db *Tree, label string) bool {
+	infos, err := db.opts.FS.ReadDir(db.segmentsDirectory)
+	if !assert.Nil(t, err, label) {
+		return false
+	}
+	live := map[string]bool{}
+	for _, segment := range db.segments {
+		live[segment] = true
+	}
+	ok := true
+	for _, info := range infos {
+		if !info.IsDir() && !live[info.Name()] {
+			orphan := db.isSegmentName(info.Name()) || db.isOrphanFile(info.Name())
+			ok = assert.False(t, orphan, "%s file %s", label, info.Name()) && ok
+		}
+	}
+	return ok
+}
+
+// checkWritten tells whether db holds exactly the keys of written.
+func checkWritten(t *testing.T, db *Tree, written map[string]string, label string) bool {
+	ok := true
+	for key, value := range written {
+		val, err := db.Get(key)
+		ok = assert.Nil(t, err, "%s key %s", label, key) && ok
+		ok = assert.Equal(t, val, value, "%s key %s", label, key) && ok
+	}
+	iter, err := db.NewIterator()
+	if !assert.Nil(t, err, label) {
+		return false
+	}
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	ok = assert.Nil(t, iter.Err(), label) && ok
+	ok = assert.Nil(t, iter.Close(), label) && ok
+	ok = assert.Equal(t, n, len(written), label) && ok
+	return ok
+}
+
+// testCrashAtEveryStepOfFlush kills a tree at each operation of a flush in
+// turn, the writes acknowledged before it must all survive. When compact is
+// set, the flush rewrites a first segment holding some of the keys.
+func testCrashAtEveryStepOfFlush(t *testing.T, opts *Options, compact bool) {
+	for step := 1; ; step++ {
+		fs := NewFaultFS()
+		opts.FS = fs
+		opts.SyncWrites = true
+		db, err := Open("db", opts)
+		if !assert.Nil(t, err) {
+			return
+		}
+		written := map[string]string{}
+		if compact {
+			for i := 0; i < 20; i++ {
+				key := "key" + strconv.Itoa(i)
+				written[key] = "old"
+				assert.Nil(t, db.Set(key, written[key]))
+			}
+			assert.Nil(t, db.flush())
+		}
+		for i := 10; i < 30; i++ {
+			key := "key" + strconv.Itoa(i)
+			written[key] = "new"
+			assert.Nil(t, db.Set(key, written[key]))
+		}
+
+		start := fs.Ops()
+		fs.FailAfter(step)
+		err = db.flush()
+		done := fs.Ops()-start < step
+		fs.Crash()
+		assert.Equal(t, err == nil, done)
+
+		db, err = Open("db", opts)
+		label := "crash at step " + strconv.Itoa(step)
+		if !assert.Nil(t, err, label) || !checkNoOrphans(t, db, label) ||
+			!checkWritten(t, db, written, label) {
+			return
+		}
+		assert.Nil(t, db.Close())
+		if done {
+			return
+		}
+	}
+}
+
+func TestCrashAtEveryStepOfFirstFlush(t *testing.T) {
+	t.Parallel()
+	testCrashAtEveryStepOfFlush(t, &Options{SparsityFactor: 4}, false)
+	testCrashAtEveryStepOfFlush(t, &Options{SparsityFactor: 4,
+		Compression: "flate", BlockSize: 64, KeyProvider: testKeyProvider("k1")}, false)
+}
+
+func TestCrashAtEveryStepOfCompaction(t *testing.T) {
+	t.Parallel()
+	for _, strategy := range []CompactionStrategy{CompactionDeleteKeys, CompactionMergeSegments} {
+		testCrashAtEveryStepOfFlush(t, &Options{SparsityFactor: 4, CompactionStrategy: strategy}, true)
+	}
+	testCrashAtEveryStepOfFlush(t, &Options{SparsityFactor: 4,
+		Compression: "flate", BlockSize: 64, KeyProvider: testKeyProvider("k1")}, true)
+}
+
+func TestCrashDuringWrites(t *testing.T) {
+	t.Parallel()
+	c := newCrashTest(t, &Options{MemtableSize: 200, SparsityFactor: 4}, 0)
+	c.run(50)
+}
+
+func TestCrashDuringCompaction(t *testing.T) {
+	t.Parallel()
+	for _, strategy := range []CompactionStrategy{CompactionDeleteKeys, CompactionMergeSegments} {
+		c := newCrashTest(t, &Options{MemtableSize: 200, SparsityFactor: 4,
+			CompactionStrategy: strategy}, 40)
+		c.run(50)
+	}
+}
+
+func TestOpenRemovesOrphanFiles(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	opts := &Options{MemtableSize: 100, SparsityFactor: 2, FS: fs}
+	db, err := Open("db", opts)
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+	}
+	segments := append([]string(nil), db.segments...)
+	assert.True(len(segments) > 0)
+	assert.Nil(db.Close())
+
+	// legacy segments the metadata doesn't list are not the tree's to remove
+	kept := []string{"segment-x", "99.sst", "notes", "segment-99"}
+	orphans := []string{segmentFileName(db.nextFileNumber), "000099.sst", "segment-1_temp", "temp",
+		"database_metadata.tmp", "wal.tmp"}
+	for _, name := range append(orphans, kept...) {
+		assert.Nil(writeFile(fs, "db/"+name, []byte("orphan")))
+	}
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	for _, name := range orphans {
+		assert.False(fileExists(fs, "db/"+name), name)
+	}
+	for _, name := range append(segments, kept...) {
+		assert.True(fileExists(fs, "db/"+name), name)
+	}
+	val, err := db.Get("key1")
+	assert.Nil(err)
+	assert.Equal(val, "value")
+	assert.Nil(db.Close())
+}
+
+func TestOpenTruncatesTornWalTail(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	opts := &Options{FS: fs}
+	db, err := Open("db", opts)
+	assert.Nil(err)
+	assert.Nil(db.Set("a", "1"))
+	assert.Nil(db.Close())
+	wal, err := readFile(fs, "db/wal")
+	assert.Nil(err)
+	// a record torn by a crash
+	assert.Nil(writeFile(fs, "db/wal", append(wal, "b,2,s="...)))
+
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	data, err := readFile(fs, "db/wal")
+	assert.Nil(err)
+	assert.Equal(data, wal)
+	assert.Nil(db.Set("c", "3"))
+	assert.Nil(db.Close())
+
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	for key, value := range map[string]string{"a": "1", "c": "3"} {
+		val, err := db.Get(key)
+		assert.Nil(err, key)
+		assert.Equal(val, value, key)
+	}
+	_, err = db.Get("b")
+	assert.Equal(err, ErrNotFound)
+	assert.Nil(db.Close())
+}
+
+// brokenFilter fails the compactions once broken is set.
+type brokenFilter struct {
+	broken bool
+}
+
+func (f *brokenFilter) Name() string {
+	return "broken-filter"
+}
+
+func (f *brokenFilter) Filter(level int, key, value string) (CompactionDecision, string) {
+	if f.broken {
+		return CompactionDecision(-1), ""
+	}
+	return CompactionKeep, ""
+}
+
+func TestFailedCompactionRemovesItsOutput(t *testing.T) {
+	assert := assert.New(t)
+	for _, strategy := range []CompactionStrategy{CompactionDeleteKeys, CompactionMergeSegments} {
+		filter := &brokenFilter{}
+		db, err := Open("db", &Options{FS: NewMemFS(), CompactionStrategy: strategy, CompactionFilter: filter})
+		assert.Nil(err)
+		assert.Nil(db.Set("a", "v"))
+		assert.Nil(db.Set("b", "v"))
+		assert.Nil(db.flush())
+
+		filter.broken = true
+		assert.Nil(db.Set("a", "w"))
+		assert.NotNil(db.flush(), strategy.String())
+		checkNoOrphans(t, db, strategy.String())
+		assert.Nil(db.Close())
+	}
+}
@@ -0,0 +1,80 @@
+package simplekv
+
+import (
+	"fmt"
+)
+
+// rangeTombstone deletes the keys from Start, inclusive, to End, exclusive
+type rangeTombstone struct {
+	Start string
+	End   string
+}
+
+func (r rangeTombstone) covers(key string, cmp Comparator) bool {
+	return cmp.Compare(r.Start, key) <= 0 && cmp.Compare(key, r.End) < 0
+}
+
+func coveredBy(tombstones []rangeTombstone, key string, cmp Comparator) bool {
+	for _, tombstone := range tombstones {
+		if tombstone.covers(key, cmp) {
+			return true
+		}
+	}
+	return false
+}
+
+// record returns the segment record of r.
+func (r rangeTombstone) record() *record {
+	return &record{key: r.Start, value: r.End, kind: kindRangeDelete}
+}
+
+// DeleteRange deletes every key from start, inclusive, to end, exclusive.
+// The range is recorded once in the WAL, and flushed as a tombstone at the
+// head of the new segment. It masks the keys of the older segments until a
+// compaction rewriting them anyway drops the keys, the segments lying fully
+// inside the range are dropped by the next one.
+func (t *Tree) DeleteRange(start, end string) error {
+	if t.opts.Comparator.Compare(start, end) >= 0 {
+		return fmt.Errorf("range not valid: [%s, %s)", start, end)
+	}
+	return t.put(&record{key: start, value: end, kind: kindRangeDelete})
+}
+
+// deleteRange drops the memtable keys covered by tombstone, the segments
+// are masked by it.
+func (t *Tree) deleteRange(tombstone rangeTombstone) {
+	for _, k := range t.memtable.KeysInRange(tombstone.Start, tombstone.End) {
+		t.memtable.Delete(k)
+	}
+	t.rangeTombstones = append(t.rangeTombstones, tombstone)
+}
+
+// rangeDeleted tells whether a range tombstone of the memtable masks key in
+// the segments.
+func (t *Tree) rangeDeleted(key string) bool {
+	return coveredBy(t.rangeTombstones, key, t.opts.Comparator)
+}
+
+// rangeDeletedAfter tells whether a range tombstone of a segment newer than
+// segment masks key.
+func (t *Tree) rangeDeletedAfter(key, segment string) bool {
+	for i := len(t.segments) - 1; i >= 0 && t.segments[i] != segment; i-- {
+		if coveredBy(t.segmentTombstones[t.segments[i]], key, t.opts.Comparator) {
+			return true
+		}
+	}
+	return false
+}
+
+// readTombstones reads the range tombstones at the head of a segment and
+// returns the record following them, nil at the end of the segment.
+func readTombstones(reader *LineReader) ([]rangeTombstone, *record, error) {
+	var tombstones []rangeTombstone
+	for {
+		rec, err := reader.readRecord()
+		if err != nil || rec == nil || rec.kind != kindRangeDelete {
+			return tombstones, rec, err
+		}
+		tombstones = append(tombstones, rangeTombstone{Start: rec.key, End: rec.value})
+	}
+}
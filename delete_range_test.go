@@ -0,0 +1,191 @@
+package simplekv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteRangeMasksMemtableAndSegments(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, &Options{MemtableSize: 60, SparsityFactor: 3})
+	defer cleanup()
+	assert.Nil(err)
+
+	for i := 0; i < 20; i++ {
+		assert.Nil(db.Set(fmt.Sprintf("tenant%d/key", i%4), fmt.Sprint(i)))
+		assert.Nil(db.Set(fmt.Sprintf("other%02d", i), "v"))
+	}
+	assert.True(len(db.segments) > 0)
+
+	assert.NotNil(db.DeleteRange("b", "a"))
+	assert.Nil(db.DeleteRange("tenant1/", "tenant3/"))
+	// written after the tombstone, so it stays
+	assert.Nil(db.Set("tenant2/new", "1"))
+
+	for key, want := range map[string]string{
+		"tenant0/key": "16",
+		"tenant1/key": "",
+		"tenant2/key": "",
+		"tenant2/new": "1",
+		"tenant3/key": "19",
+	} {
+		val, err := db.Get(key)
+		if want == "" {
+			assert.Equal(err, ErrNotFound, key)
+		} else {
+			assert.Nil(err)
+		}
+		assert.Equal(val, want, key)
+	}
+
+	it, err := db.NewIterator()
+	assert.Nil(err)
+	var keys []string
+	for it.Next() {
+		if it.Key() >= "tenant" {
+			keys = append(keys, it.Key())
+		}
+	}
+	assert.Nil(it.Err())
+	assert.Nil(it.Close())
+	assert.Equal(keys, []string{"tenant0/key", "tenant2/new", "tenant3/key"})
+	assert.Nil(db.Close())
+
+	// the tombstone is replayed from the WAL
+	db, err = Open(testBasePath, &Options{MemtableSize: 60, SparsityFactor: 3})
+	assert.Nil(err)
+	val, err := db.Get("tenant1/key")
+	assert.Equal(err, ErrNotFound)
+	assert.Equal(val, "")
+	assert.Equal(len(db.rangeTombstones), 1)
+	assert.Nil(db.Close())
+}
+
+func TestDeleteRangeIsFlushedAsTombstone(t *testing.T) {
+	assert := assert.New(t)
+	fs := NewMemFS()
+	opts := &Options{FS: fs}
+	db, err := Open("db", opts)
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(db.Set(fmt.Sprintf("a%d", i), "v"))
+	}
+	assert.Nil(db.Set("b0", "v"))
+	assert.Nil(db.flush())
+	old := db.segments[0]
+	assert.Nil(db.DeleteRange("a", "b"))
+	assert.Nil(db.Set("c0", "v"))
+	assert.Nil(db.flush())
+
+	// the older segment is not rewritten, the tombstone masks its keys
+	assert.Equal(db.segments[0], old)
+	assert.Equal(len(db.segments), 2)
+	assert.Equal(db.segmentTombstones[db.segments[1]], []rangeTombstone{{Start: "a", End: "b"}})
+	check := func(label string) {
+		val, err := db.Get("a3")
+		assert.Equal(err, ErrNotFound, label)
+		assert.Equal(val, "", label)
+		for key, want := range map[string]string{"b0": "v", "c0": "v"} {
+			val, err := db.Get(key)
+			assert.Nil(err, label)
+			assert.Equal(val, want, label)
+		}
+		p, err := db.GetPinned([]byte("a3"))
+		assert.Equal(err, ErrNotFound, label)
+		assert.Nil(p, label)
+		has, err := db.Has("a3")
+		assert.Nil(err, label)
+		assert.False(has, label)
+		it, err := db.NewIterator()
+		assert.Nil(err)
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		assert.Nil(it.Err())
+		assert.Nil(it.Close())
+		assert.Equal(keys, []string{"b0", "c0"}, label)
+	}
+	check("flushed")
+	assert.Nil(db.Close())
+
+	// the tombstone is read back from the segment, the WAL is empty
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	assert.Equal(len(db.rangeTombstones), 0)
+	check("reopened")
+
+	// a key written after the tombstone is visible again
+	assert.Nil(db.Set("a3", "new"))
+	assert.Nil(db.flush())
+	val, err := db.Get("a3")
+	assert.Nil(err)
+	assert.Equal(val, "new")
+	assert.Nil(db.Close())
+}
+
+func TestDeleteRangeIsAppliedByCompaction(t *testing.T) {
+	assert := assert.New(t)
+	for _, strategy := range []CompactionStrategy{CompactionDeleteKeys, CompactionMergeSegments} {
+		db, err := Open("db", &Options{FS: NewMemFS(), CompactionStrategy: strategy})
+		assert.Nil(err)
+		for i := 0; i < 10; i++ {
+			assert.Nil(db.Set(fmt.Sprintf("a%d", i), "v"))
+		}
+		assert.Nil(db.Set("b0", "v"))
+		assert.Nil(db.Set("b1", "v"))
+		assert.Nil(db.flush())
+		assert.Nil(db.DeleteRange("a", "b"))
+		// overwriting b0 makes the delete-keys compaction rewrite the segment
+		assert.Nil(db.Set("b0", "w"))
+		assert.Nil(db.flush())
+
+		var keys []string
+		for _, segment := range db.segments {
+			err := db.iterLineOfSegment(segment, func(rec *record) (bool, error) {
+				keys = append(keys, rec.key)
+				return false, nil
+			})
+			assert.Nil(err)
+		}
+		switch strategy {
+		case CompactionDeleteKeys:
+			// the rewritten segment lost the masked keys, the new one
+			// starts with the tombstone
+			assert.Equal(keys, []string{"b1", "a", "b0"}, strategy.String())
+		case CompactionMergeSegments:
+			// merged into the oldest segment, the tombstone masks nothing
+			assert.Equal(keys, []string{"b0", "b1"}, strategy.String())
+		}
+		val, err := db.Get("b0")
+		assert.Nil(err)
+		assert.Equal(val, "w")
+		assert.Nil(db.Close())
+	}
+}
+
+func TestDeleteRangeDropsCoveredSegments(t *testing.T) {
+	assert := assert.New(t)
+	fs := NewMemFS()
+	db, err := Open("db", &Options{MemtableSize: 20, SparsityFactor: 2, FS: fs})
+	assert.Nil(err)
+
+	for i := 0; i < 20; i++ {
+		assert.Nil(db.Set(fmt.Sprintf("k%02d", i), "v"))
+	}
+	assert.Nil(db.flush())
+	before := append([]string(nil), db.segments...)
+	assert.True(len(before) > 1)
+
+	assert.Nil(db.DeleteRange("k", "l"))
+	assert.Nil(db.flush())
+	for _, segment := range before {
+		assert.NotContains(db.segments, segment)
+		assert.False(fileExists(fs, db.segmentPath(segment)), segment)
+	}
+	_, err = db.Get("k05")
+	assert.Equal(err, ErrNotFound)
+	assert.Nil(db.Close())
+}
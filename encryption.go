@@ -0,0 +1,286 @@
+package simplekv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrEncrypted is returned when reading an encrypted file without
+	// Options.KeyProvider.
+	ErrEncrypted = errors.New("data is encrypted, no key provider set")
+	// ErrWrongKey is returned when the key provider doesn't hold the master
+	// key a file was encrypted with.
+	ErrWrongKey = errors.New("wrong encryption key")
+	// ErrNotEncrypted is returned when a tree with Options.KeyProvider reads
+	// a plain file without Options.AllowPlaintextMigration.
+	ErrNotEncrypted = errors.New("data is not encrypted, plaintext migration not allowed")
+)
+
+const (
+	// sealedMagic starts the encrypted segments and metadata files, it is
+	// followed by the envelope of their data key
+	sealedMagic = "\xffSKVE\n"
+	// walHeaderPrefix starts the WAL line holding the envelope of the key
+	// the following lines are encrypted with
+	walHeaderPrefix = "\xffSKVE"
+
+	dataKeyLen = 32
+)
+
+// KeyProvider holds the master keys that wrap the data key of every
+// encrypted file. Each file gets its own random data key, wrapped with the
+// current master key and tagged with its id, so rotating the master key
+// only requires keeping the previous ones until their files are rewritten.
+type KeyProvider interface {
+	// CurrentKey returns the master key new files are wrapped with.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the master key id, or an error when it is unknown.
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeyProvider KeyProvider over a fixed set of AES keys of 16, 24 or
+// 32 bytes. Current names the key new files are wrapped with.
+type StaticKeyProvider struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (p *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := p.Key(p.Current)
+	if err != nil {
+		return "", nil, err
+	}
+	return p.Current, key, nil
+}
+
+func (p *StaticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := p.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key: %s", id)
+	}
+	return key, nil
+}
+
+// fileCipher AES-GCM cipher of the data key of a file, with the envelope
+// that stores the data key wrapped by a master key
+type fileCipher struct {
+	aead     cipher.AEAD
+	envelope []byte
+	// walLines numbers the WAL lines sealed or opened with the key, each
+	// line is bound to its ordinal so that lines can't be reordered,
+	// dropped from the middle or replayed
+	walLines uint64
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newFileCipher draws a data key for a new file and wraps it with the
+// current master key of provider.
+func newFileCipher(provider KeyProvider) (*fileCipher, error) {
+	id, masterKey, err := provider.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("current master key err: %s", err)
+	}
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("master key %s err: %s", id, err)
+	}
+	dataKey := make([]byte, dataKeyLen)
+	if _, err = rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("generate data key err: %s", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	// envelope: key id length, key id, then the sealed data key
+	envelope := binary.AppendUvarint(nil, uint64(len(id)))
+	envelope = append(envelope, id...)
+	envelope = seal(master, envelope, dataKey, []byte(id))
+	return &fileCipher{aead: aead, envelope: envelope}, nil
+}
+
+// openFileCipher unwraps the data key of envelope with provider.
+func openFileCipher(provider KeyProvider, envelope []byte) (*fileCipher, error) {
+	if provider == nil {
+		return nil, ErrEncrypted
+	}
+	n, i := binary.Uvarint(envelope)
+	if i <= 0 || uint64(len(envelope)-i) < n {
+		return nil, fmt.Errorf("key envelope not valid")
+	}
+	id := string(envelope[i : i+int(n)])
+	masterKey, err := provider.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrWrongKey, err)
+	}
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("master key %s err: %s", id, err)
+	}
+	dataKey, err := unseal(master, envelope[i+int(n):], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("%w: master key %s can't unwrap the data key", ErrWrongKey, id)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &fileCipher{aead: aead, envelope: envelope}, nil
+}
+
+// seal appends a random nonce and the encryption of plaintext to dst.
+func seal(aead cipher.AEAD, dst, plaintext, additional []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		// crypto/rand never fails on supported platforms
+		panic(err)
+	}
+	dst = append(dst, nonce...)
+	return aead.Seal(dst, nonce, plaintext, additional)
+}
+
+// unseal decrypts data written by seal.
+func unseal(aead cipher.AEAD, data, additional []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed data too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additional)
+}
+
+// sealedHeader returns the header of an encrypted file: the magic, then the
+// length prefixed envelope.
+func (c *fileCipher) sealedHeader() []byte {
+	header := append([]byte(sealedMagic), binary.AppendUvarint(nil, uint64(len(c.envelope)))...)
+	return append(header, c.envelope...)
+}
+
+// parseSealedHeader returns the envelope of the encrypted file data, with
+// the length of its header.
+func parseSealedHeader(data []byte) ([]byte, int, error) {
+	rest := data[len(sealedMagic):]
+	n, i := binary.Uvarint(rest)
+	if i <= 0 || uint64(len(rest)-i) < n {
+		return nil, 0, fmt.Errorf("encrypted file header not valid")
+	}
+	return rest[i : i+int(n)], len(sealedMagic) + i + int(n), nil
+}
+
+// sealFile encrypts the content of a whole file, such as the metadata,
+// when the tree is encrypted.
+func (t *Tree) sealFile(data []byte) ([]byte, error) {
+	if t.opts.KeyProvider == nil {
+		return data, nil
+	}
+	c, err := newFileCipher(t.opts.KeyProvider)
+	if err != nil {
+		return nil, err
+	}
+	return seal(c.aead, c.sealedHeader(), data, nil), nil
+}
+
+// openFile decrypts a file written by sealFile, plain files are returned
+// as is when they may be read.
+func (t *Tree) openFile(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(sealedMagic)) {
+		if err := t.checkPlaintext(); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	envelope, n, err := parseSealedHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	c, err := openFileCipher(t.opts.KeyProvider, envelope)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := unseal(c.aead, data[n:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt file err: %s", err)
+	}
+	return plain, nil
+}
+
+// checkPlaintext tells whether plain data may be read: an encrypted tree
+// only reads the files left by the plain tree it is migrated from, other
+// plain files could have been swapped for its own.
+func (t *Tree) checkPlaintext() error {
+	if t.opts.KeyProvider != nil && !t.opts.AllowPlaintextMigration {
+		return ErrNotEncrypted
+	}
+	return nil
+}
+
+// walHeader returns the WAL line announcing the key of the lines after it.
+func (c *fileCipher) walHeader() string {
+	return walHeaderPrefix + base64.StdEncoding.EncodeToString(c.envelope) + "\n"
+}
+
+// nextWalLine returns the additional data of the next WAL line of the key.
+func (c *fileCipher) nextWalLine() []byte {
+	c.walLines++
+	additional := make([]byte, 8)
+	binary.BigEndian.PutUint64(additional, c.walLines)
+	return additional
+}
+
+// sealLines encrypts every line of entry, the encrypted lines are base64
+// encoded and hold no comma, which tells them apart from plain records.
+func (c *fileCipher) sealLines(entry string) string {
+	var sealed strings.Builder
+	for _, line := range strings.SplitAfter(entry, "\n") {
+		if line == "" {
+			continue
+		}
+		data := seal(c.aead, nil, []byte(strings.TrimSuffix(line, "\n")), c.nextWalLine())
+		sealed.WriteString(base64.StdEncoding.EncodeToString(data))
+		sealed.WriteString("\n")
+	}
+	return sealed.String()
+}
+
+// openWalLine returns the plain form of a WAL line, the cipher of a header
+// line, or the line itself when it is not encrypted.
+func (t *Tree) openWalLine(line string, c *fileCipher) (string, *fileCipher, error) {
+	if strings.HasPrefix(line, walHeaderPrefix) {
+		envelope, err := base64.StdEncoding.DecodeString(line[len(walHeaderPrefix):])
+		if err != nil {
+			return "", nil, fmt.Errorf("wal key header not valid: %s", err)
+		}
+		c, err = openFileCipher(t.opts.KeyProvider, envelope)
+		return "", c, err
+	}
+	if c == nil {
+		// encrypted lines all follow a key header
+		return line, c, t.checkPlaintext()
+	}
+	if strings.IndexByte(line, ',') >= 0 {
+		return "", nil, fmt.Errorf("plain wal line after a key header")
+	}
+	data, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return "", nil, fmt.Errorf("encrypted wal line not valid: %s", err)
+	}
+	plain, err := unseal(c.aead, data, c.nextWalLine())
+	if err != nil {
+		return "", nil, fmt.Errorf("decrypt wal line err: %s", err)
+	}
+	return string(plain), c, nil
+}
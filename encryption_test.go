@@ -0,0 +1,290 @@
+package simplekv
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeyProvider(current string) *StaticKeyProvider {
+	return &StaticKeyProvider{
+		Current: current,
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 16),
+		},
+	}
+}
+
+func TestEncryptedTreeLeavesNoPlaintextOnDisk(t *testing.T) {
+	assert := assert.New(t)
+	for _, codec := range []string{"none", "flate"} {
+		opts := &Options{MemtableSize: 200, SparsityFactor: 4,
+			Compression: codec, KeyProvider: testKeyProvider("k1")}
+		db, err := Open(testBasePath, opts)
+		assert.Nil(err)
+		for i := 0; i < 30; i++ {
+			assert.Nil(db.Set("key"+strconv.Itoa(i), "secret-value"+strconv.Itoa(i)))
+		}
+		assert.True(len(db.segments) > 0)
+		assert.Nil(db.Close())
+
+		err = filepath.Walk(testBasePath, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || info.Name() == optionsFilename {
+				return err
+			}
+			data, err := ioutil.ReadFile(path)
+			assert.Nil(err)
+			assert.False(bytes.Contains(data, []byte("secret-value")), path)
+			assert.False(bytes.Contains(data, []byte("key1")), path)
+			return nil
+		})
+		assert.Nil(err)
+
+		db, err = Open(testBasePath, opts)
+		assert.Nil(err)
+		for i := 0; i < 30; i++ {
+			val, err := db.Get("key" + strconv.Itoa(i))
+			assert.Nil(err)
+			assert.Equal(val, "secret-value"+strconv.Itoa(i))
+		}
+		iter, err := db.NewIterator()
+		assert.Nil(err)
+		n := 0
+		for iter.Next() {
+			n++
+		}
+		assert.Nil(iter.Err())
+		assert.Nil(iter.Close())
+		assert.Equal(n, 30)
+		assert.Nil(db.Close())
+		cleanup()
+	}
+}
+
+func TestOpenWithWrongKeyFails(t *testing.T) {
+	assert := assert.New(t)
+	defer cleanup()
+	db, err := Open(testBasePath, &Options{KeyProvider: testKeyProvider("k1")})
+	assert.Nil(err)
+	assert.Nil(db.Set("key", "value"))
+	assert.Nil(db.Close())
+
+	// only the WAL holds data
+	wrong := &StaticKeyProvider{Current: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{9}, 32)}}
+	_, err = Open(testBasePath, &Options{KeyProvider: wrong})
+	assert.True(errors.Is(err, ErrWrongKey), err)
+	_, err = Open(testBasePath, nil)
+	assert.True(errors.Is(err, ErrEncrypted), err)
+
+	db, err = Open(testBasePath, &Options{KeyProvider: testKeyProvider("k1")})
+	assert.Nil(err)
+	assert.Nil(db.flush())
+	assert.Nil(db.Close())
+
+	// the metadata is read first
+	_, err = Open(testBasePath, &Options{KeyProvider: wrong})
+	assert.True(errors.Is(err, ErrWrongKey), err)
+	rotated := &StaticKeyProvider{Current: "k2", Keys: map[string][]byte{"k2": bytes.Repeat([]byte{2}, 16)}}
+	_, err = OpenReadOnly(testBasePath, &Options{KeyProvider: rotated})
+	assert.True(errors.Is(err, ErrWrongKey), err)
+	_, err = Open(testBasePath, nil)
+	assert.True(errors.Is(err, ErrEncrypted), err)
+}
+
+func TestMasterKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+	defer cleanup()
+	opts := &Options{MemtableSize: 100, SparsityFactor: 2, KeyProvider: testKeyProvider("k1")}
+	db, err := Open(testBasePath, opts)
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(db.Set("old"+strconv.Itoa(i), "v"))
+	}
+	assert.Nil(db.flush())
+	assert.Nil(db.Close())
+
+	// files wrapped with k1 stay readable while new ones use k2
+	opts.KeyProvider = testKeyProvider("k2")
+	db, err = Open(testBasePath, opts)
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(db.Set("new"+strconv.Itoa(i), "v"))
+	}
+	assert.Nil(db.flush())
+	for i := 0; i < 10; i++ {
+		_, err := db.Get("old" + strconv.Itoa(i))
+		assert.Nil(err)
+		_, err = db.Get("new" + strconv.Itoa(i))
+		assert.Nil(err)
+	}
+	assert.Nil(db.Close())
+}
+
+func TestPlainTreeCanBeEncryptedLater(t *testing.T) {
+	assert := assert.New(t)
+	defer cleanup()
+	db, err := Open(testBasePath, &Options{MemtableSize: 100, SparsityFactor: 2})
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(db.Set("plain"+strconv.Itoa(i), "v"))
+	}
+	assert.Nil(db.flush())
+	assert.Nil(db.Close())
+
+	opts := &Options{MemtableSize: 100, SparsityFactor: 2, KeyProvider: testKeyProvider("k1")}
+	_, err = Open(testBasePath, opts)
+	assert.True(errors.Is(err, ErrNotEncrypted), err)
+	opts.AllowPlaintextMigration = true
+	db, err = Open(testBasePath, opts)
+	assert.Nil(err)
+	assert.Nil(db.Set("sealed", "v"))
+	assert.Nil(db.Close())
+
+	// the metadata and the WAL are encrypted from now on
+	opts.AllowPlaintextMigration = false
+	db, err = Open(testBasePath, opts)
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		_, err := db.Get("plain" + strconv.Itoa(i))
+		assert.Nil(err)
+	}
+	val, err := db.Get("sealed")
+	assert.Nil(err)
+	assert.Equal(val, "v")
+	assert.Nil(db.Close())
+}
+
+func TestTamperedSegmentBlockIsDetected(t *testing.T) {
+	assert := assert.New(t)
+	defer cleanup()
+	opts := &Options{MemtableSize: 100, SparsityFactor: 2, KeyProvider: testKeyProvider("k1")}
+	db, err := Open(testBasePath, opts)
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+	}
+	assert.Nil(db.flush())
+	path := db.segmentPath(db.segments[0])
+	assert.Nil(db.Close())
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	data[len(data)-1] ^= 0xff
+	assert.Nil(ioutil.WriteFile(path, data, 0666))
+
+	db, err = Open(testBasePath, opts)
+	assert.Nil(err)
+	iter, err := db.NewIterator()
+	if err == nil {
+		for iter.Next() {
+		}
+		err = iter.Err()
+		iter.Close()
+	}
+	assert.NotNil(err)
+	assert.Nil(db.Close())
+}
+
+func TestTamperedWalIsDetected(t *testing.T) {
+	assert := assert.New(t)
+	opts := &Options{FS: NewMemFS(), KeyProvider: testKeyProvider("k1")}
+	db, err := Open("db", opts)
+	assert.Nil(err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+	}
+	path := db.memtableWalPath()
+	assert.Nil(db.Close())
+	data, err := readFile(opts.FS, path)
+	assert.Nil(err)
+	lines := strings.SplitAfter(string(data), "\n")
+	// the key header, three records, then the empty string after the last
+	// newline
+	assert.Equal(len(lines), 5)
+
+	for name, tampered := range map[string][]string{
+		"reordered": {lines[0], lines[2], lines[1], lines[3]},
+		"dropped":   {lines[0], lines[1], lines[3]},
+		"replayed":  {lines[0], lines[1], lines[2], lines[3], lines[3]},
+		"plain":     {lines[0], lines[1], "key9,value\n", lines[3]},
+	} {
+		assert.Nil(writeFile(opts.FS, path, []byte(strings.Join(tampered, ""))))
+		db, err = Open("db", opts)
+		if !assert.NotNil(err, name) {
+			assert.Nil(db.Close())
+		}
+	}
+
+	assert.Nil(writeFile(opts.FS, path, data))
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	// the lines appended after a reopen keep their ordinals
+	assert.Nil(db.Set("key3", "value"))
+	assert.Nil(db.Close())
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	for i := 0; i < 4; i++ {
+		_, err := db.Get("key" + strconv.Itoa(i))
+		assert.Nil(err)
+	}
+	assert.Nil(db.Close())
+}
+
+func TestPlainWalIsRejectedByEncryptedTree(t *testing.T) {
+	assert := assert.New(t)
+	fs := NewMemFS()
+	db, err := Open("db", &Options{FS: fs})
+	assert.Nil(err)
+	assert.Nil(db.Set("key", "value"))
+	assert.Nil(db.Close())
+
+	opts := &Options{FS: fs, KeyProvider: testKeyProvider("k1")}
+	// both the metadata and the WAL of the plain tree are rejected
+	data, err := readFile(fs, "db/"+metadataFilename)
+	assert.Nil(err)
+	assert.False(bytes.HasPrefix(data, []byte(sealedMagic)))
+	_, err = Open("db", opts)
+	assert.True(errors.Is(err, ErrNotEncrypted), err)
+	assert.Nil(fs.Remove("db/" + metadataFilename))
+	_, err = Open("db", opts)
+	assert.True(errors.Is(err, ErrNotEncrypted), err)
+
+	opts.AllowPlaintextMigration = true
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	val, err := db.Get("key")
+	assert.Nil(err)
+	assert.Equal(val, "value")
+	assert.Nil(db.Close())
+}
+
+func TestSegmentsWrappedWithLongKeyIDAreReadable(t *testing.T) {
+	assert := assert.New(t)
+	id := strings.Repeat("k", 2000)
+	provider := &StaticKeyProvider{Current: id, Keys: map[string][]byte{id: bytes.Repeat([]byte{3}, 32)}}
+	opts := &Options{FS: NewMemFS(), MemtableSize: 100, SparsityFactor: 2, KeyProvider: provider}
+	db, err := Open("db", opts)
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+	}
+	assert.Nil(db.flush())
+	assert.Nil(db.Close())
+
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		val, err := db.Get("key" + strconv.Itoa(i))
+		assert.Nil(err)
+		assert.Equal(val, "value")
+	}
+	assert.Nil(db.Close())
+}
@@ -0,0 +1,256 @@
+package simplekv
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventListener is notified of the flushes, compactions, stalls and errors
+// of a tree, e.g. to log them or to alert when compactions fall behind.
+// Callbacks run synchronously with the tree locked, they must return
+// quickly and must not call the tree. Embed BaseEventListener to only
+// implement some of them.
+type EventListener interface {
+	// OnFlushBegin is called before the memtable of a column family is
+	// written to a new segment.
+	OnFlushBegin(info FlushInfo)
+	// OnFlushCompleted is called once the flush is done, or failed.
+	OnFlushCompleted(info FlushInfo)
+	// OnCompactionBegin is called for the compactions that replaced
+	// segments or failed, before OnCompactionCompleted. Compactions leaving
+	// the segments unchanged are not reported.
+	OnCompactionBegin(info CompactionInfo)
+	// OnCompactionCompleted is called once the compaction is done, or
+	// failed.
+	OnCompactionCompleted(info CompactionInfo)
+	// OnWriteStall is called when a write had to wait for the memtables to
+	// be flushed and the segments compacted. Flushing a full memtable alone
+	// is no stall.
+	OnWriteStall(info WriteStallInfo)
+	// OnBackgroundError is called when a flush or a compaction fails, the
+	// write that triggered it fails too.
+	OnBackgroundError(info BackgroundErrorInfo)
+	// OnSegmentDeleted is called when a segment file is deleted.
+	OnSegmentDeleted(info SegmentDeletedInfo)
+}
+
+// BaseEventListener EventListener ignoring every event.
+type BaseEventListener struct{}
+
+func (BaseEventListener) OnFlushBegin(FlushInfo)                {}
+func (BaseEventListener) OnFlushCompleted(FlushInfo)            {}
+func (BaseEventListener) OnCompactionBegin(CompactionInfo)      {}
+func (BaseEventListener) OnCompactionCompleted(CompactionInfo)  {}
+func (BaseEventListener) OnWriteStall(WriteStallInfo)           {}
+func (BaseEventListener) OnBackgroundError(BackgroundErrorInfo) {}
+func (BaseEventListener) OnSegmentDeleted(SegmentDeletedInfo)   {}
+
+// FlushInfo describes the flush of the memtable of a column family.
+type FlushInfo struct {
+	ColumnFamily string
+	// Segment is the segment the memtable is written to, it is only known
+	// once the compactions preceding the flush are done.
+	Segment string
+	// Keys is the number of keys of the memtable.
+	Keys int
+	// Bytes is the size of the segment, once flushed.
+	Bytes int64
+	// Duration is how long the flush took, compactions included.
+	Duration time.Duration
+	// Err is the error the flush failed with.
+	Err error
+}
+
+// CompactionReason tells which step of a flush compacts segments.
+type CompactionReason int
+
+const (
+	// CompactionReasonDeleteKeys rewrites the segments holding keys the
+	// memtable overwrites or deletes.
+	CompactionReasonDeleteKeys CompactionReason = iota
+	// CompactionReasonMergeSegments merges all segments into one.
+	CompactionReasonMergeSegments
+)
+
+var compactionReasonNames = map[CompactionReason]string{
+	CompactionReasonDeleteKeys:    "delete-keys",
+	CompactionReasonMergeSegments: "merge-segments",
+}
+
+func (r CompactionReason) String() string {
+	if name, ok := compactionReasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("CompactionReason(%d)", int(r))
+}
+
+// CompactionInfo describes a compaction of the segments of a column family.
+type CompactionInfo struct {
+	ColumnFamily string
+	Reason       CompactionReason
+	// Inputs are the segments the compaction may replace when it begins,
+	// the ones it replaced or dropped once completed.
+	Inputs []string
+	// Outputs are the segments written by the compaction.
+	Outputs     []string
+	InputBytes  int64
+	OutputBytes int64
+	Duration    time.Duration
+	// Err is the error the compaction failed with.
+	Err error
+}
+
+// WriteStallInfo describes a write that waited for a flush and compaction.
+type WriteStallInfo struct {
+	ColumnFamily string
+	// Duration is how long the write waited.
+	Duration time.Duration
+}
+
+// BackgroundErrorReason tells what failed.
+type BackgroundErrorReason int
+
+const (
+	BackgroundErrorFlush BackgroundErrorReason = iota
+	BackgroundErrorCompaction
+)
+
+func (r BackgroundErrorReason) String() string {
+	switch r {
+	case BackgroundErrorFlush:
+		return "flush"
+	case BackgroundErrorCompaction:
+		return "compaction"
+	}
+	return fmt.Sprintf("BackgroundErrorReason(%d)", int(r))
+}
+
+// BackgroundErrorInfo describes a failed flush or compaction.
+type BackgroundErrorInfo struct {
+	ColumnFamily string
+	Reason       BackgroundErrorReason
+	Err          error
+}
+
+// SegmentDeletedInfo describes the deletion of a segment file.
+type SegmentDeletedInfo struct {
+	ColumnFamily string
+	Segment      string
+	Path         string
+	// Orphan is set for the segments a crash left behind, deleted on open.
+	Orphan bool
+}
+
+// notify calls event on every listener of t.
+func (t *Tree) notify(event func(EventListener)) {
+	for _, listener := range t.opts.EventListeners {
+		event(listener)
+	}
+}
+
+// flushForWrite flushes the memtables for a write of t they can't hold. The
+// write stalls when the flush has to compact the segments first.
+func (t *Tree) flushForWrite() error {
+	root := t.root()
+	start := time.Now()
+	compactions := root.compactions
+	err := t.flush()
+	if root.compactions != compactions && len(t.opts.EventListeners) > 0 {
+		info := WriteStallInfo{ColumnFamily: t.columnFamilyName(), Duration: time.Since(start)}
+		t.notify(func(l EventListener) { l.OnWriteStall(info) })
+	}
+	return err
+}
+
+// segmentDeleted notifies the deletion of segment.
+func (t *Tree) segmentDeleted(segment string, orphan bool) {
+	if len(t.opts.EventListeners) == 0 {
+		return
+	}
+	info := SegmentDeletedInfo{
+		ColumnFamily: t.columnFamilyName(),
+		Segment:      segment,
+		Path:         t.segmentPath(segment),
+		Orphan:       orphan,
+	}
+	t.notify(func(l EventListener) { l.OnSegmentDeleted(info) })
+}
+
+// compaction runs the compaction fn of the segments of t, and reports it to
+// the listeners and in the statistics when it changed the segments or
+// failed. Whether it does is only known once it is done.
+func (t *Tree) compaction(reason CompactionReason, fn func() error) error {
+	if !t.compactionNeeded(reason) {
+		return fn()
+	}
+	inputs := append([]string(nil), t.segments...)
+	before := map[string]bool{}
+	for _, segment := range inputs {
+		before[segment] = true
+	}
+	obsolete := len(t.obsolete)
+	start := time.Now()
+	err := fn()
+	info := CompactionInfo{
+		ColumnFamily: t.columnFamilyName(),
+		Reason:       reason,
+		Duration:     time.Since(start),
+		Err:          err,
+	}
+
+	// segments written and replaced by the same compaction are left out
+	for _, segment := range t.obsolete[obsolete:] {
+		if before[segment] {
+			info.Inputs = append(info.Inputs, segment)
+		}
+	}
+	for _, segment := range t.segments {
+		if !before[segment] {
+			info.Outputs = append(info.Outputs, segment)
+		}
+	}
+	info.InputBytes = t.segmentsSize(info.Inputs)
+	info.OutputBytes = t.segmentsSize(info.Outputs)
+	if len(info.Inputs) == 0 && len(info.Outputs) == 0 && err == nil {
+		return nil
+	}
+	t.root().compactions++
+	t.stats.compactions.add(1)
+	t.stats.compactionBytes.add(info.OutputBytes)
+
+	begin := info
+	begin.Inputs, begin.Outputs, begin.OutputBytes = inputs, nil, 0
+	begin.InputBytes, begin.Duration, begin.Err = t.segmentsSize(inputs), 0, nil
+	t.opts.Logger.Info("compacting", "cf", begin.ColumnFamily, "reason", reason,
+		"segments", len(begin.Inputs), "bytes", begin.InputBytes)
+	t.notify(func(l EventListener) { l.OnCompactionBegin(begin) })
+	if info.Err != nil {
+		t.opts.Logger.Error("compaction failed", "cf", info.ColumnFamily, "reason", reason, "err", info.Err)
+	} else {
+		t.opts.Logger.Info("compacted", "cf", info.ColumnFamily, "reason", reason,
+			"inputs", info.Inputs, "outputs", info.Outputs, "input_bytes", info.InputBytes,
+			"output_bytes", info.OutputBytes, "duration", info.Duration)
+	}
+	t.notify(func(l EventListener) { l.OnCompactionCompleted(info) })
+	return info.Err
+}
+
+// compactionNeeded tells whether the compaction may change the segments.
+func (t *Tree) compactionNeeded(reason CompactionReason) bool {
+	switch reason {
+	case CompactionReasonMergeSegments:
+		return len(t.segments) > 1
+	}
+	return len(t.segments) > 0
+}
+
+// segmentsSize returns the size on disk of segments.
+func (t *Tree) segmentsSize(segments []string) int64 {
+	var size int64
+	for _, segment := range segments {
+		if info, err := t.opts.FS.Stat(t.segmentPath(segment)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
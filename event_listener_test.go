@@ -0,0 +1,208 @@
+package simplekv
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingListener struct {
+	BaseEventListener
+	flushBegins      []FlushInfo
+	flushes          []FlushInfo
+	compactionBegins []CompactionInfo
+	compactions      []CompactionInfo
+	stalls           []WriteStallInfo
+	errors           []BackgroundErrorInfo
+	deleted          []SegmentDeletedInfo
+}
+
+func (l *recordingListener) OnFlushBegin(info FlushInfo) {
+	l.flushBegins = append(l.flushBegins, info)
+}
+
+func (l *recordingListener) OnFlushCompleted(info FlushInfo) {
+	l.flushes = append(l.flushes, info)
+}
+
+func (l *recordingListener) OnCompactionBegin(info CompactionInfo) {
+	l.compactionBegins = append(l.compactionBegins, info)
+}
+
+func (l *recordingListener) OnCompactionCompleted(info CompactionInfo) {
+	l.compactions = append(l.compactions, info)
+}
+
+func (l *recordingListener) OnWriteStall(info WriteStallInfo) {
+	l.stalls = append(l.stalls, info)
+}
+
+func (l *recordingListener) OnBackgroundError(info BackgroundErrorInfo) {
+	l.errors = append(l.errors, info)
+}
+
+func (l *recordingListener) OnSegmentDeleted(info SegmentDeletedInfo) {
+	l.deleted = append(l.deleted, info)
+}
+
+func TestEventListenerFlushAndCompaction(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	listener := &recordingListener{}
+	db, err := Open("db", &Options{MemtableSize: 100, SparsityFactor: 2, FS: NewMemFS(),
+		EventListeners: []EventListener{listener}})
+	assert.Nil(err)
+	for i := 0; i < 60; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i%30), "value"+strconv.Itoa(i)))
+	}
+	assert.True(len(listener.flushes) > 1)
+	assert.Equal(len(listener.flushBegins), len(listener.flushes))
+	assert.Nil(listener.errors)
+	for _, info := range listener.flushes {
+		assert.Equal(info.ColumnFamily, DefaultColumnFamilyName)
+		assert.NotEqual(info.Segment, "")
+		assert.True(info.Keys > 0)
+		assert.True(info.Bytes > 0)
+		assert.Nil(info.Err)
+	}
+	assert.Equal(listener.flushes[len(listener.flushes)-1].Segment, db.segments[len(db.segments)-1])
+
+	// the flushes of overwritten keys rewrite the segments holding them,
+	// the writes stall on them
+	assert.True(len(listener.compactions) > 0)
+	assert.True(len(listener.compactions) < len(listener.flushes))
+	assert.Equal(len(listener.compactionBegins), len(listener.compactions))
+	assert.Equal(len(listener.stalls), len(listener.compactions))
+	deleted := map[string]bool{}
+	for _, info := range listener.deleted {
+		assert.False(info.Orphan)
+		assert.Equal(info.Path, db.segmentPath(info.Segment))
+		assert.False(fileExists(db.opts.FS, info.Path))
+		deleted[info.Segment] = true
+	}
+	for _, info := range listener.compactions {
+		assert.Equal(info.Reason, CompactionReasonDeleteKeys)
+		assert.Nil(info.Err)
+		// the segments left without keys are dropped
+		assert.True(len(info.Inputs) > 0)
+		assert.True(len(info.Outputs) <= len(info.Inputs))
+		for _, input := range info.Inputs {
+			assert.True(deleted[input], input)
+		}
+	}
+	assert.Nil(db.Close())
+}
+
+func TestEventListenerSkipsCompactionsChangingNothing(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	listener := &recordingListener{}
+	db, err := Open("db", &Options{FS: NewMemFS(), EventListeners: []EventListener{listener}})
+	assert.Nil(err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+		assert.Nil(db.flush())
+	}
+	assert.Equal(len(db.segments), 3)
+	assert.Equal(len(listener.flushes), 3)
+	assert.Nil(listener.compactionBegins)
+	assert.Nil(listener.compactions)
+	assert.Nil(db.Close())
+}
+
+func TestEventListenerMergeSegments(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	listener := &recordingListener{}
+	db, err := Open("db", &Options{MemtableSize: 100, SparsityFactor: 2, FS: NewMemFS(),
+		CompactionStrategy: CompactionMergeSegments, EventListeners: []EventListener{listener}})
+	assert.Nil(err)
+	for i := 0; i < 40; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+	}
+	merges := 0
+	for _, info := range listener.compactions {
+		if info.Reason != CompactionReasonMergeSegments {
+			continue
+		}
+		merges++
+		assert.Equal(len(info.Inputs), 2)
+		assert.Equal(len(info.Outputs), 1)
+		assert.True(info.InputBytes > 0)
+		assert.True(info.OutputBytes > 0)
+	}
+	assert.Equal(merges, len(listener.flushes)-1)
+	assert.Equal(db.segments, listener.compactions[len(listener.compactions)-1].Outputs)
+	assert.Nil(db.Close())
+}
+
+func TestEventListenerColumnFamily(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	listener := &recordingListener{}
+	db, err := Open("db", &Options{MemtableSize: 100, SparsityFactor: 2, FS: NewMemFS(),
+		EventListeners: []EventListener{listener}})
+	assert.Nil(err)
+	cf, err := db.CreateColumnFamily("users", nil)
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(cf.Set("key"+strconv.Itoa(i), "value"))
+	}
+	// the flushes of new keys compact nothing
+	assert.Nil(listener.stalls)
+	for i := 0; i < 20; i++ {
+		assert.Nil(cf.Set("key"+strconv.Itoa(i), "value2"))
+	}
+	assert.True(len(listener.stalls) > 0)
+	assert.Equal(listener.stalls[0].ColumnFamily, "users")
+	families := map[string]bool{}
+	for _, info := range listener.flushes {
+		families[info.ColumnFamily] = true
+	}
+	assert.True(families["users"])
+	assert.Nil(db.Close())
+}
+
+func TestEventListenerBackgroundError(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	listener := &recordingListener{}
+	fs := NewFaultFS()
+	db, err := Open("db", &Options{MemtableSize: 100, SparsityFactor: 2, FS: fs,
+		EventListeners: []EventListener{listener}})
+	assert.Nil(err)
+	for i := 0; len(listener.flushes) == 0; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+	}
+	// the next flush rewrites the first segment
+	for i := 0; i < 4; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "new"))
+	}
+	fs.FailAfter(1)
+	assert.NotNil(db.flush())
+	assert.Equal(len(listener.errors), 1)
+	assert.Equal(listener.errors[0].Reason, BackgroundErrorCompaction)
+	assert.Equal(listener.errors[0].ColumnFamily, DefaultColumnFamilyName)
+	assert.NotNil(listener.flushes[len(listener.flushes)-1].Err)
+	assert.NotNil(listener.compactions[len(listener.compactions)-1].Err)
+}
+
+func TestEventListenerOrphanSegments(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	db, err := Open("db", &Options{FS: fs})
+	assert.Nil(err)
+	assert.Nil(db.Close())
+	for _, name := range []string{"000099.sst", "database_metadata.tmp"} {
+		assert.Nil(writeFile(fs, "db/"+name, []byte("orphan")))
+	}
+	listener := &recordingListener{}
+	db, err = Open("db", &Options{FS: fs, EventListeners: []EventListener{listener}})
+	assert.Nil(err)
+	assert.Equal(len(listener.deleted), 1)
+	assert.Equal(listener.deleted[0].Segment, "000099.sst")
+	assert.True(listener.deleted[0].Orphan)
+	assert.Nil(db.Close())
+}
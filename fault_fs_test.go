@@ -0,0 +1,293 @@
+package simplekv
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrInjected is returned by the operations a FaultFS fails.
+var ErrInjected = errors.New("injected fault")
+
+// FaultFS MemFS that fails operations on demand and loses the writes that
+// were not synced when it crashes, to test recovery. Every operation that
+// changes the file system, opening a file included, is counted. Renames,
+// removals and new directories are durable as soon as they return.
+type FaultFS struct {
+	mem *MemFS
+
+	mu     sync.Mutex
+	ops    int
+	failAt int
+	epoch  int
+	// synced holds the durable content of the files written since their
+	// last sync
+	synced map[*memNode][]byte
+	// torn is the file the failing write wrote half of its bytes to
+	torn *memNode
+}
+
+func NewFaultFS() *FaultFS {
+	return &FaultFS{
+		mem:    NewMemFS(),
+		synced: map[*memNode][]byte{},
+	}
+}
+
+// Ops returns the number of operations counted so far.
+func (fs *FaultFS) Ops() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.ops
+}
+
+// FailAfter makes the n-th counted operation from now fail with
+// ErrInjected, as if the process died there: every later operation fails
+// too, until Crash. The failing write still writes half of its bytes.
+func (fs *FaultFS) FailAfter(n int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.failAt = fs.ops + n
+}
+
+// Crash simulates a power loss: the writes that were not synced are
+// dropped, the files and locks opened before are lost and operations stop
+// failing.
+func (fs *FaultFS) Crash() {
+	fs.crash(false)
+}
+
+// CrashTorn is Crash, except that the file the failing write tore keeps
+// what was written to it, the torn half of that write included, as when
+// the pages of a file reach the disk before the crash but not all of them.
+func (fs *FaultFS) CrashTorn() {
+	fs.crash(true)
+}
+
+func (fs *FaultFS) crash(keepTorn bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for node, data := range fs.synced {
+		if keepTorn && node == fs.torn {
+			continue
+		}
+		node.mu.Lock()
+		node.data = data
+		node.mu.Unlock()
+	}
+	fs.synced = map[*memNode][]byte{}
+	fs.torn = nil
+	fs.failAt = 0
+	fs.epoch++
+
+	fs.mem.mu.Lock()
+	fs.mem.locks = map[string]bool{}
+	fs.mem.mu.Unlock()
+}
+
+// op counts an operation of the given epoch, it fails once the fault is
+// reached or when the epoch is over.
+func (fs *FaultFS) op(epoch int, counted bool) error {
+	_, err := fs.count(epoch, counted)
+	return err
+}
+
+// count is op, it also tells whether the operation is the one reaching
+// the fault.
+func (fs *FaultFS) count(epoch int, counted bool) (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if epoch != fs.epoch || fs.failed() {
+		return false, ErrInjected
+	}
+	if counted {
+		fs.ops++
+		if fs.failed() {
+			return true, ErrInjected
+		}
+	}
+	return false, nil
+}
+
+// failed tells whether the fault was reached, fs.mu must be held.
+func (fs *FaultFS) failed() bool {
+	return fs.failAt > 0 && fs.ops >= fs.failAt
+}
+
+// track remembers the durable content of node before it is changed.
+func (fs *FaultFS) track(node *memNode) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.synced[node]; ok {
+		return
+	}
+	node.mu.RLock()
+	fs.synced[node] = append([]byte(nil), node.data...)
+	node.mu.RUnlock()
+}
+
+func (fs *FaultFS) currentEpoch() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.epoch
+}
+
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	epoch := fs.currentEpoch()
+	if err := fs.op(epoch, true); err != nil {
+		return nil, err
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if writable && flag&os.O_TRUNC != 0 {
+		// the truncation is lost too when the file isn't synced
+		if file, err := fs.mem.OpenFile(name, os.O_RDONLY, 0); err == nil {
+			fs.track(file.(*memFile).node)
+			file.Close()
+		}
+	}
+	file, err := fs.mem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{fs: fs, epoch: epoch, file: file.(*memFile)}, nil
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	if err := fs.op(fs.currentEpoch(), true); err != nil {
+		return err
+	}
+	return fs.mem.Remove(name)
+}
+
+func (fs *FaultFS) RemoveAll(name string) error {
+	if err := fs.op(fs.currentEpoch(), true); err != nil {
+		return err
+	}
+	return fs.mem.RemoveAll(name)
+}
+
+func (fs *FaultFS) Rename(oldname, newname string) error {
+	if err := fs.op(fs.currentEpoch(), true); err != nil {
+		return err
+	}
+	return fs.mem.Rename(oldname, newname)
+}
+
+func (fs *FaultFS) Link(oldname, newname string) error {
+	if err := fs.op(fs.currentEpoch(), true); err != nil {
+		return err
+	}
+	return fs.mem.Link(oldname, newname)
+}
+
+func (fs *FaultFS) MkdirAll(dir string, perm os.FileMode) error {
+	if err := fs.op(fs.currentEpoch(), true); err != nil {
+		return err
+	}
+	return fs.mem.MkdirAll(dir, perm)
+}
+
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := fs.op(fs.currentEpoch(), false); err != nil {
+		return nil, err
+	}
+	return fs.mem.Stat(name)
+}
+
+func (fs *FaultFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	if err := fs.op(fs.currentEpoch(), false); err != nil {
+		return nil, err
+	}
+	return fs.mem.ReadDir(dir)
+}
+
+func (fs *FaultFS) Lock(name string) (io.Closer, error) {
+	if err := fs.op(fs.currentEpoch(), true); err != nil {
+		return nil, err
+	}
+	return fs.mem.Lock(name)
+}
+
+// faultFile handle of a FaultFS file, it stops working after a crash
+type faultFile struct {
+	fs    *FaultFS
+	epoch int
+	file  *memFile
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.op(f.epoch, false); err != nil {
+		return 0, err
+	}
+	return f.file.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.op(f.epoch, false); err != nil {
+		return 0, err
+	}
+	return f.file.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	reached, err := f.fs.count(f.epoch, true)
+	if err != nil && !reached {
+		return 0, err
+	}
+	f.fs.track(f.file.node)
+	if err != nil {
+		// a torn write
+		f.fs.mu.Lock()
+		f.fs.torn = f.file.node
+		f.fs.mu.Unlock()
+		n, _ := f.file.Write(p[:len(p)/2])
+		return n, err
+	}
+	return f.file.Write(p)
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.fs.op(f.epoch, false); err != nil {
+		return 0, err
+	}
+	return f.file.Seek(offset, whence)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.op(f.epoch, true); err != nil {
+		return err
+	}
+	f.fs.mu.Lock()
+	delete(f.fs.synced, f.file.node)
+	f.fs.mu.Unlock()
+	return f.file.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fs.op(f.epoch, true); err != nil {
+		return err
+	}
+	f.fs.track(f.file.node)
+	return f.file.Truncate(size)
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if err := f.fs.op(f.epoch, false); err != nil {
+		return nil, err
+	}
+	return f.file.Stat()
+}
+
+func (f *faultFile) Close() error {
+	if err := f.fs.op(f.epoch, false); err != nil {
+		return err
+	}
+	return f.file.Close()
+}
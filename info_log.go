@@ -0,0 +1,166 @@
+package simplekv
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	infoLogFilename  = "LOG"
+	infoLogOldPrefix = "LOG.old."
+)
+
+// infoLog LOG file of a tree directory, receiving the info level
+// diagnostics. It is rotated like RocksDB's: the LOG of the previous open,
+// or one grown past MaxLogFileSize, is renamed LOG.old.<microseconds> and
+// only the KeepLogFileNum newest rotated files are kept.
+type infoLog struct {
+	fs      FS
+	dir     string
+	clock   Clock
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	file File
+	size int64
+}
+
+func openInfoLog(fs FS, dir string, opts *Options) (*infoLog, error) {
+	l := &infoLog{
+		fs:      fs,
+		dir:     dir,
+		clock:   opts.Clock,
+		maxSize: opts.MaxLogFileSize,
+		keep:    opts.KeepLogFileNum,
+	}
+	err := l.rotate()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// logger returns a Logger writing the info level records to l.
+func (l *infoLog) logger() Logger {
+	return slog.New(slog.NewTextHandler(l, &slog.HandlerOptions{Level: slog.LevelInfo}))
+}
+
+func (l *infoLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return 0, os.ErrClosed
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *infoLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// rotate moves the current LOG aside and starts a new one.
+func (l *infoLog) rotate() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	path := l.dir + infoLogFilename
+	if fileExists(l.fs, path) {
+		stamp := l.clock.Now().UnixMicro()
+		for fileExists(l.fs, l.oldPath(stamp)) {
+			stamp++
+		}
+		err := l.fs.Rename(path, l.oldPath(stamp))
+		if err != nil {
+			return fmt.Errorf("rotate info log err: %s", err)
+		}
+	}
+	file, err := l.fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return fmt.Errorf("open info log err: %s", err)
+	}
+	l.file, l.size = file, 0
+	return l.removeOldFiles()
+}
+
+func (l *infoLog) oldPath(stamp int64) string {
+	return l.dir + infoLogOldPrefix + strconv.FormatInt(stamp, 10)
+}
+
+// removeOldFiles removes the oldest rotated files beyond the kept ones.
+func (l *infoLog) removeOldFiles() error {
+	infos, err := l.fs.ReadDir(l.dir)
+	if err != nil {
+		return fmt.Errorf("read dir: %s err: %s", l.dir, err)
+	}
+	var stamps []int64
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasPrefix(info.Name(), infoLogOldPrefix) {
+			continue
+		}
+		stamp, err := strconv.ParseInt(strings.TrimPrefix(info.Name(), infoLogOldPrefix), 10, 64)
+		if err == nil {
+			stamps = append(stamps, stamp)
+		}
+	}
+	if len(stamps) <= l.keep {
+		return nil
+	}
+	sort.Slice(stamps, func(i, j int) bool { return stamps[i] < stamps[j] })
+	for _, stamp := range stamps[:len(stamps)-l.keep] {
+		err = l.fs.Remove(l.oldPath(stamp))
+		if err != nil {
+			return fmt.Errorf("remove old info log err: %s", err)
+		}
+	}
+	return nil
+}
+
+// teeLogger Logger writing to each of its loggers.
+type teeLogger []Logger
+
+func (l teeLogger) Debug(msg string, args ...any) {
+	for _, logger := range l {
+		logger.Debug(msg, args...)
+	}
+}
+
+func (l teeLogger) Info(msg string, args ...any) {
+	for _, logger := range l {
+		logger.Info(msg, args...)
+	}
+}
+
+func (l teeLogger) Warn(msg string, args ...any) {
+	for _, logger := range l {
+		logger.Warn(msg, args...)
+	}
+}
+
+func (l teeLogger) Error(msg string, args ...any) {
+	for _, logger := range l {
+		logger.Error(msg, args...)
+	}
+}
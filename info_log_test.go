@@ -0,0 +1,168 @@
+package simplekv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingLogger Logger keeping its records as "LEVEL msg key value...".
+type recordingLogger struct {
+	mu      sync.Mutex
+	records []string
+}
+
+func (l *recordingLogger) log(level, msg string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records = append(l.records, strings.TrimSuffix(fmt.Sprintln(append([]any{level, msg}, args...)...), "\n"))
+}
+
+func (l *recordingLogger) Debug(msg string, args ...any) { l.log("DEBUG", msg, args...) }
+func (l *recordingLogger) Info(msg string, args ...any)  { l.log("INFO", msg, args...) }
+func (l *recordingLogger) Warn(msg string, args ...any)  { l.log("WARN", msg, args...) }
+func (l *recordingLogger) Error(msg string, args ...any) { l.log("ERROR", msg, args...) }
+
+// has tells whether a record starts with prefix.
+func (l *recordingLogger) has(prefix string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, record := range l.records {
+		if strings.HasPrefix(record, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// oldInfoLogs returns the rotated LOG files of dir.
+func oldInfoLogs(t *testing.T, fs FS, dir string) []string {
+	infos, err := fs.ReadDir(dir)
+	assert.Nil(t, err)
+	var names []string
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), infoLogOldPrefix) {
+			names = append(names, info.Name())
+		}
+	}
+	return names
+}
+
+func TestInfoLog(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	opts := &Options{MemtableSize: 100, SparsityFactor: 2, FS: fs, KeepLogFileNum: 2}
+	for i := 0; i < 4; i++ {
+		db, err := Open("db", opts)
+		assert.Nil(err)
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+		assert.Nil(db.Close())
+		rotated := i
+		if rotated > 2 {
+			rotated = 2
+		}
+		assert.Equal(len(oldInfoLogs(t, fs, "db")), rotated)
+	}
+	data, err := readFile(fs, "db/"+infoLogFilename)
+	assert.Nil(err)
+	assert.True(strings.Contains(string(data), "level=INFO msg=\"tree opened\" dir=db/"), string(data))
+	assert.True(strings.Contains(string(data), "msg=\"tree closed\""))
+
+	// the column families log to the LOG of the tree
+	db, err := Open("db", opts)
+	assert.Nil(err)
+	cf, err := db.CreateColumnFamily("users", nil)
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(cf.Set("key"+strconv.Itoa(i), "value"))
+	}
+	assert.Nil(db.Close())
+	data, err = readFile(fs, "db/"+infoLogFilename)
+	assert.Nil(err)
+	assert.True(strings.Contains(string(data), "msg=\"memtable flushed\" cf=users"), string(data))
+	assert.False(fileExists(fs, db.columnFamilyDir(1)+infoLogFilename))
+}
+
+func TestInfoLogMaxSize(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	db, err := Open("db", &Options{MemtableSize: 100, SparsityFactor: 2, FS: fs,
+		MaxLogFileSize: 512, KeepLogFileNum: 3})
+	assert.Nil(err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+	}
+	assert.Equal(len(oldInfoLogs(t, fs, "db")), 3)
+	info, err := fs.Stat("db/" + infoLogFilename)
+	assert.Nil(err)
+	assert.True(info.Size() <= 512)
+	assert.Nil(db.Close())
+}
+
+func TestDisableInfoLog(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	logger := &recordingLogger{}
+	db, err := Open("db", &Options{FS: fs, DisableInfoLog: true, Logger: logger})
+	assert.Nil(err)
+	assert.Nil(db.Close())
+	assert.False(fileExists(fs, "db/"+infoLogFilename))
+	assert.True(logger.has("INFO tree opened"))
+
+	_, err = Open("db", &Options{FS: fs, MaxLogFileSize: -1})
+	assert.ErrorIs(err, ErrInvalidOptions)
+}
+
+func TestLoggerDiagnostics(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	logger := &recordingLogger{}
+	opts := &Options{MemtableSize: 100, SparsityFactor: 2, FS: fs, Logger: logger,
+		SlowOperationThreshold: 1}
+	db, err := Open("db", opts)
+	assert.Nil(err)
+	for i := 0; i < 30; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i%20), "value"))
+	}
+	assert.Nil(db.Close())
+	for _, prefix := range []string{"INFO flushing memtable", "INFO memtable flushed", "INFO compacting",
+		"INFO compacted", "WARN slow operation op put"} {
+		assert.True(logger.has(prefix), prefix)
+	}
+
+	// a record torn by a crash
+	wal, err := readFile(fs, "db/wal")
+	assert.Nil(err)
+	assert.Nil(writeFile(fs, "db/wal", append(wal, "key,tor"...)))
+	logger = &recordingLogger{}
+	opts.Logger = logger
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	assert.True(logger.has("WARN wal torn tail dropped path db/wal offset "+strconv.Itoa(len(wal))+" bytes 7"),
+		logger.records)
+	assert.True(logger.has("INFO wal replayed"))
+	assert.Nil(db.Close())
+
+	// compactions failing
+	faultFS := NewFaultFS()
+	logger = &recordingLogger{}
+	db, err = Open("db", &Options{MemtableSize: 100, SparsityFactor: 2, FS: faultFS, Logger: logger})
+	assert.Nil(err)
+	for i := 0; i < 30; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i%20), "value"))
+	}
+	faultFS.FailAfter(1)
+	assert.NotNil(db.flush())
+	assert.True(logger.has("ERROR compaction failed"), logger.records)
+	assert.True(logger.has("ERROR flush failed"))
+}
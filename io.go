@@ -10,18 +10,25 @@ import (
 )
 
 type LineReader struct {
-	file  *os.File
+	file  io.Closer
 	inner *bufio.Reader
 }
 
+// NewLineReader returns a line reader positioned at offset of path.
 func NewLineReader(path string, offset int64) (*LineReader, error) {
-	file, err := os.OpenFile(path, os.O_RDONLY, 0666)
+	return newLineReader(OSFS, path, offset)
+}
+
+// newLineReader returns a line reader positioned at offset of path in fs.
+func newLineReader(fs FS, path string, offset int64) (*LineReader, error) {
+	file, err := fs.OpenFile(path, os.O_RDONLY, 0666)
 	if err != nil {
 		return nil, fmt.Errorf("open file err: %s", err)
 	}
 	if offset > 0 {
 		_, err = file.Seek(offset, 0)
 		if err != nil {
+			file.Close()
 			return nil, fmt.Errorf("seek segment file err: %s", err)
 		}
 	}
@@ -31,6 +38,15 @@ func NewLineReader(path string, offset int64) (*LineReader, error) {
 	}, nil
 }
 
+// newSectionLineReader reads r from offset up to size, Close leaves r open.
+func newSectionLineReader(r io.ReaderAt, offset, size int64) *LineReader {
+	section := io.NewSectionReader(r, offset, size-offset)
+	return &LineReader{
+		file:  io.NopCloser(section),
+		inner: bufio.NewReader(section),
+	}
+}
+
 func (r *LineReader) ReadLine() (string, error) {
 	line, err := r.inner.ReadString('\n')
 	if err != nil {
@@ -48,41 +64,25 @@ func (r *LineReader) ReadLineKV() (string, string, error) {
 	if err != nil {
 		return "", "", err
 	}
-	parts := strings.Split(line, ",")
-	if len(parts) != 2 {
+	rec, err := decodeRecord(line)
+	if err != nil {
 		return "", "", fmt.Errorf("kv line not valid: %s", line)
 	}
-	return parts[0], parts[1], nil
+	return rec.key, rec.value, nil
 }
 
-func (r *LineReader) Close() error {
-	return r.file.Close()
-}
-
-func readFileLines(path string) (lines []string) {
-	f, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
+// readRecord decodes the next line, it returns nil at the end of the file.
+func (r *LineReader) readRecord() (*record, error) {
+	line, err := r.ReadLine()
 	if err != nil {
-		return
-	}
-	defer f.Close()
-
-	rd := bufio.NewReader(f)
-	for {
-		line, err := rd.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return
+		if errors.Is(err, io.EOF) {
+			return nil, nil
 		}
-		lines = append(lines, line)
+		return nil, err
 	}
-	return
+	return decodeRecord(line)
 }
 
-func exists(path string) bool {
-	if _, err := os.Stat(path); err != nil && os.IsNotExist(err) {
-		return false
-	}
-	return true
+func (r *LineReader) Close() error {
+	return r.file.Close()
 }
@@ -0,0 +1,211 @@
+package simplekv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Iterator walks the live keys of a tree in key order. It sees the tree as
+// it was when created: the memtable is copied and the segment files are
+// kept open, so later writes and compactions don't show up. Close must be
+// called once done.
+type Iterator struct {
+	tree *Tree
+	// sources by priority, the memtable first then the newest segment
+	sources []recordSource
+	// range tombstones of every source, they mask the keys of the sources
+	// that follow
+	tombstones [][]rangeTombstone
+	key        string
+	value      string
+	err        error
+}
+
+type recordSource interface {
+	// peek returns the current record, nil once exhausted
+	peek() *record
+	next() error
+	close() error
+}
+
+// NewIterator returns an iterator positioned before the smallest key.
+func (t *Tree) NewIterator() (*Iterator, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	memtable := &sliceSource{}
+	if !t.memtable.inner.Empty() {
+		iter := t.memtable.inner.Iterator()
+		for iter != nil {
+			k := iter.Key.(keyType).key
+			if m, ok := iter.Value.(*mergeEntry); ok {
+				// operands are merged now, the base may be compacted away
+				rec, err := t.mergedRecord(k, m)
+				if err != nil {
+					return nil, err
+				}
+				memtable.records = append(memtable.records, rec)
+			} else {
+				memtable.records = append(memtable.records, recordFromMemtable(k, iter.Value))
+			}
+			iter = iter.Next()
+		}
+	}
+
+	it := &Iterator{
+		tree:       t,
+		sources:    []recordSource{memtable},
+		tombstones: [][]rangeTombstone{append([]rangeTombstone(nil), t.rangeTombstones...)},
+	}
+	for i := len(t.segments) - 1; i >= 0; i-- {
+		it.tombstones = append(it.tombstones, t.segmentTombstones[t.segments[i]])
+		reader, err := t.openSegment(t.segments[i], 0)
+		if err != nil {
+			it.Close()
+			return nil, fmt.Errorf("open segment: %s err: %s", t.segments[i], err)
+		}
+		source := &segmentSource{reader: reader}
+		it.sources = append(it.sources, source)
+		err = source.next()
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+	}
+	return it, nil
+}
+
+// Next moves to the next live key, it returns false at the end or on error.
+func (it *Iterator) Next() bool {
+	cmp := it.tree.opts.Comparator
+	for it.err == nil {
+		var smallest *record
+		from := 0
+		for i, source := range it.sources {
+			rec := source.peek()
+			if rec != nil && (smallest == nil || cmp.Compare(rec.key, smallest.key) < 0) {
+				smallest = rec
+				from = i
+			}
+		}
+		if smallest == nil {
+			return false
+		}
+		// older versions of the key are shadowed by smallest
+		for _, source := range it.sources {
+			for source.peek() != nil && source.peek().key == smallest.key {
+				if err := source.next(); err != nil {
+					it.err = err
+					return false
+				}
+			}
+		}
+		if smallest.kind == kindDelete || smallest.expired(it.tree.opts.Clock.Now()) {
+			continue
+		}
+		if it.masked(smallest.key, from) {
+			continue
+		}
+		it.key = smallest.key
+		it.value = smallest.value
+		return true
+	}
+	return false
+}
+
+// masked tells whether a range tombstone of a source newer than source
+// masks key.
+func (it *Iterator) masked(key string, source int) bool {
+	for _, tombstones := range it.tombstones[:source] {
+		if coveredBy(tombstones, key, it.tree.opts.Comparator) {
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the value of the current key.
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the segment files held by the iterator.
+func (it *Iterator) Close() error {
+	var err error
+	for _, source := range it.sources {
+		if closeErr := source.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	it.sources = nil
+	return err
+}
+
+// sliceSource records copied out of the memtable
+type sliceSource struct {
+	records []*record
+	pos     int
+}
+
+func (s *sliceSource) peek() *record {
+	if s.pos >= len(s.records) {
+		return nil
+	}
+	return s.records[s.pos]
+}
+
+func (s *sliceSource) next() error {
+	s.pos++
+	return nil
+}
+
+func (s *sliceSource) close() error {
+	return nil
+}
+
+// segmentSource records read from a segment file
+type segmentSource struct {
+	reader  *LineReader
+	current *record
+}
+
+func (s *segmentSource) peek() *record {
+	return s.current
+}
+
+// next moves to the next record, the range tombstones at the head of the
+// segment are skipped, the iterator knows them from the tree.
+func (s *segmentSource) next() error {
+	for {
+		line, err := s.reader.ReadLine()
+		if err != nil {
+			s.current = nil
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("read segment file err: %s", err)
+		}
+		s.current, err = decodeRecord(line)
+		if err != nil {
+			return fmt.Errorf("segment file data err: %s", err)
+		}
+		if s.current.kind != kindRangeDelete {
+			return nil
+		}
+	}
+}
+
+func (s *segmentSource) close() error {
+	return s.reader.Close()
+}
@@ -0,0 +1,76 @@
+package simplekv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func collect(t *testing.T, db *Tree) []string {
+	it, err := db.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+
+	var pairs []string
+	for it.Next() {
+		pairs = append(pairs, it.Key()+"="+it.Value())
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	return pairs
+}
+
+func TestIteratorMergesMemtableAndSegments(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, &Options{MemtableSize: 40, SparsityFactor: 10})
+	defer cleanup()
+	assert.Nil(err)
+
+	var expected []string
+	for i := 0; i < 20; i++ {
+		assert.Nil(db.Set(fmt.Sprintf("key%02d", i), "v1"))
+	}
+	for i := 0; i < 20; i += 3 {
+		assert.Nil(db.Set(fmt.Sprintf("key%02d", i), "v2"))
+	}
+	for i := 0; i < 20; i++ {
+		value := "v1"
+		if i%3 == 0 {
+			value = "v2"
+		}
+		expected = append(expected, fmt.Sprintf("key%02d=%s", i, value))
+	}
+	assert.NotEqual(len(db.segments), 0)
+	assert.Equal(collect(t, db), expected)
+	assert.Nil(db.Close())
+}
+
+func TestIteratorIsPointInTime(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, &Options{MemtableSize: 40, SparsityFactor: 10})
+	defer cleanup()
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(db.Set(fmt.Sprintf("key%02d", i), "v1"))
+	}
+
+	it, err := db.NewIterator()
+	assert.Nil(err)
+	// flushes and compactions rewrite the segments the iterator reads
+	for i := 0; i < 30; i++ {
+		assert.Nil(db.Set(fmt.Sprintf("key%02d", i), "v2"))
+	}
+	count := 0
+	for it.Next() {
+		assert.Equal(it.Value(), "v1")
+		count++
+	}
+	assert.Nil(it.Err())
+	assert.Nil(it.Close())
+	assert.Equal(count, 10)
+	assert.Nil(db.Close())
+}
@@ -1,8 +1,34 @@
 package simplekv
 
-type keyType string
+import (
+	rbtree "github.com/pedrogao/RbTree"
+)
+
+// keyType key of the memtable and of the sparse index, it is ordered by the
+// comparator of the tree holding it
+type keyType struct {
+	key  string
+	tree *orderedTree
+}
 
 func (n keyType) LessThan(b interface{}) bool {
 	value, _ := b.(keyType)
-	return n < value
+	return n.tree.cmp.Compare(n.key, value.key) < 0
+}
+
+// orderedTree red-black tree ordered by a Comparator, it backs the memtable
+// and the sparse index
+type orderedTree struct {
+	*rbtree.Tree
+	cmp Comparator
+}
+
+func newOrderedTree(cmp Comparator) *orderedTree {
+	return &orderedTree{Tree: rbtree.NewTree(), cmp: cmp}
+}
+
+// key returns the key of k in t. The keys of a tree share it, so that
+// identical keys are equal, as the comparator requires.
+func (t *orderedTree) key(k string) keyType {
+	return keyType{key: k, tree: t}
 }
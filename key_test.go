@@ -0,0 +1,71 @@
+package simplekv
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderedTreeOps(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newOrderedTree(BytewiseComparator{})
+	assert.True(s.Empty())
+	assert.Nil(s.FloorKey(s.key("a")))
+
+	want := map[string]int{}
+	for i := 0; i < 500; i++ {
+		k := strconv.Itoa(rand.Intn(200))
+		s.Insert(s.key(k), i)
+		want[k] = i
+	}
+	assert.Equal(s.Size(), len(want))
+	for k, v := range want {
+		assert.Equal(s.Find(s.key(k)), v)
+	}
+
+	var keys []string
+	for iter := s.Iterator(); iter != nil; iter = iter.Next() {
+		keys = append(keys, iter.Key.(keyType).key)
+	}
+	assert.True(sort.StringsAreSorted(keys))
+	assert.Equal(len(keys), len(want))
+
+	for k := range want {
+		s.Delete(s.key(k))
+		assert.False(s.Contains(s.key(k)))
+	}
+	assert.True(s.Empty())
+}
+
+func TestOrderedTreeFloorAndCeil(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newOrderedTree(BytewiseComparator{})
+	for _, k := range []string{"b", "d", "f"} {
+		s.Insert(s.key(k), k)
+	}
+	assert.Equal(s.FloorKey(s.key("e")), s.key("d"))
+	assert.Equal(s.FloorKey(s.key("d")), s.key("d"))
+	assert.Nil(s.FloorKey(s.key("a")))
+	assert.Equal(s.CeilKey(s.key("c")), s.key("d"))
+	assert.Nil(s.CeilKey(s.key("g")))
+}
+
+func TestOrderedTreeFollowsItsComparator(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newOrderedTree(NumericComparator{})
+	for _, k := range []string{"10", "9", "x", "100"} {
+		s.Insert(s.key(k), k)
+	}
+	var keys []string
+	for iter := s.Iterator(); iter != nil; iter = iter.Next() {
+		keys = append(keys, iter.Key.(keyType).key)
+	}
+	assert.Equal(keys, []string{"9", "10", "100", "x"})
+	assert.Equal(s.FloorKey(s.key("50")), s.key("10"))
+}
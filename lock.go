@@ -0,0 +1,39 @@
+package simplekv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrLocked is returned by Open when another process holds the LOCK file of
+// the database directory.
+var ErrLocked = errors.New("database is locked by another process")
+
+const lockFilename = "LOCK"
+
+// fileLock exclusive advisory lock on the LOCK file of a database directory
+type fileLock struct {
+	lock io.Closer
+}
+
+// acquireLock takes the exclusive lock on path of fs without blocking.
+func acquireLock(fs FS, path string) (*fileLock, error) {
+	lock, err := fs.Lock(path)
+	if err != nil {
+		if errors.Is(err, ErrLocked) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("open lock file: %s err: %s", path, err)
+	}
+	return &fileLock{lock: lock}, nil
+}
+
+// release unlocks and closes the LOCK file.
+func (l *fileLock) release() error {
+	err := l.lock.Close()
+	if err != nil {
+		return fmt.Errorf("close lock file err: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package simplekv
+
+import "os"
+
+// flock is unavailable here, the LOCK file is created but not locked.
+func lockFileDescriptor(file *os.File) error {
+	return nil
+}
+
+func unlockFileDescriptor(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,35 @@
+package simplekv
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenLocksDirectory(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, nil)
+	defer cleanup()
+	assert.Nil(err)
+	assert.True(exists(testBasePath + lockFilename))
+
+	_, err = Open(testBasePath, nil)
+	assert.True(errors.Is(err, ErrLocked))
+
+	err = db.Close()
+	assert.Nil(err)
+
+	db, err = Open(testBasePath, nil)
+	assert.Nil(err)
+	err = db.Close()
+	assert.Nil(err)
+
+	// closing again must not release the lock of another handle
+	other, err := Open(testBasePath, nil)
+	assert.Nil(err)
+	assert.Nil(db.Close())
+	_, err = Open(testBasePath, nil)
+	assert.True(errors.Is(err, ErrLocked))
+	assert.Nil(other.Close())
+}
@@ -0,0 +1,29 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package simplekv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func lockFileDescriptor(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("%w: %s", ErrLocked, file.Name())
+		}
+		return fmt.Errorf("flock %s err: %s", file.Name(), err)
+	}
+	return nil
+}
+
+func unlockFileDescriptor(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	if err != nil {
+		return fmt.Errorf("unlock %s err: %s", file.Name(), err)
+	}
+	return nil
+}
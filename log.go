@@ -2,23 +2,31 @@ package simplekv
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 )
 
 // AppendLog 追加日志
 type AppendLog struct {
+	fs       FS
 	filename string
-	stream   *os.File
+	stream   File
 }
 
 // NewAppendLog 新建追加日志
 func NewAppendLog(filename string) (*AppendLog, error) {
+	return newAppendLog(OSFS, filename)
+}
+
+func newAppendLog(fs FS, filename string) (*AppendLog, error) {
 	// link: https://en.wikipedia.org/wiki/File-system_permissions
-	stream, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+	stream, err := fs.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, fmt.Errorf("open log file: %s err: %s", filename, err)
 	}
 	log := &AppendLog{
+		fs:       fs,
 		filename: filename,
 		stream:   stream,
 	}
@@ -26,7 +34,7 @@ func NewAppendLog(filename string) (*AppendLog, error) {
 }
 
 func (l *AppendLog) WriteString(val string) error {
-	_, err := l.stream.WriteString(val)
+	_, err := io.WriteString(l.stream, val)
 	if err != nil {
 		return fmt.Errorf("write log file err: %s", err)
 	}
@@ -54,16 +62,61 @@ func (l *AppendLog) Sync() error {
 	return nil
 }
 
+// truncate cuts the log to size, a torn record is dropped before new
+// ones are appended after it.
+func (l *AppendLog) truncate(size int64) error {
+	err := l.stream.Truncate(size)
+	if err != nil {
+		return fmt.Errorf("truncate log file err: %s", err)
+	}
+	return l.Sync()
+}
+
+// Clear replaces the log with a new empty file. Readers still holding the
+// old file, such as secondaries, keep seeing its content and can tell the
+// logs apart with os.SameFile.
 func (l *AppendLog) Clear() error {
+	return l.Reset("")
+}
+
+// Reset replaces the log with a new file starting with header.
+func (l *AppendLog) Reset(header string) error {
 	err := l.stream.Close()
 	if err != nil {
 		return fmt.Errorf("close log file err: %s", err)
 	}
 
-	l.stream, err = os.OpenFile(l.filename, os.O_WRONLY|os.O_CREATE, 0666)
+	tempName := l.filename + ".tmp"
+	stream, err := l.fs.OpenFile(tempName, os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return fmt.Errorf("reopen log file err: %s", err)
 	}
+	if header != "" {
+		_, err = io.WriteString(stream, header)
+		if err != nil {
+			stream.Close()
+			return fmt.Errorf("write log file err: %s", err)
+		}
+	}
+	err = l.fs.Rename(tempName, l.filename)
+	if err == nil {
+		// the old log must not come back after a crash
+		err = syncDir(l.fs, filepath.Dir(l.filename))
+	}
+	if err != nil {
+		stream.Close()
+		return fmt.Errorf("replace log file err: %s", err)
+	}
+	l.stream = stream
+
+	return nil
+}
+
+func (l *AppendLog) Close() error {
+	err := l.stream.Close()
+	if err != nil {
+		return fmt.Errorf("close log file err: %s", err)
+	}
 
 	return nil
 }
@@ -40,7 +40,7 @@ func TestAppendLog_WriteString(t *testing.T) {
 	assert.Nil(err)
 	parts = strings.Split(string(data), "\n")
 
-	assert.Equal(len(parts), 6)
+	assert.Equal(len(parts), 3)
 
 	err = os.Remove(filepath)
 	assert.Nil(err)
@@ -1,26 +1,27 @@
 package simplekv
 
-import (
-	rbtree "github.com/pedrogao/RbTree"
-)
-
 // SizedMap map with size
 type SizedMap struct {
-	inner     *rbtree.Tree // 内部索引
+	inner     *orderedTree // 内部索引
 	totalSize int
 }
 
-// NewSizedMap new sized map
+// NewSizedMap new sized map ordered bytewise
 func NewSizedMap() *SizedMap {
+	return NewSizedMapWithComparator(BytewiseComparator{})
+}
+
+// NewSizedMapWithComparator new sized map ordered by cmp
+func NewSizedMapWithComparator(cmp Comparator) *SizedMap {
 	return &SizedMap{
-		inner:     rbtree.NewTree(),
+		inner:     newOrderedTree(cmp),
 		totalSize: 0,
 	}
 }
 
 // Get k
 func (m *SizedMap) Get(key string) interface{} {
-	return m.inner.Find(keyType(key))
+	return m.inner.Find(m.inner.key(key))
 }
 
 // Set k->v
@@ -31,15 +32,42 @@ func (m *SizedMap) Set(key string, v interface{}) {
 	}
 	size := len(key) + sizeof(v)
 	m.totalSize += size
-	m.inner.Insert(keyType(key), v)
+	m.inner.Insert(m.inner.key(key), v)
 }
 
 // Contains k
 func (m *SizedMap) Contains(key string) bool {
-	return m.inner.Contains(keyType(key))
+	return m.inner.Contains(m.inner.key(key))
 }
 
 // GetTotalSize total size of kvs
 func (m *SizedMap) GetTotalSize() int {
 	return m.totalSize
 }
+
+// Delete k
+func (m *SizedMap) Delete(key string) {
+	old := m.Get(key)
+	if old == nil {
+		return
+	}
+	m.totalSize -= len(key) + sizeof(old)
+	m.inner.Delete(m.inner.key(key))
+}
+
+// KeysInRange keys k with start <= k < end, in order
+func (m *SizedMap) KeysInRange(start, end string) []string {
+	ceil := m.inner.CeilKey(m.inner.key(start))
+	if ceil == nil {
+		return nil
+	}
+	var keys []string
+	for iter := m.inner.FindIt(ceil); iter != nil; iter = iter.Next() {
+		k := iter.Key.(keyType).key
+		if m.inner.cmp.Compare(k, end) >= 0 {
+			break
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
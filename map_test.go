@@ -17,3 +17,21 @@ func TestSizedMapOp(t *testing.T) {
 	m.Set("gender", "male")
 	assert.Equal(m.GetTotalSize(), 24)
 }
+
+func TestSizedMapDeleteAndRange(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewSizedMap()
+	for _, k := range []string{"a", "b", "c", "d"} {
+		m.Set(k, "v")
+	}
+	assert.Equal(m.KeysInRange("b", "d"), []string{"b", "c"})
+	assert.Equal(m.KeysInRange("bb", "z"), []string{"c", "d"})
+	assert.Nil(m.KeysInRange("e", "z"))
+
+	m.Delete("b")
+	m.Delete("missing")
+	assert.Nil(m.Get("b"))
+	assert.Equal(m.GetTotalSize(), 6)
+	assert.Equal(m.KeysInRange("a", "z"), []string{"a", "c", "d"})
+}
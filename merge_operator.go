@@ -0,0 +1,230 @@
+package simplekv
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrNoMergeOperator is returned by Merge, and by Open when the WAL holds
+// merge operands, if the options have no MergeOperator.
+var ErrNoMergeOperator = errors.New("no merge operator configured")
+
+// MergeOperator combines the operands recorded by Tree.Merge with the value
+// of their key, so that read-modify-write updates need no Get.
+type MergeOperator interface {
+	// Name identifies the operator.
+	Name() string
+	// FullMerge applies operands, oldest first, to the existing value of
+	// key, existing is nil when the key is absent.
+	FullMerge(key string, existing *string, operands []string) (string, error)
+	// PartialMerge combines two consecutive operands into one, ok is false
+	// when they can only be applied one by one.
+	PartialMerge(key, left, right string) (merged string, ok bool)
+}
+
+// mergeEntry memtable value of a key updated by Merge, the operands are
+// applied when the key is read or flushed
+type mergeEntry struct {
+	// HasBase tells Base is known, otherwise it is read from the segments
+	HasBase bool
+	// Base value the operands apply to, nil when the key is absent
+	Base *string
+	// ExpireAt expiry of Base, which the merged value keeps
+	ExpireAt int64
+	Operands []string
+}
+
+func (m *mergeEntry) size() int {
+	n := 0
+	if m.Base != nil {
+		n += len(*m.Base)
+	}
+	for _, operand := range m.Operands {
+		n += len(operand)
+	}
+	return n
+}
+
+// Merge records operand for key, the MergeOperator of the options combines
+// it with the value of key when read or compacted.
+func (t *Tree) Merge(key, operand string) error {
+	if t.opts.MergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+	return t.put(&record{key: key, value: operand, kind: kindMerge})
+}
+
+// mergeInto returns the memtable value of key once operand is added to it.
+func (t *Tree) mergeInto(key, operand string) *mergeEntry {
+	switch v := t.memtable.Get(key).(type) {
+	case nil:
+		// a range tombstone masks the base in the segments
+		return &mergeEntry{HasBase: t.rangeDeleted(key), Operands: []string{operand}}
+	case *mergeEntry:
+		// the memtable accounts the size of the old value, so it is copied
+		m := &mergeEntry{HasBase: v.HasBase, Base: v.Base, ExpireAt: v.ExpireAt}
+		last := len(v.Operands) - 1
+		merged, ok := t.opts.MergeOperator.PartialMerge(key, v.Operands[last], operand)
+		if ok {
+			m.Operands = append(append(m.Operands, v.Operands[:last]...), merged)
+		} else {
+			m.Operands = append(append(m.Operands, v.Operands...), operand)
+		}
+		return m
+	default:
+		m := &mergeEntry{HasBase: true, Operands: []string{operand}}
+		rec := recordFromMemtable(key, v)
+		if val, found := t.liveValue(rec); found {
+			m.Base, m.ExpireAt = &val, rec.expireAt
+		}
+		return m
+	}
+}
+
+// fullMerge applies the operands of m to their base value, found is false
+// once the base it expires with has expired.
+func (t *Tree) fullMerge(key string, m *mergeEntry) (string, bool, error) {
+	rec, err := t.mergedRecord(key, m)
+	if err != nil {
+		return "", false, err
+	}
+	val, found := t.liveValue(rec)
+	return val, found, nil
+}
+
+// mergedRecord returns the record of key holding the operands of m applied
+// to their base value, it expires with the base.
+func (t *Tree) mergedRecord(key string, m *mergeEntry) (*record, error) {
+	if t.opts.MergeOperator == nil {
+		return nil, ErrNoMergeOperator
+	}
+	base, expireAt := m.Base, m.ExpireAt
+	if !m.HasBase {
+		rec, err := t.findRecord(key)
+		if err != nil {
+			return nil, err
+		}
+		if rec != nil {
+			if val, found := t.liveValue(rec); found {
+				base, expireAt = &val, rec.expireAt
+			}
+		}
+	}
+	val, err := t.opts.MergeOperator.FullMerge(key, base, m.Operands)
+	if err != nil {
+		return nil, fmt.Errorf("full merge of key: %s err: %s", key, err)
+	}
+	return &record{key: key, value: val, expireAt: expireAt}, nil
+}
+
+// setMergeBases hands the merge operands of the memtable the base values
+// compaction removed from the segments, nil when a key has none.
+func (t *Tree) setMergeBases(bases map[string]*record) {
+	for k, rec := range bases {
+		m := t.memtable.Get(k).(*mergeEntry)
+		resolved := &mergeEntry{HasBase: true, Operands: m.Operands}
+		if rec != nil {
+			resolved.Base, resolved.ExpireAt = &rec.value, rec.expireAt
+		}
+		t.memtable.Set(k, resolved)
+	}
+}
+
+// resolveMerges replaces the merge operands of the memtable by their full
+// merge, so that flushed segments only hold values. It runs once compaction
+// handed the operands the bases it removed from the segments: the keys
+// left without one have none, they are not looked up.
+func (t *Tree) resolveMerges() error {
+	if t.memtable.inner.Empty() {
+		return nil
+	}
+	resolved := map[string]any{}
+	iter := t.memtable.inner.Iterator()
+	for iter != nil {
+		k := iter.Key.(keyType).key
+		if m, ok := iter.Value.(*mergeEntry); ok {
+			if !m.HasBase {
+				m = &mergeEntry{HasBase: true, Operands: m.Operands}
+			}
+			rec, err := t.mergedRecord(k, m)
+			if err != nil {
+				return err
+			}
+			resolved[k] = rec.memtableValue()
+		}
+		iter = iter.Next()
+	}
+	for k, v := range resolved {
+		t.memtable.Set(k, v)
+	}
+	return nil
+}
+
+// unresolvedMerge tells whether the memtable holds merge operands of key
+// whose base is still in the segments.
+func (t *Tree) unresolvedMerge(key string) bool {
+	m, ok := t.memtable.Get(key).(*mergeEntry)
+	return ok && !m.HasBase
+}
+
+// UInt64AddOperator adds operands to the value of a key, both written as
+// decimal uint64, an absent key counts as 0.
+type UInt64AddOperator struct{}
+
+func (UInt64AddOperator) Name() string {
+	return "uint64add"
+}
+
+func (UInt64AddOperator) FullMerge(key string, existing *string, operands []string) (string, error) {
+	var sum uint64
+	if existing != nil {
+		n, err := strconv.ParseUint(*existing, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("value not a uint64: %s", *existing)
+		}
+		sum = n
+	}
+	for _, operand := range operands {
+		n, err := strconv.ParseUint(operand, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("operand not a uint64: %s", operand)
+		}
+		sum += n
+	}
+	return strconv.FormatUint(sum, 10), nil
+}
+
+func (UInt64AddOperator) PartialMerge(key, left, right string) (string, bool) {
+	l, err := strconv.ParseUint(left, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	r, err := strconv.ParseUint(right, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	return strconv.FormatUint(l+r, 10), true
+}
+
+// StringAppendOperator appends operands to the value of a key, separated
+// by Delimiter.
+type StringAppendOperator struct {
+	Delimiter string
+}
+
+func (StringAppendOperator) Name() string {
+	return "stringappend"
+}
+
+func (o StringAppendOperator) FullMerge(key string, existing *string, operands []string) (string, error) {
+	if existing == nil {
+		return strings.Join(operands, o.Delimiter), nil
+	}
+	return *existing + o.Delimiter + strings.Join(operands, o.Delimiter), nil
+}
+
+func (o StringAppendOperator) PartialMerge(key, left, right string) (string, bool) {
+	return left + o.Delimiter + right, true
+}
@@ -0,0 +1,244 @@
+package simplekv
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeRequiresOperator(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, nil)
+	defer cleanup()
+	assert.Nil(err)
+
+	err = db.Merge("counter", "1")
+	assert.True(errors.Is(err, ErrNoMergeOperator))
+	assert.Nil(db.Close())
+}
+
+func TestMergeUInt64Add(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, &Options{MergeOperator: UInt64AddOperator{}})
+	defer cleanup()
+	assert.Nil(err)
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(db.Merge("counter", "2"))
+	}
+	val, err := db.Get("counter")
+	assert.Nil(err)
+	assert.Equal(val, "6")
+	// the operands were combined by partial merge
+	assert.Equal(db.memtable.Get("counter").(*mergeEntry).Operands, []string{"6"})
+
+	assert.Nil(db.Set("counter", "10"))
+	assert.Nil(db.Merge("counter", "5"))
+	val, err = db.Get("counter")
+	assert.Nil(err)
+	assert.Equal(val, "15")
+
+	assert.Nil(db.Merge("bad", "x"))
+	_, err = db.Get("bad")
+	assert.NotNil(err)
+	assert.Nil(db.Close())
+}
+
+func TestMergeAppliesOperandsToFlushedValue(t *testing.T) {
+	assert := assert.New(t)
+	for _, strategy := range []CompactionStrategy{CompactionDeleteKeys, CompactionMergeSegments} {
+		db, err := Open(testBasePath, &Options{
+			MemtableSize:       20,
+			SparsityFactor:     2,
+			CompactionStrategy: strategy,
+			MergeOperator:      StringAppendOperator{Delimiter: ","},
+		})
+		assert.Nil(err)
+
+		assert.Nil(db.Set("list", "a"))
+		for i := 0; i < 10; i++ {
+			// distinct keys force flushes between the operands
+			assert.Nil(db.Set("key"+strconv.Itoa(i), "v"))
+			assert.Nil(db.Merge("list", strconv.Itoa(i)))
+		}
+		assert.True(len(db.segments) > 0, strategy.String())
+		val, err := db.Get("list")
+		assert.Nil(err)
+		assert.Equal(val, "a,0,1,2,3,4,5,6,7,8,9", strategy.String())
+
+		it, err := db.NewIterator()
+		assert.Nil(err)
+		found := false
+		for it.Next() {
+			if it.Key() == "list" {
+				found = true
+				assert.Equal(it.Value(), "a,0,1,2,3,4,5,6,7,8,9")
+			}
+		}
+		assert.Nil(it.Err())
+		assert.Nil(it.Close())
+		assert.True(found)
+		assert.Nil(db.Close())
+		cleanup()
+	}
+}
+
+func TestMergedValueExpiresWithItsBase(t *testing.T) {
+	assert := assert.New(t)
+	for _, flushed := range []bool{false, true} {
+		clock := &fakeClock{now: time.Unix(1000, 0)}
+		db, err := Open("db", &Options{FS: NewMemFS(), Clock: clock, MergeOperator: UInt64AddOperator{}})
+		assert.Nil(err)
+		assert.Nil(db.SetWithTTL("c", "1", time.Hour))
+		if flushed {
+			assert.Nil(db.flush())
+		}
+		assert.Nil(db.Merge("c", "2"))
+		val, err := db.Get("c")
+		assert.Nil(err)
+		assert.Equal(val, "3")
+		assert.Nil(db.flush())
+		val, err = db.Get("c")
+		assert.Nil(err)
+		assert.Equal(val, "3")
+
+		clock.Advance(2 * time.Hour)
+		_, err = db.Get("c")
+		assert.Equal(err, ErrNotFound, "flushed %v", flushed)
+		assert.Nil(db.Close())
+	}
+}
+
+func TestCompactionHandsMergeOperandsTheirBase(t *testing.T) {
+	assert := assert.New(t)
+	for _, strategy := range []CompactionStrategy{CompactionDeleteKeys, CompactionMergeSegments} {
+		db, err := Open("db", &Options{FS: NewMemFS(), CompactionStrategy: strategy,
+			MergeOperator: UInt64AddOperator{}})
+		assert.Nil(err)
+		assert.Nil(db.Set("c", "1"))
+		assert.Nil(db.Set("other", "v"))
+		assert.Nil(db.flush())
+		assert.Nil(db.Merge("c", "2"))
+		assert.Nil(db.Merge("absent", "5"))
+
+		// the flush reads no key, the rewrite of the segment gives the base
+		reads := db.Stats().SegmentReads
+		assert.Nil(db.flush())
+		assert.Equal(db.Stats().SegmentReads, reads, strategy.String())
+		for key, want := range map[string]string{"c": "3", "absent": "5", "other": "v"} {
+			val, err := db.Get(key)
+			assert.Nil(err)
+			assert.Equal(val, want, strategy.String())
+		}
+		assert.Nil(db.Close())
+	}
+}
+
+func TestMergeOperandsSurviveRestart(t *testing.T) {
+	assert := assert.New(t)
+	opts := &Options{MergeOperator: StringAppendOperator{Delimiter: ";"}}
+	db, err := Open(testBasePath, opts)
+	defer cleanup()
+	assert.Nil(err)
+	assert.Nil(db.Merge("list", "x,y"))
+	assert.Nil(db.Merge("list", "z"))
+	assert.Nil(db.Close())
+
+	_, err = Open(testBasePath, nil)
+	assert.True(errors.Is(err, ErrNoMergeOperator))
+
+	db, err = Open(testBasePath, opts)
+	assert.Nil(err)
+	val, err := db.Get("list")
+	assert.Nil(err)
+	assert.Equal(val, "x,y;z")
+	assert.Nil(db.Close())
+}
+
+func TestMergeOperandsAreNotReappliedAfterCrashBeforeWalReset(t *testing.T) {
+	assert := assert.New(t)
+	fs := NewFaultFS()
+	opts := &Options{MergeOperator: UInt64AddOperator{}, SyncWrites: true, FS: fs}
+	db, err := Open("db", opts)
+	assert.Nil(err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(db.Merge("c", "1"))
+	}
+	// the segment and the metadata are written, the WAL is not cleared yet
+	assert.Nil(db.flushMemtable())
+	fs.Crash()
+
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	val, err := db.Get("c")
+	assert.Nil(err)
+	assert.Equal(val, "3")
+	assert.Nil(db.Merge("c", "1"))
+	assert.Nil(db.Close())
+
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	val, err = db.Get("c")
+	assert.Nil(err)
+	assert.Equal(val, "4")
+	assert.Nil(db.Close())
+}
+
+func TestUInt64AddOperator(t *testing.T) {
+	assert := assert.New(t)
+	op := UInt64AddOperator{}
+	existing := "40"
+	val, err := op.FullMerge("k", &existing, []string{"1", "1"})
+	assert.Nil(err)
+	assert.Equal(val, "42")
+	val, err = op.FullMerge("k", nil, []string{"7"})
+	assert.Nil(err)
+	assert.Equal(val, "7")
+	_, err = op.FullMerge("k", nil, []string{"-1"})
+	assert.NotNil(err)
+
+	merged, ok := op.PartialMerge("k", "1", "2")
+	assert.True(ok)
+	assert.Equal(merged, "3")
+	_, ok = op.PartialMerge("k", "1", "x")
+	assert.False(ok)
+}
+
+type countingOperator struct {
+	UInt64AddOperator
+	fullMerges int
+}
+
+func (o *countingOperator) FullMerge(key string, existing *string, operands []string) (string, error) {
+	o.fullMerges++
+	return o.UInt64AddOperator.FullMerge(key, existing, operands)
+}
+
+func TestHasNeitherMergesNorDecodesValues(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	op := &countingOperator{}
+	db, err := Open("db", &Options{FS: NewMemFS(), Clock: clock, MergeOperator: op})
+	assert.Nil(err)
+	assert.Nil(db.SetWithTTL("expiring", "1", time.Minute))
+	assert.Nil(db.Set("c", "1"))
+	assert.Nil(db.flush())
+	assert.Nil(db.Merge("c", "2"))
+	assert.Nil(db.Merge("absent", "2"))
+	merges := op.fullMerges
+
+	for key, want := range map[string]bool{"expiring": true, "c": true, "absent": true, "missing": false} {
+		has, err := db.Has(key)
+		assert.Nil(err)
+		assert.Equal(has, want, key)
+	}
+	assert.Equal(op.fullMerges, merges)
+	clock.Advance(time.Hour)
+	has, err := db.Has("expiring")
+	assert.Nil(err)
+	assert.False(has)
+	assert.Nil(db.Close())
+}
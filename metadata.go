@@ -6,6 +6,8 @@ import (
 	jsoniter "github.com/json-iterator/go"
 )
 
+const metadataFilename = "database_metadata"
+
 type bloomMetadata struct {
 	FalsePositivePob        float64
 	BitArraySize, HashCount int
@@ -15,10 +17,33 @@ type bloomMetadata struct {
 
 // treeMetadata 元数据
 type treeMetadata struct {
-	Segments       []string
-	CurrentSegment string
+	Segments []string
+	// CurrentSegment named the next segment before segments were numbered
+	CurrentSegment string `json:",omitempty"`
+	// NextFileNumber numbers the next segment, 0 for trees written before
+	// segments were numbered
+	NextFileNumber uint64 `json:",omitempty"`
 	Index          map[string]*indexItem
 	BloomFilter    string
+	// Comparator name of the key ordering, empty for trees written before
+	// comparators were configurable, which are bytewise
+	Comparator string
+	// FlushedSequence sequence number of the last WAL record held by the
+	// segments, replaying the WAL skips the records up to it
+	FlushedSequence uint64 `json:",omitempty"`
+	// SegmentTombstones range tombstones written at the head of the
+	// segments, kept here so that opening the tree reads no segment
+	SegmentTombstones map[string][]rangeTombstone `json:",omitempty"`
+	// SegmentKeys number of records of the segments, estimating the number
+	// of keys of the tree without reading them
+	SegmentKeys map[string]int `json:",omitempty"`
+	// ObsoleteSegments segments replaced by a compaction and not removed
+	// yet, opening the tree removes them
+	ObsoleteSegments []string `json:",omitempty"`
+	// ColumnFamilies families other than the default one, which lives in
+	// the tree directory
+	ColumnFamilies     []*columnFamilyMetadata `json:",omitempty"`
+	NextColumnFamilyID uint32                  `json:",omitempty"`
 }
 
 func (m *treeMetadata) load(bytes []byte) error {
@@ -0,0 +1,244 @@
+package simplekv
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricsPrefix prefixes the names of the metrics of a tree.
+const metricsPrefix = "simplekv_"
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// MetricsHandler http.Handler serving the Stats of a tree, and the sizes of
+// its column families, in the Prometheus text exposition format.
+type MetricsHandler struct {
+	tree   *Tree
+	labels string
+}
+
+// NewMetricsHandler returns a MetricsHandler of t adding labels to every
+// metric, e.g. to tell the trees of a process apart.
+func NewMetricsHandler(t *Tree, labels map[string]string) (*MetricsHandler, error) {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") ||
+			name == "cf" || name == "le" {
+			return nil, fmt.Errorf("invalid metric label name: %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabelValue(labels[name]) + `"`
+	}
+	return &MetricsHandler{tree: t.root(), labels: strings.Join(pairs, ",")}, nil
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := h.WriteMetrics(w); err != nil {
+		h.tree.opts.Logger.Error("write metrics", "err", err)
+	}
+}
+
+// WriteMetrics writes the metrics to w.
+func (h *MetricsHandler) WriteMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	m := &metricsWriter{w: bw, labels: h.labels}
+	stats := h.tree.Stats()
+	m.counter("gets_total", "Point lookups.", stats.Gets)
+	m.counter("sets_total", "Records written.", stats.Sets)
+	m.counter("memtable_hits_total", "Lookups answered by a memtable.", stats.MemtableHits)
+	m.counter("bloom_useful_total", "Lookups the bloom filter kept from reading the segments.", stats.BloomUseful)
+	m.counter("bloom_false_positives_total", "Lookups that read the segments for a key they don't hold.",
+		stats.BloomFalsePositives)
+	m.counter("segment_reads_total", "Segment lookups.", stats.SegmentReads)
+	m.counter("flushes_total", "Memtable flushes.", stats.Flushes)
+	m.counter("flush_bytes_total", "Bytes of the segments written by flushes.", stats.FlushBytes)
+	m.counter("compactions_total", "Compactions.", stats.Compactions)
+	m.counter("compaction_bytes_total", "Bytes of the segments written by compactions.", stats.CompactionBytes)
+	m.histogram("read_latency_seconds", "Latency of the point lookups.", stats.ReadLatency)
+	m.histogram("write_latency_seconds", "Latency of the writes.", stats.WriteLatency)
+
+	h.tree.mu.RLock()
+	families := h.tree.familyTrees()
+	names := make([]string, len(families))
+	segments := make([]float64, len(families))
+	segmentBytes := make([]float64, len(families))
+	memtableBytes := make([]float64, len(families))
+	for i, tree := range families {
+		names[i] = tree.columnFamilyName()
+		segments[i] = float64(len(tree.segments))
+		segmentBytes[i] = float64(tree.segmentsSize(tree.segments))
+		memtableBytes[i] = float64(tree.memtable.GetTotalSize())
+	}
+	h.tree.mu.RUnlock()
+
+	m.gauge("segments", "Segments of a column family.", names, segments)
+	m.gauge("segment_bytes", "Bytes of the segments of a column family.", names, segmentBytes)
+	m.gauge("memtable_bytes", "Size of the keys and values of the memtable of a column family.",
+		names, memtableBytes)
+	if m.err != nil {
+		return m.err
+	}
+	return bw.Flush()
+}
+
+// metricsWriter writes metrics in the text exposition format, the first
+// error is kept and stops the writes.
+type metricsWriter struct {
+	w      io.Writer
+	labels string
+	err    error
+}
+
+func (m *metricsWriter) printf(format string, args ...any) {
+	if m.err == nil {
+		_, m.err = fmt.Fprintf(m.w, format, args...)
+	}
+}
+
+func (m *metricsWriter) header(name, help, kind string) {
+	m.printf("# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, kind)
+}
+
+// sample writes a sample of name, extra labels come before the labels of
+// the handler.
+func (m *metricsWriter) sample(name, extra string, value float64) {
+	labels := extra
+	if labels != "" && m.labels != "" {
+		labels += ","
+	}
+	labels += m.labels
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	m.printf("%s%s%s %s\n", metricsPrefix, name, labels, formatMetricValue(value))
+}
+
+func (m *metricsWriter) counter(name, help string, value int64) {
+	m.header(name, help, "counter")
+	m.sample(name, "", float64(value))
+}
+
+func (m *metricsWriter) gauge(name, help string, families []string, values []float64) {
+	m.header(name, help, "gauge")
+	for i, family := range families {
+		m.sample(name, `cf="`+escapeLabelValue(family)+`"`, values[i])
+	}
+}
+
+func (m *metricsWriter) histogram(name, help string, h Histogram) {
+	m.header(name, help, "histogram")
+	var count int64
+	for _, bucket := range h.Buckets {
+		count += bucket.Count
+		le := "+Inf"
+		if bucket.UpperBound != math.MaxInt64 {
+			le = formatMetricValue(bucket.UpperBound.Seconds())
+		}
+		m.sample(name+"_bucket", `le="`+le+`"`, float64(count))
+	}
+	m.sample(name+"_sum", "", h.Sum.Seconds())
+	m.sample(name+"_count", "", float64(h.Count))
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// ErrExpvarPublished is returned when the expvar name is already taken, by
+// an open tree or by another variable.
+var ErrExpvarPublished = errors.New("expvar already published")
+
+var (
+	// expvarMu guards expvarTrees and the expvarNames of the trees
+	expvarMu sync.Mutex
+	// expvarTrees trees published by name, nil once closed: expvar can't
+	// unpublish a name, a tree opened again is bound to it instead
+	expvarTrees = map[string]*Tree{}
+)
+
+// PublishExpvar publishes the Stats of t, and the properties of its column
+// families, as the expvar name, served by the /debug/vars handler of expvar.
+// Closing t publishes null under name, until a tree publishes it again.
+func (t *Tree) PublishExpvar(name string) error {
+	root := t.root()
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	tree, ok := expvarTrees[name]
+	if tree != nil || (!ok && expvar.Get(name) != nil) {
+		return fmt.Errorf("%w: %s", ErrExpvarPublished, name)
+	}
+	expvarTrees[name] = root
+	root.expvarNames = append(root.expvarNames, name)
+	if !ok {
+		expvar.Publish(name, expvar.Func(func() any {
+			expvarMu.Lock()
+			tree := expvarTrees[name]
+			expvarMu.Unlock()
+			if tree == nil {
+				return nil
+			}
+			return tree.expvarValue()
+		}))
+	}
+	return nil
+}
+
+// unpublishExpvar unbinds t from the expvar names it published.
+func (t *Tree) unpublishExpvar() {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	for _, name := range t.expvarNames {
+		if expvarTrees[name] == t {
+			expvarTrees[name] = nil
+		}
+	}
+	t.expvarNames = nil
+}
+
+// expvarProperties are the properties published for every column family.
+var expvarProperties = []string{PropertyNumSegments, PropertyMemtableSize, PropertyMemtableKeys,
+	PropertyTotalSegmentBytes}
+
+func (t *Tree) expvarValue() map[string]any {
+	t.mu.RLock()
+	trees := t.familyTrees()
+	names := make([]string, len(trees))
+	for i, tree := range trees {
+		names[i] = tree.columnFamilyName()
+	}
+	t.mu.RUnlock()
+
+	families := map[string]map[string]string{}
+	for i, tree := range trees {
+		properties := map[string]string{}
+		for _, name := range expvarProperties {
+			if value, ok := tree.GetProperty(name); ok {
+				properties[name] = value
+			}
+		}
+		families[names[i]] = properties
+	}
+	return map[string]any{
+		"stats":           t.Stats(),
+		"column_families": families,
+	}
+}
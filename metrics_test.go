@@ -0,0 +1,134 @@
+package simplekv
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	db, err := Open("db", &Options{MemtableSize: 100, SparsityFactor: 2, FS: NewMemFS()})
+	assert.Nil(err)
+	cf, err := db.CreateColumnFamily("users", nil)
+	assert.Nil(err)
+	for i := 0; i < 30; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+	}
+	assert.Nil(cf.Set("key", "value"))
+	_, err = db.Get("key1")
+	assert.Nil(err)
+
+	_, err = NewMetricsHandler(db, map[string]string{"0db": "x"})
+	assert.NotNil(err)
+	_, err = NewMetricsHandler(db, map[string]string{"cf": "x"})
+	assert.NotNil(err)
+	handler, err := NewMetricsHandler(cf.tree, map[string]string{"instance": "db\"1\"", "app": "test"})
+	assert.Nil(err)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	resp := recorder.Result()
+	assert.Equal(resp.StatusCode, 200)
+	assert.True(strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4"))
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(err)
+	lines := strings.Split(string(body), "\n")
+
+	has := func(line string) bool {
+		for _, l := range lines {
+			if l == line {
+				return true
+			}
+		}
+		return false
+	}
+	labels := `app="test",instance="db\"1\""`
+	assert.True(has("# TYPE simplekv_sets_total counter"))
+	assert.True(has("simplekv_sets_total{"+labels+"} 31"), string(body))
+	assert.True(has("simplekv_gets_total{" + labels + "} 1"))
+	assert.True(has("# TYPE simplekv_read_latency_seconds histogram"))
+	assert.True(has(`simplekv_read_latency_seconds_bucket{le="+Inf",` + labels + "} 1"))
+	assert.True(has("simplekv_write_latency_seconds_count{" + labels + "} 31"))
+	assert.True(has(`simplekv_segments{cf="default",` + labels + "} " + strconv.Itoa(len(db.segments))))
+	assert.True(has(`simplekv_segments{cf="users",` + labels + "} 0"))
+	assert.True(has(`simplekv_memtable_bytes{cf="users",` + labels + "} 8"))
+
+	// every sample is a name, optional labels and a number
+	for _, line := range lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		value := line[strings.LastIndex(line, " ")+1:]
+		_, err := strconv.ParseFloat(value, 64)
+		assert.Nil(err, line)
+		assert.True(strings.HasPrefix(line, "simplekv_"), line)
+	}
+	assert.Nil(db.Close())
+}
+
+func TestPublishExpvar(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	db, err := Open("db", &Options{FS: NewMemFS()})
+	assert.Nil(err)
+	assert.Nil(db.Set("key", "value"))
+	assert.Nil(db.PublishExpvar("simplekv_test"))
+	assert.True(errors.Is(db.PublishExpvar("simplekv_test"), ErrExpvarPublished))
+
+	var value struct {
+		Stats          Stats
+		ColumnFamilies map[string]map[string]string `json:"column_families"`
+	}
+	assert.Nil(json.Unmarshal([]byte(expvar.Get("simplekv_test").String()), &value))
+	assert.Equal(value.Stats.Sets, int64(1))
+	assert.Equal(value.ColumnFamilies[DefaultColumnFamilyName][PropertyMemtableKeys], "1")
+	assert.Nil(db.Close())
+	assert.Equal(expvar.Get("simplekv_test").String(), "null")
+
+	// the name is bound to the tree opened again
+	db, err = Open("db", &Options{FS: db.opts.FS})
+	assert.Nil(err)
+	assert.Nil(db.PublishExpvar("simplekv_test"))
+	assert.True(errors.Is(db.PublishExpvar("simplekv_test"), ErrExpvarPublished))
+	assert.Nil(json.Unmarshal([]byte(expvar.Get("simplekv_test").String()), &value))
+	assert.Equal(value.Stats.Sets, int64(0))
+	assert.Nil(db.Close())
+
+	expvar.NewInt("simplekv_test_taken")
+	db, err = Open("db", &Options{FS: db.opts.FS})
+	assert.Nil(err)
+	assert.True(errors.Is(db.PublishExpvar("simplekv_test_taken"), ErrExpvarPublished))
+	assert.Nil(db.Close())
+}
+
+func TestPublishExpvarConcurrently(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	db, err := Open("db", &Options{FS: NewMemFS()})
+	assert.Nil(err)
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			errs <- db.PublishExpvar("simplekv_test_concurrent")
+		}()
+	}
+	published := 0
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err == nil {
+			published++
+		} else {
+			assert.True(errors.Is(err, ErrExpvarPublished))
+		}
+	}
+	assert.Equal(published, 1)
+	assert.Nil(db.Close())
+}
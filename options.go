@@ -0,0 +1,314 @@
+package simplekv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// ErrInvalidOptions is returned by Open when the options fail validation.
+var ErrInvalidOptions = errors.New("invalid options")
+
+const (
+	defaultMemtableSize            = 1000000
+	defaultSparsityFactor          = 100
+	defaultBloomFilterNumItems     = 100
+	defaultBloomFilterFalsePosProb = 0.2
+	defaultCacheSize               = 8 << 20
+	defaultBlockSize               = 4 << 10
+	defaultSegmentBasename         = "segment-1"
+	defaultWalBasename             = "wal"
+	defaultKeepLogFileNum          = 1000
+	defaultSlowOperationThreshold  = time.Second
+
+	optionsFilename = "OPTIONS"
+)
+
+// CompactionStrategy decides how older segments are rewritten when the
+// memtable is flushed.
+type CompactionStrategy int
+
+const (
+	// CompactionDeleteKeys removes the keys held by the memtable from every
+	// older segment before the memtable is flushed, so each key lives in
+	// exactly one segment.
+	CompactionDeleteKeys CompactionStrategy = iota
+	// CompactionMergeSegments flushes the memtable to a new segment and then
+	// merges all segments into one, newer values winning.
+	CompactionMergeSegments
+)
+
+var compactionStrategyNames = map[CompactionStrategy]string{
+	CompactionDeleteKeys:    "delete-keys",
+	CompactionMergeSegments: "merge-segments",
+}
+
+func (s CompactionStrategy) String() string {
+	if name, ok := compactionStrategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("CompactionStrategy(%d)", int(s))
+}
+
+// MarshalText persists the strategy by name in the OPTIONS file.
+func (s CompactionStrategy) MarshalText() ([]byte, error) {
+	if _, ok := compactionStrategyNames[s]; !ok {
+		return nil, fmt.Errorf("unknown compaction strategy: %d", int(s))
+	}
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText parses a strategy name written by MarshalText.
+func (s *CompactionStrategy) UnmarshalText(text []byte) error {
+	for strategy, name := range compactionStrategyNames {
+		if name == string(text) {
+			*s = strategy
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown compaction strategy: %s", text)
+}
+
+// Logger receives engine diagnostics, *slog.Logger satisfies it.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Options tunes a Tree, zero fields are replaced by their defaults in Open.
+type Options struct {
+	// SegmentBasename named the first segment of the trees written before
+	// segments were numbered, it must look like name-N. Segments are now
+	// named from their file number, e.g. 000123.sst.
+	SegmentBasename string
+	// WalBasename names the memtable write ahead log.
+	WalBasename string
+	// MemtableSize is the number of key and value bytes the memtable holds
+	// before it is flushed to a segment.
+	MemtableSize int
+	// SparsityFactor keeps one sparse index entry every
+	// MemtableSize/SparsityFactor keys of a segment.
+	SparsityFactor int
+	// BloomFilterNumItems is the expected number of keys in the bloom filter.
+	BloomFilterNumItems int
+	// BloomFilterFalsePosProb is the target false positive probability.
+	BloomFilterFalsePosProb float64
+	// BloomFilterBitsPerKey, when set, sizes the bloom filter by bits per key
+	// and overrides BloomFilterFalsePosProb.
+	BloomFilterBitsPerKey int
+	// SyncWrites fsyncs the write ahead log after every write.
+	SyncWrites bool
+	// CompactionStrategy decides how segments are compacted on flush.
+	CompactionStrategy CompactionStrategy
+	// CompactionFilter drops or rewrites records while compacting.
+	CompactionFilter CompactionFilter `json:"-"`
+	// Comparator orders the keys, it can't change once the tree is written.
+	Comparator Comparator `json:"-"`
+	// MergeOperator combines the operands written by Tree.Merge.
+	MergeOperator MergeOperator `json:"-"`
+	// ColumnFamilyOptions tunes the column families reopened by name, the
+	// others reuse their OPTIONS file.
+	ColumnFamilyOptions map[string]*Options `json:"-"`
+	// CacheSize is the number of bytes of segment files kept in memory.
+	CacheSize int
+	// Compression names the codec segments are compressed with, "none"
+	// keeps them as plain lines. Changing it only affects new segments.
+	Compression string
+	// BlockSize is the number of bytes of lines compressed together.
+	BlockSize int
+	// DisableInfoLog stops writing the info level diagnostics to the LOG
+	// file of the tree directory, Logger still receives them.
+	DisableInfoLog bool
+	// MaxLogFileSize is the size past which the LOG file is rotated, 0
+	// only rotates it on open.
+	MaxLogFileSize int64
+	// KeepLogFileNum is the number of rotated LOG files kept.
+	KeepLogFileNum int
+	// SlowOperationThreshold is the duration past which reads, writes and
+	// flushes are logged as slow, a negative one disables the warnings.
+	SlowOperationThreshold time.Duration
+	// KeyProvider, when set, encrypts the segments, the WAL and the
+	// metadata with AES-GCM. Encrypted files can't be read without it.
+	KeyProvider KeyProvider `json:"-"`
+	// AllowPlaintextMigration lets a tree with a KeyProvider read the plain
+	// metadata and WAL of a tree written without one, so that it can be
+	// encrypted. They are rejected otherwise, with ErrNotEncrypted.
+	AllowPlaintextMigration bool `json:"-"`
+	// Logger receives engine diagnostics, by default they only go to the
+	// LOG file.
+	Logger Logger `json:"-"`
+	// Clock tells the time keys written with a TTL expire against.
+	Clock Clock `json:"-"`
+	// FS is the file system the tree is stored in, OSFS by default.
+	FS FS `json:"-"`
+	// EventListeners are notified of flushes, compactions, write stalls and
+	// background errors.
+	EventListeners []EventListener `json:"-"`
+}
+
+// DefaultOptions returns the options NewTree has always used.
+func DefaultOptions() *Options {
+	return &Options{
+		SegmentBasename:         defaultSegmentBasename,
+		WalBasename:             defaultWalBasename,
+		MemtableSize:            defaultMemtableSize,
+		SparsityFactor:          defaultSparsityFactor,
+		BloomFilterNumItems:     defaultBloomFilterNumItems,
+		BloomFilterFalsePosProb: defaultBloomFilterFalsePosProb,
+		CompactionStrategy:      CompactionDeleteKeys,
+		CacheSize:               defaultCacheSize,
+		Compression:             noneCodec{}.Name(),
+		BlockSize:               defaultBlockSize,
+		KeepLogFileNum:          defaultKeepLogFileNum,
+		SlowOperationThreshold:  defaultSlowOperationThreshold,
+		Logger:                  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Clock:                   systemClock{},
+		Comparator:              BytewiseComparator{},
+		FS:                      OSFS,
+	}
+}
+
+// withDefaults returns a copy of o with every zero field set to its default.
+func (o *Options) withDefaults() *Options {
+	def := DefaultOptions()
+	if o == nil {
+		return def
+	}
+	opts := *o
+	if opts.SegmentBasename == "" {
+		opts.SegmentBasename = def.SegmentBasename
+	}
+	if opts.WalBasename == "" {
+		opts.WalBasename = def.WalBasename
+	}
+	if opts.MemtableSize == 0 {
+		opts.MemtableSize = def.MemtableSize
+	}
+	if opts.SparsityFactor == 0 {
+		opts.SparsityFactor = def.SparsityFactor
+	}
+	if opts.BloomFilterNumItems == 0 {
+		opts.BloomFilterNumItems = def.BloomFilterNumItems
+	}
+	if opts.BloomFilterFalsePosProb == 0 {
+		opts.BloomFilterFalsePosProb = def.BloomFilterFalsePosProb
+	}
+	if opts.CacheSize == 0 {
+		opts.CacheSize = def.CacheSize
+	}
+	if opts.Compression == "" {
+		opts.Compression = def.Compression
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = def.BlockSize
+	}
+	if opts.KeepLogFileNum == 0 {
+		opts.KeepLogFileNum = def.KeepLogFileNum
+	}
+	if opts.SlowOperationThreshold == 0 {
+		opts.SlowOperationThreshold = def.SlowOperationThreshold
+	}
+	if opts.Logger == nil {
+		opts.Logger = def.Logger
+	}
+	if opts.Clock == nil {
+		opts.Clock = def.Clock
+	}
+	if opts.Comparator == nil {
+		opts.Comparator = def.Comparator
+	}
+	if opts.FS == nil {
+		opts.FS = def.FS
+	}
+	return &opts
+}
+
+func (o *Options) validate() error {
+	if _, _, ok := parseLegacySegmentName(o.SegmentBasename); !ok {
+		return fmt.Errorf("%w: segment basename %q must look like name-N", ErrInvalidOptions, o.SegmentBasename)
+	}
+	if err := validateBasename("segment basename", o.SegmentBasename); err != nil {
+		return err
+	}
+	if err := validateBasename("wal basename", o.WalBasename); err != nil {
+		return err
+	}
+	if o.MemtableSize <= 0 {
+		return fmt.Errorf("%w: memtable size must be positive", ErrInvalidOptions)
+	}
+	if o.SparsityFactor <= 0 {
+		return fmt.Errorf("%w: sparsity factor must be positive", ErrInvalidOptions)
+	}
+	if o.BloomFilterNumItems <= 0 {
+		return fmt.Errorf("%w: bloom filter items must be positive", ErrInvalidOptions)
+	}
+	if o.BloomFilterFalsePosProb <= 0 || o.BloomFilterFalsePosProb >= 1 {
+		return fmt.Errorf("%w: bloom filter false positive probability must be in (0, 1)", ErrInvalidOptions)
+	}
+	if o.BloomFilterBitsPerKey < 0 {
+		return fmt.Errorf("%w: bloom filter bits per key must not be negative", ErrInvalidOptions)
+	}
+	if _, ok := compactionStrategyNames[o.CompactionStrategy]; !ok {
+		return fmt.Errorf("%w: unknown compaction strategy %d", ErrInvalidOptions, o.CompactionStrategy)
+	}
+	if o.CacheSize < 0 {
+		return fmt.Errorf("%w: cache size must not be negative", ErrInvalidOptions)
+	}
+	if _, _, err := codecByName(o.Compression); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidOptions, err)
+	}
+	if o.BlockSize <= 0 {
+		return fmt.Errorf("%w: block size must be positive", ErrInvalidOptions)
+	}
+	if o.MaxLogFileSize < 0 {
+		return fmt.Errorf("%w: max log file size must not be negative", ErrInvalidOptions)
+	}
+	if o.KeepLogFileNum < 0 {
+		return fmt.Errorf("%w: kept log files must not be negative", ErrInvalidOptions)
+	}
+	return nil
+}
+
+// bloomFalsePosProb returns the false positive probability the bloom filter
+// is built with, derived from BloomFilterBitsPerKey when it is set.
+func (o *Options) bloomFalsePosProb() float64 {
+	if o.BloomFilterBitsPerKey > 0 {
+		// p = e^(-(m/n) * lg(2)^2)
+		return math.Exp(-float64(o.BloomFilterBitsPerKey) * math.Pow(math.Log(2), 2))
+	}
+	return o.BloomFilterFalsePosProb
+}
+
+// save writes the options in effect to path of fs.
+func (o *Options) save(fs FS, path string) error {
+	bytes, err := jsoniter.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json marshal err: %s", err)
+	}
+	err = writeFileAtomically(fs, path, bytes)
+	if err != nil {
+		return fmt.Errorf("write options file err: %s", err)
+	}
+	return nil
+}
+
+// loadOptions reads an OPTIONS file written by Options.save.
+func loadOptions(fs FS, path string) (*Options, error) {
+	bytes, err := readFile(fs, path)
+	if err != nil {
+		return nil, fmt.Errorf("read options file err: %s", err)
+	}
+	opts := &Options{}
+	err = jsoniter.Unmarshal(bytes, opts)
+	if err != nil {
+		return nil, fmt.Errorf("json unmarshal err: %s", err)
+	}
+	return opts, nil
+}
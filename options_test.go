@@ -0,0 +1,114 @@
+package simplekv
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAppliesDefaults(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, &Options{MemtableSize: 20})
+	defer cleanup()
+	assert.Nil(err)
+
+	assert.Equal(db.threshold, 20)
+	assert.Equal(db.sparsityFactor, defaultSparsityFactor)
+	assert.Equal(db.nextFileNumber, uint64(1))
+	assert.Equal(db.walBasename, defaultWalBasename)
+	assert.Equal(db.bloomFilter.numItems, defaultBloomFilterNumItems)
+}
+
+func TestSparsityFactorAboveMemtableSizeStillIndexes(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, &Options{MemtableSize: 20})
+	defer cleanup()
+	assert.Nil(err)
+
+	assert.Equal(db.sparsity(), 1)
+	for i := 0; i < 5; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "v"))
+	}
+	assert.Nil(db.flush())
+	assert.False(db.index.Empty())
+	val, err := db.Get("key3")
+	assert.Nil(err)
+	assert.Equal(val, "v")
+	assert.Nil(db.Close())
+}
+
+func TestOpenRejectsInvalidOptions(t *testing.T) {
+	assert := assert.New(t)
+	defer cleanup()
+
+	invalid := []*Options{
+		{MemtableSize: -1},
+		{SparsityFactor: -5},
+		{BloomFilterFalsePosProb: 1.5},
+		{BloomFilterBitsPerKey: -1},
+		{CompactionStrategy: CompactionStrategy(42)},
+		{CacheSize: -1},
+		{SegmentBasename: "segment"},
+		{SegmentBasename: "dir/segment-1"},
+		{WalBasename: "LOCK"},
+		{WalBasename: "a/wal"},
+		{WalBasename: "000001.sst"},
+		{WalBasename: "wal.tmp"},
+	}
+	for _, opts := range invalid {
+		_, err := Open(testBasePath, opts)
+		assert.True(errors.Is(err, ErrInvalidOptions), "%+v", opts)
+	}
+}
+
+func TestOpenPersistsOptions(t *testing.T) {
+	assert := assert.New(t)
+	_, err := Open(testBasePath, &Options{
+		MemtableSize:       4096,
+		SyncWrites:         true,
+		CompactionStrategy: CompactionMergeSegments,
+	})
+	defer cleanup()
+	assert.Nil(err)
+
+	opts, err := loadOptions(OSFS, testBasePath+optionsFilename)
+	assert.Nil(err)
+	assert.Equal(opts.MemtableSize, 4096)
+	assert.True(opts.SyncWrites)
+	assert.Equal(opts.CompactionStrategy, CompactionMergeSegments)
+	assert.Equal(opts.WalBasename, defaultWalBasename)
+}
+
+func TestBloomFilterBitsPerKeyOverridesProbability(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, &Options{BloomFilterBitsPerKey: 10})
+	defer cleanup()
+	assert.Nil(err)
+
+	assert.InDelta(db.bloomFilter.falsePositivePob, 0.0082, 0.0001)
+}
+
+func TestMergeSegmentsStrategyKeepsOneSegment(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, &Options{
+		MemtableSize:       20,
+		SparsityFactor:     5,
+		CompactionStrategy: CompactionMergeSegments,
+	})
+	defer cleanup()
+	assert.Nil(err)
+
+	for i := 0; i < 100; i++ {
+		err = db.Set(strconv.Itoa(i%25), strconv.Itoa(i))
+		assert.Nil(err)
+	}
+
+	assert.Equal(len(db.segments), 1)
+	for i := 75; i < 100; i++ {
+		val, err := db.Get(strconv.Itoa(i % 25))
+		assert.Nil(err)
+		assert.Equal(val, strconv.Itoa(i))
+	}
+}
@@ -0,0 +1,65 @@
+package simplekv
+
+import (
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func snapshotDir(t *testing.T, dir string) map[string]string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{}
+	for _, file := range files {
+		bytes, err := ioutil.ReadFile(dir + file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[file.Name()] = string(bytes)
+	}
+	return contents
+}
+
+func TestOpenReadOnlyReadsWithoutWriting(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, &Options{MemtableSize: 20})
+	defer cleanup()
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		err = db.Set("key"+strconv.Itoa(i), strconv.Itoa(i))
+		assert.Nil(err)
+	}
+	err = db.saveMetadata()
+	assert.Nil(err)
+	before := snapshotDir(t, testBasePath)
+
+	// the writer keeps the directory locked
+	ro, err := OpenReadOnly(testBasePath, &Options{MemtableSize: 20})
+	assert.Nil(err)
+	for i := 0; i < 10; i++ {
+		val, err := ro.Get("key" + strconv.Itoa(i))
+		assert.Nil(err)
+		assert.Equal(val, strconv.Itoa(i))
+	}
+
+	err = ro.Set("key0", "changed")
+	assert.True(errors.Is(err, ErrReadOnly))
+	err = ro.Close()
+	assert.Nil(err)
+
+	assert.Equal(snapshotDir(t, testBasePath), before)
+	err = db.Close()
+	assert.Nil(err)
+}
+
+func TestOpenReadOnlyRequiresExistingDirectory(t *testing.T) {
+	assert := assert.New(t)
+	_, err := OpenReadOnly(testBasePath+"missing/", nil)
+	assert.NotNil(err)
+	assert.False(exists(testBasePath + "missing/"))
+}
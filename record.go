@@ -0,0 +1,334 @@
+package simplekv
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// record one line of the WAL or of a segment file:
+//
+//	key,value[,attributes]
+//
+// key and value are written as is, unless one of them holds ',', '\r' or
+// '\n': both then escape '%', ',', '\r' and '\n' as %XX and the record is
+// marked with f=1, so the lines written before escaping keep their meaning.
+// attributes is a ';' separated list of name=value pairs, only written when
+// the record carries more than a key and a value:
+//   - f=1 key and value are escaped
+//   - e=<unix nanoseconds> the record expires at that time
+//   - k=m the value is a merge operand, see Tree.Merge
+//   - k=d the record deletes key, its value is empty
+//   - k=r the record is a range tombstone deleting the keys from key,
+//     inclusive, to value, exclusive, see Tree.DeleteRange
+//   - c=<id> the record belongs to column family <id>, WAL only
+//   - b=<n> the record belongs to the WriteBatch whose last record has
+//     sequence number n, WAL only
+//   - s=<n> sequence number of the record, WAL only
+type record struct {
+	key      string
+	value    string
+	expireAt int64
+	kind     recordKind
+	cf       uint32
+	batch    uint64
+	seq      uint64
+}
+
+type recordKind int
+
+const (
+	kindValue recordKind = iota
+	kindMerge
+	kindRangeDelete
+	kindDelete
+)
+
+var recordKindNames = map[recordKind]string{
+	kindMerge:       "m",
+	kindRangeDelete: "r",
+	kindDelete:      "d",
+}
+
+// entry memtable value of a key written with a TTL, plain values are kept
+// as strings
+type entry struct {
+	Value    string
+	ExpireAt int64
+}
+
+func (e *entry) size() int {
+	return len(e.Value) + 8
+}
+
+// deletedEntry memtable value of a deleted key, it shadows the key in the
+// segments until the next flush removes it from them
+type deletedEntry struct{}
+
+func (*deletedEntry) size() int {
+	return 0
+}
+
+// Clock tells the time, it is used to expire keys written with a TTL.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// encode returns the line of r, including its trailing newline.
+func (r *record) encode() string {
+	key, value := r.key, r.value
+	var attrs []string
+	if needsEscaping(key) || needsEscaping(value) {
+		key, value = escapeField(key), escapeField(value)
+		attrs = append(attrs, "f=1")
+	}
+	line := key + "," + value
+	if r.expireAt != 0 {
+		attrs = append(attrs, "e="+strconv.FormatInt(r.expireAt, 10))
+	}
+	if r.kind != kindValue {
+		attrs = append(attrs, "k="+recordKindNames[r.kind])
+	}
+	if r.cf != 0 {
+		attrs = append(attrs, "c="+strconv.FormatUint(uint64(r.cf), 10))
+	}
+	if r.batch != 0 {
+		attrs = append(attrs, "b="+strconv.FormatUint(r.batch, 10))
+	}
+	if r.seq != 0 {
+		attrs = append(attrs, "s="+strconv.FormatUint(r.seq, 10))
+	}
+	if len(attrs) > 0 {
+		line += "," + strings.Join(attrs, ";")
+	}
+	return line + "\n"
+}
+
+// expired tells whether r has expired at now.
+func (r *record) expired(now time.Time) bool {
+	return r.expireAt != 0 && r.expireAt <= now.UnixNano()
+}
+
+// memtableValue returns the value the memtable stores for r.
+func (r *record) memtableValue() any {
+	if r.kind == kindDelete {
+		return &deletedEntry{}
+	}
+	if r.expireAt == 0 {
+		return r.value
+	}
+	return &entry{Value: r.value, ExpireAt: r.expireAt}
+}
+
+// decodeRecord parses a line without its trailing newline.
+func decodeRecord(line string) (*record, error) {
+	parts := strings.Split(line, ",")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("record not valid: %s", line)
+	}
+	r := &record{key: parts[0], value: parts[1]}
+	if len(parts) == 2 {
+		return r, nil
+	}
+	for _, attr := range strings.Split(parts[2], ";") {
+		name, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			return nil, fmt.Errorf("record attribute not valid: %s", line)
+		}
+		switch name {
+		case "f":
+			if value != "1" {
+				return nil, fmt.Errorf("record format not valid: %s", line)
+			}
+			r.key, r.value = unescapeField(r.key), unescapeField(r.value)
+		case "e":
+			expireAt, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("record expiry not valid: %s", line)
+			}
+			r.expireAt = expireAt
+		case "k":
+			kind, ok := parseRecordKind(value)
+			if !ok {
+				return nil, fmt.Errorf("record kind not valid: %s", line)
+			}
+			r.kind = kind
+		case "c":
+			cf, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("record column family not valid: %s", line)
+			}
+			r.cf = uint32(cf)
+		case "b":
+			batch, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || batch == 0 {
+				return nil, fmt.Errorf("record batch not valid: %s", line)
+			}
+			r.batch = batch
+		case "s":
+			seq, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || seq == 0 {
+				return nil, fmt.Errorf("record sequence not valid: %s", line)
+			}
+			r.seq = seq
+		default:
+			return nil, fmt.Errorf("unknown record attribute: %s", line)
+		}
+	}
+	return r, nil
+}
+
+func parseRecordKind(name string) (recordKind, bool) {
+	for kind, kindName := range recordKindNames {
+		if kindName == name {
+			return kind, true
+		}
+	}
+	return kindValue, false
+}
+
+// splitLine splits a line without its trailing newline into its fields,
+// still escaped, attrs is nil when the line has none.
+func splitLine(line []byte) (key, value, attrs []byte, err error) {
+	i := bytes.IndexByte(line, ',')
+	if i < 0 {
+		return nil, nil, nil, fmt.Errorf("record not valid: %s", line)
+	}
+	key, value = line[:i], line[i+1:]
+	if j := bytes.IndexByte(value, ','); j >= 0 {
+		value, attrs = value[:j], value[j+1:]
+		if bytes.IndexByte(attrs, ',') >= 0 {
+			return nil, nil, nil, fmt.Errorf("record not valid: %s", line)
+		}
+	}
+	return key, value, attrs, nil
+}
+
+// attrValue returns the value of the attribute name of a line.
+func attrValue(attrs []byte, name string) ([]byte, bool) {
+	for len(attrs) > 0 {
+		a := attrs
+		if i := bytes.IndexByte(attrs, ';'); i >= 0 {
+			a, attrs = attrs[:i], attrs[i+1:]
+		} else {
+			attrs = nil
+		}
+		if len(a) > len(name) && a[len(name)] == '=' && string(a[:len(name)]) == name {
+			return a[len(name)+1:], true
+		}
+	}
+	return nil, false
+}
+
+// hasAttr tells whether the attribute name of a line is set to value.
+func hasAttr(attrs []byte, name, value string) bool {
+	v, ok := attrValue(attrs, name)
+	return ok && string(v) == value
+}
+
+// liveLine tells whether the line of attrs holds a live value at now, its
+// key and value are not decoded.
+func liveLine(attrs []byte, now time.Time) (bool, error) {
+	if hasAttr(attrs, "k", recordKindNames[kindDelete]) {
+		return false, nil
+	}
+	v, ok := attrValue(attrs, "e")
+	if !ok {
+		return true, nil
+	}
+	expireAt, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("record expiry not valid: %s", v)
+	}
+	return expireAt > now.UnixNano(), nil
+}
+
+// compareField compares the field raw of a line, escaped when escaped is
+// set, with s under cmp. It doesn't allocate for unescaped fields under the
+// bytewise comparator.
+func compareField(raw []byte, escaped bool, s string, cmp Comparator) int {
+	field := func() string {
+		if escaped {
+			return unescapeField(string(raw))
+		}
+		return string(raw)
+	}
+	if _, ok := cmp.(BytewiseComparator); !ok {
+		return cmp.Compare(field(), s)
+	}
+	if escaped {
+		return strings.Compare(field(), s)
+	}
+	switch {
+	case string(raw) == s:
+		return 0
+	case string(raw) < s:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// recordFromMemtable builds the record of a memtable key and value.
+func recordFromMemtable(key string, v any) *record {
+	switch v := v.(type) {
+	case *entry:
+		return &record{key: key, value: v.Value, expireAt: v.ExpireAt}
+	case *deletedEntry:
+		return &record{key: key, kind: kindDelete}
+	default:
+		return &record{key: key, value: v.(string)}
+	}
+}
+
+// needsEscaping tells whether s holds bytes that would break the line
+// format.
+func needsEscaping(s string) bool {
+	return strings.ContainsAny(s, ",\r\n")
+}
+
+// escapeField escapes '%' and the bytes of s that would break the line
+// format.
+func escapeField(s string) string {
+	if !strings.ContainsAny(s, "%,\r\n") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '%', ',', '\r', '\n':
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeField reverses escapeField, a '%' not followed by two hex digits
+// is kept as is.
+func unescapeField(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,94 @@
+package simplekv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestRecordEncodeDecode(t *testing.T) {
+	assert := assert.New(t)
+
+	plain := &record{key: "name", value: "pedro"}
+	assert.Equal(plain.encode(), "name,pedro\n")
+	expiring := &record{key: "session", value: "abc", expireAt: 42}
+	assert.Equal(expiring.encode(), "session,abc,e=42\n")
+
+	operand := &record{key: "counter", value: "1", kind: kindMerge}
+	assert.Equal(operand.encode(), "counter,1,k=m\n")
+	escaped := &record{key: "a,b", value: "50%\r\n", expireAt: 42, kind: kindMerge}
+	assert.Equal(escaped.encode(), "a%2Cb,50%25%0D%0A,f=1;e=42;k=m\n")
+	percent := &record{key: "100%", value: "a%2Cb"}
+	assert.Equal(percent.encode(), "100%,a%2Cb\n")
+
+	tombstone := &record{key: "a", value: "b", kind: kindRangeDelete}
+	assert.Equal(tombstone.encode(), "a,b,k=r\n")
+
+	deletion := &record{key: "gone", kind: kindDelete}
+	assert.Equal(deletion.encode(), "gone,,k=d\n")
+
+	batched := &record{key: "a", value: "b", cf: 3, batch: 8, seq: 7}
+	assert.Equal(batched.encode(), "a,b,c=3;b=8;s=7\n")
+
+	for _, rec := range []*record{plain, expiring, operand, escaped, percent, tombstone, deletion, batched} {
+		line := rec.encode()
+		decoded, err := decodeRecord(line[:len(line)-1])
+		assert.Nil(err)
+		assert.Equal(decoded, rec)
+	}
+
+	for _, line := range []string{"novalue", "a,b,c,d", "a,b,e", "a,b,e=x", "a,b,z=1", "a,b,k=x", "a,b,c=x", "a,b,b=0", "a,b,f=2", "a,b,s=0"} {
+		_, err := decodeRecord(line)
+		assert.NotNil(err, line)
+	}
+}
+
+func TestRecordExpired(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(100, 0)
+
+	assert.False((&record{key: "a"}).expired(now))
+	assert.False((&record{key: "a", expireAt: now.Add(time.Second).UnixNano()}).expired(now))
+	assert.True((&record{key: "a", expireAt: now.UnixNano()}).expired(now))
+}
+
+func TestUnescapeFieldKeepsStrayPercent(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(unescapeField("100%"), "100%")
+	assert.Equal(unescapeField("%zz%2C"), "%zz,")
+	assert.Equal(unescapeField(escapeField("%%,,")), "%%,,")
+}
+
+func TestEscapedAndPercentKeysReadFromSegments(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open("db", &Options{FS: NewMemFS()})
+	assert.Nil(err)
+	values := map[string]string{"a,b": "x\ny", "100%": "a%2Cb", "c": "d"}
+	for key, value := range values {
+		assert.Nil(db.Set(key, value))
+	}
+	assert.Nil(db.flush())
+	for key, value := range values {
+		val, err := db.Get(key)
+		assert.Nil(err, key)
+		assert.Equal(val, value, key)
+		p, err := db.GetPinned([]byte(key))
+		assert.Nil(err, key)
+		assert.Equal(string(p.Data()), value, key)
+		p.Release()
+	}
+	assert.Nil(db.Close())
+}
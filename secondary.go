@@ -0,0 +1,230 @@
+package simplekv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+)
+
+// ErrNotSecondary is returned by TryCatchUpWithPrimary on trees that were
+// not opened with OpenAsSecondary.
+var ErrNotSecondary = errors.New("tree is not a secondary")
+
+// errPrimaryChanged the primary flushed or compacted while a secondary was
+// catching up, the catch up is retried.
+var errPrimaryChanged = errors.New("primary changed during catch up")
+
+const maxCatchUpAttempts = 10
+
+// secondaryState what a secondary has read of its primary so far
+type secondaryState struct {
+	metadata  []byte
+	segments  map[string]File
+	sizes     map[string]int64
+	wal       File
+	walOffset int64
+}
+
+// OpenAsSecondary opens a read-only tree that follows the primary writing
+// to dir. It never takes the lock nor writes to dir, TryCatchUpWithPrimary
+// picks up what the primary wrote since.
+func OpenAsSecondary(dir string, opts *Options) (*Tree, error) {
+	tree, err := newTree(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	tree.readOnly = true
+	tree.secondary = &secondaryState{
+		segments: map[string]File{},
+		sizes:    map[string]int64{},
+	}
+
+	if _, err := tree.opts.FS.Stat(tree.segmentsDirectory); err != nil {
+		return nil, fmt.Errorf("stat dir: %s err: %s", tree.segmentsDirectory, err)
+	}
+	err = tree.TryCatchUpWithPrimary()
+	if err != nil {
+		tree.secondary.close()
+		return nil, err
+	}
+	return tree, nil
+}
+
+// TryCatchUpWithPrimary reloads the primary's metadata, pins the segments it
+// lists and replays the WAL records appended since the last catch up.
+// Pinned segments stay readable after the primary compacts them away, they
+// are released once a newer metadata no longer references them.
+func (t *Tree) TryCatchUpWithPrimary() error {
+	if t.secondary == nil {
+		return ErrNotSecondary
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for attempt := 0; attempt < maxCatchUpAttempts; attempt++ {
+		err := t.catchUpMetadata()
+		if err == nil {
+			err = t.catchUpWal()
+		}
+		if err == nil {
+			// the primary saves its metadata before it replaces the WAL, an
+			// unchanged metadata means the replayed WAL belongs to it
+			err = t.checkMetadataUnchanged()
+		}
+		if errors.Is(err, errPrimaryChanged) {
+			continue
+		}
+		return err
+	}
+	return errPrimaryChanged
+}
+
+func (t *Tree) readPrimaryMetadata() ([]byte, error) {
+	data, err := readFile(t.opts.FS, t.metadataPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			// nothing flushed yet
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read meta data err: %s", err)
+	}
+	data, err = t.openFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("read meta data err: %w", err)
+	}
+	return data, nil
+}
+
+func (t *Tree) checkMetadataUnchanged() error {
+	data, err := t.readPrimaryMetadata()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, t.secondary.metadata) {
+		return errPrimaryChanged
+	}
+	return nil
+}
+
+func (t *Tree) catchUpMetadata() error {
+	s := t.secondary
+	data, err := t.readPrimaryMetadata()
+	if err != nil {
+		return err
+	}
+	if data == nil || bytes.Equal(data, s.metadata) {
+		return nil
+	}
+
+	meta := &treeMetadata{}
+	err = meta.load(data)
+	if err != nil {
+		// caught the primary writing it
+		return errPrimaryChanged
+	}
+	segments := map[string]File{}
+	sizes := map[string]int64{}
+	for _, segment := range meta.Segments {
+		file, err := t.opts.FS.OpenFile(t.segmentPath(segment), os.O_RDONLY, 0)
+		if err == nil {
+			var info os.FileInfo
+			info, err = file.Stat()
+			if err == nil {
+				segments[segment] = file
+				sizes[segment] = info.Size()
+			} else {
+				file.Close()
+			}
+		}
+		if err != nil {
+			closeFiles(segments)
+			if os.IsNotExist(err) {
+				return errPrimaryChanged
+			}
+			return fmt.Errorf("open segment: %s err: %s", segment, err)
+		}
+	}
+
+	err = t.applyMetadata(data)
+	if err != nil {
+		closeFiles(segments)
+		return err
+	}
+	closeFiles(s.segments)
+	s.segments = segments
+	s.sizes = sizes
+	s.metadata = data
+	t.cache = newSegmentCache(t.opts.CacheSize)
+	// the index is rebuilt from the pinned files, the ones reads go through
+	return t.repopulateIndex()
+}
+
+func (t *Tree) catchUpWal() error {
+	s := t.secondary
+	info, err := t.opts.FS.Stat(t.memtableWalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("stat wal err: %s", err)
+	}
+	if s.wal != nil {
+		current, err := s.wal.Stat()
+		if err != nil {
+			return fmt.Errorf("stat wal err: %s", err)
+		}
+		if !sameFile(info, current) {
+			// the primary flushed its memtable and started a new log
+			s.wal.Close()
+			s.wal = nil
+		}
+	}
+	if s.wal == nil {
+		s.wal, err = t.opts.FS.OpenFile(t.memtableWalPath(), os.O_RDONLY, 0)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return errPrimaryChanged
+			}
+			return fmt.Errorf("open wal err: %s", err)
+		}
+		s.walOffset = 0
+		t.walCipher = nil
+		t.memtable = NewSizedMapWithComparator(t.opts.Comparator)
+		t.rangeTombstones = nil
+	}
+
+	reader := newSectionLineReader(s.wal, s.walOffset, math.MaxInt64)
+	consumed, err := t.replayWal(reader)
+	s.walOffset += consumed
+	return err
+}
+
+// pinned returns the handle of segment pinned by a secondary.
+func (s *secondaryState) pinned(segment string) (File, int64, bool) {
+	if s == nil {
+		return nil, 0, false
+	}
+	file, ok := s.segments[segment]
+	return file, s.sizes[segment], ok
+}
+
+func (s *secondaryState) close() error {
+	closeFiles(s.segments)
+	s.segments = map[string]File{}
+	if s.wal != nil {
+		err := s.wal.Close()
+		s.wal = nil
+		if err != nil {
+			return fmt.Errorf("close wal err: %s", err)
+		}
+	}
+	return nil
+}
+
+func closeFiles(files map[string]File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
@@ -0,0 +1,101 @@
+package simplekv
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecondaryCatchesUpWithPrimary(t *testing.T) {
+	assert := assert.New(t)
+	opts := &Options{MemtableSize: 40, SparsityFactor: 10}
+	primary, err := Open(testBasePath, opts)
+	defer cleanup()
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		err = primary.Set("key"+strconv.Itoa(i), "v1")
+		assert.Nil(err)
+	}
+
+	secondary, err := OpenAsSecondary(testBasePath, opts)
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		val, err := secondary.Get("key" + strconv.Itoa(i))
+		assert.Nil(err)
+		assert.Equal(val, "v1")
+	}
+
+	for i := 0; i < 30; i++ {
+		err = primary.Set("key"+strconv.Itoa(i), "v2")
+		assert.Nil(err)
+	}
+	// not caught up yet, the old segments are still readable
+	val, err := secondary.Get("key25")
+	assert.Equal(err, ErrNotFound)
+	assert.Equal(val, "")
+
+	err = secondary.TryCatchUpWithPrimary()
+	assert.Nil(err)
+	for i := 0; i < 30; i++ {
+		val, err := secondary.Get("key" + strconv.Itoa(i))
+		assert.Nil(err)
+		assert.Equal(val, "v2")
+	}
+
+	err = secondary.Set("key0", "v3")
+	assert.True(errors.Is(err, ErrReadOnly))
+	assert.Nil(secondary.Close())
+	assert.Nil(primary.Close())
+}
+
+func TestSecondaryReadsSegmentsCompactedAway(t *testing.T) {
+	assert := assert.New(t)
+	opts := &Options{
+		MemtableSize:       40,
+		SparsityFactor:     10,
+		CompactionStrategy: CompactionMergeSegments,
+	}
+	primary, err := Open(testBasePath, opts)
+	defer cleanup()
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		err = primary.Set("key"+strconv.Itoa(i), "v1")
+		assert.Nil(err)
+	}
+	secondary, err := OpenAsSecondary(testBasePath, opts)
+	assert.Nil(err)
+	segments := append([]string{}, secondary.segments...)
+	assert.NotEqual(len(segments), 0)
+
+	// merging removes or rewrites every segment the secondary pinned
+	for i := 20; i < 60; i++ {
+		err = primary.Set("key"+strconv.Itoa(i), "v1")
+		assert.Nil(err)
+	}
+	for i := 0; i < 20; i++ {
+		val, err := secondary.Get("key" + strconv.Itoa(i))
+		assert.Nil(err)
+		assert.Equal(val, "v1")
+	}
+
+	err = secondary.TryCatchUpWithPrimary()
+	assert.Nil(err)
+	for i := 0; i < 60; i++ {
+		val, err := secondary.Get("key" + strconv.Itoa(i))
+		assert.Nil(err)
+		assert.Equal(val, "v1")
+	}
+	assert.Nil(secondary.Close())
+	assert.Nil(primary.Close())
+}
+
+func TestTryCatchUpRequiresSecondary(t *testing.T) {
+	assert := assert.New(t)
+	db, err := Open(testBasePath, nil)
+	defer cleanup()
+	assert.Nil(err)
+	assert.True(errors.Is(db.TryCatchUpWithPrimary(), ErrNotSecondary))
+	assert.Nil(db.Close())
+}
@@ -0,0 +1,373 @@
+package simplekv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// segmentMagic starts the segments written in blocks. A segment of plain
+// lines can't start with it, every record line holds a comma.
+const segmentMagic = "\xffSKVB\n"
+
+const maxBlockHeaderLen = 1 + 2*binary.MaxVarintLen64
+
+// segmentWriter writes the lines of a segment, as is when the tree doesn't
+// compress nor encrypt, else grouped in blocks of about Options.BlockSize
+// bytes. Every block starts with the id of its codec, its raw and its
+// stored length. Encrypted blocks are sealed with the data key of the file
+// and bound to their offset.
+type segmentWriter struct {
+	path      string
+	file      File
+	codec     Codec
+	codecID   uint8
+	cipher    *fileCipher
+	blockSize int
+	buf       []byte
+	pos       int64
+}
+
+// createSegment creates, or truncates, the segment file at path.
+func (t *Tree) createSegment(path string) (*segmentWriter, error) {
+	file, err := t.opts.FS.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %s err: %s", path, err)
+	}
+	w := &segmentWriter{path: path, file: file, blockSize: t.opts.BlockSize}
+	if t.opts.Compression == (noneCodec{}).Name() && t.opts.KeyProvider == nil {
+		return w, nil
+	}
+	w.codecID, w.codec, err = codecByName(t.opts.Compression)
+	header := []byte(segmentMagic)
+	if err == nil && t.opts.KeyProvider != nil {
+		w.cipher, err = newFileCipher(t.opts.KeyProvider)
+		if err == nil {
+			header = w.cipher.sealedHeader()
+		}
+	}
+	if err == nil {
+		_, err = file.Write(header)
+		w.pos = int64(len(header))
+	}
+	if err != nil {
+		file.Close()
+		t.opts.FS.Remove(path)
+		return nil, fmt.Errorf("write %s err: %w", path, err)
+	}
+	return w, nil
+}
+
+func (w *segmentWriter) WriteString(s string) error {
+	if w.codec == nil {
+		_, err := io.WriteString(w.file, s)
+		if err != nil {
+			return fmt.Errorf("write %s err: %s", w.path, err)
+		}
+		return nil
+	}
+	w.buf = append(w.buf, s...)
+	if len(w.buf) >= w.blockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// flushBlock writes the buffered lines as a block, stored raw when the
+// codec doesn't shrink them.
+func (w *segmentWriter) flushBlock() error {
+	data, err := w.codec.Compress(w.buf)
+	if err != nil {
+		return fmt.Errorf("compress block of %s err: %s", w.path, err)
+	}
+	id := w.codecID
+	if len(data) >= len(w.buf) {
+		data, id = w.buf, CodecNone
+	}
+	if w.cipher != nil {
+		data = seal(w.cipher.aead, nil, data, blockAAD(w.pos))
+	}
+	header := make([]byte, 1, maxBlockHeaderLen)
+	header[0] = id
+	header = binary.AppendUvarint(header, uint64(len(w.buf)))
+	header = binary.AppendUvarint(header, uint64(len(data)))
+	_, err = w.file.Write(append(header, data...))
+	if err != nil {
+		return fmt.Errorf("write %s err: %s", w.path, err)
+	}
+	w.pos += int64(len(header) + len(data))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close writes the last block, then syncs and closes the file.
+func (w *segmentWriter) Close() error {
+	if w.codec != nil && len(w.buf) > 0 {
+		if err := w.flushBlock(); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	err := w.file.Sync()
+	if err != nil {
+		w.file.Close()
+		return fmt.Errorf("flush file err: %s", err)
+	}
+	err = w.file.Close()
+	if err != nil {
+		return fmt.Errorf("close file err: %s", err)
+	}
+	return nil
+}
+
+// blockAAD binds an encrypted block to its offset in the file.
+func blockAAD(pos int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(pos))
+}
+
+// openSegmentFile returns a line reader positioned at offset of the
+// segment file at path, offset counting decompressed bytes.
+func (t *Tree) openSegmentFile(path string, offset int64) (*LineReader, error) {
+	file, err := t.opts.FS.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open file err: %s", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("stat file err: %s", err)
+	}
+	reader, err := t.newSegmentLineReader(file, file, info.Size(), offset)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// newSegmentLineReader reads the lines of the segment held by the size
+// first bytes of r from offset, Close closes closer.
+func (t *Tree) newSegmentLineReader(r io.ReaderAt, closer io.Closer, size, offset int64) (*LineReader, error) {
+	header, err := readSegmentHeader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	var src io.Reader
+	if header.blocked {
+		reader := &blockReader{r: r, pos: header.size, size: size, skip: offset}
+		if header.envelope != nil {
+			reader.cipher, err = openFileCipher(t.opts.KeyProvider, header.envelope)
+			if err != nil {
+				return nil, err
+			}
+		}
+		src = reader
+	} else {
+		src = io.NewSectionReader(r, offset, size-offset)
+	}
+	return &LineReader{
+		file:  closer,
+		inner: bufio.NewReader(src),
+	}, nil
+}
+
+// segmentHeader what starts a segment file, nothing for plain lines
+type segmentHeader struct {
+	blocked  bool
+	envelope []byte
+	size     int64
+}
+
+func readSegmentHeader(r io.ReaderAt, size int64) (*segmentHeader, error) {
+	// the magic, then the length of the envelope when there is one
+	data := make([]byte, len(sealedMagic)+binary.MaxVarintLen64)
+	if size < int64(len(data)) {
+		data = data[:size]
+	}
+	n, err := r.ReadAt(data, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("read segment header err: %s", err)
+	}
+	data = data[:n]
+	switch {
+	case bytes.HasPrefix(data, []byte(segmentMagic)):
+		return &segmentHeader{blocked: true, size: int64(len(segmentMagic))}, nil
+	case bytes.HasPrefix(data, []byte(sealedMagic)):
+		length, i := binary.Uvarint(data[len(sealedMagic):])
+		start := int64(len(sealedMagic) + i)
+		if i <= 0 || uint64(size-start) < length {
+			return nil, fmt.Errorf("encrypted file header not valid")
+		}
+		envelope := make([]byte, length)
+		if n, err := r.ReadAt(envelope, start); n < len(envelope) {
+			return nil, fmt.Errorf("read segment header err: %s", err)
+		}
+		return &segmentHeader{blocked: true, envelope: envelope, size: start + int64(length)}, nil
+	}
+	return &segmentHeader{}, nil
+}
+
+// blockReader reads the decompressed content of a blocked segment, the
+// skip first bytes left out. Blocks lying before skip aren't decompressed.
+type blockReader struct {
+	r      io.ReaderAt
+	cipher *fileCipher
+	pos    int64
+	size   int64
+	skip   int64
+	cur    []byte
+}
+
+func (b *blockReader) Read(p []byte) (int, error) {
+	for len(b.cur) == 0 {
+		if b.pos >= b.size {
+			return 0, io.EOF
+		}
+		if err := b.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, b.cur)
+	b.cur = b.cur[n:]
+	return n, nil
+}
+
+func (b *blockReader) nextBlock() error {
+	id, rawLen, storedLen, n, err := readBlockHeader(b.r, b.pos, b.size)
+	if err != nil {
+		return err
+	}
+	blockPos, start := b.pos, b.pos+int64(n)
+	b.pos = start + storedLen
+	if b.skip >= rawLen {
+		b.skip -= rawLen
+		return nil
+	}
+	codec, err := codecByID(id)
+	if err != nil {
+		return err
+	}
+	stored := make([]byte, storedLen)
+	_, err = b.r.ReadAt(stored, start)
+	if err != nil {
+		return fmt.Errorf("read segment block err: %s", err)
+	}
+	if b.cipher != nil {
+		stored, err = unseal(b.cipher.aead, stored, blockAAD(blockPos))
+		if err != nil {
+			return fmt.Errorf("decrypt segment block at %d err: %s", blockPos, err)
+		}
+	}
+	raw, err := codec.Decompress(stored, int(rawLen))
+	if err != nil {
+		return fmt.Errorf("decompress segment block err: %s", err)
+	}
+	b.cur, b.skip = raw[b.skip:], 0
+	return nil
+}
+
+// readBlockHeader reads the header of the block at pos, n is its length.
+func readBlockHeader(r io.ReaderAt, pos, size int64) (id uint8, rawLen, storedLen int64, n int, err error) {
+	header := make([]byte, maxBlockHeaderLen)
+	if rest := size - pos; rest < int64(len(header)) {
+		header = header[:rest]
+	}
+	read, err := r.ReadAt(header, pos)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, 0, 0, 0, fmt.Errorf("read segment block err: %s", err)
+	}
+	header = header[:read]
+	if len(header) == 0 {
+		return 0, 0, 0, 0, fmt.Errorf("segment block not valid at %d", pos)
+	}
+	raw, i := binary.Uvarint(header[1:])
+	if i <= 0 {
+		return 0, 0, 0, 0, fmt.Errorf("segment block not valid at %d", pos)
+	}
+	stored, j := binary.Uvarint(header[1+i:])
+	if j <= 0 || pos+int64(1+i+j)+int64(stored) > size {
+		return 0, 0, 0, 0, fmt.Errorf("segment block not valid at %d", pos)
+	}
+	return header[0], int64(raw), int64(stored), 1 + i + j, nil
+}
+
+// CompressionStats sizes of the segments of a tree before and after
+// compression.
+type CompressionStats struct {
+	// RawBytes is the size of the segment lines.
+	RawBytes int64
+	// StoredBytes is the size they take on disk.
+	StoredBytes int64
+	// Blocks counts the blocks of each codec, segments that are not
+	// written in blocks are not counted.
+	Blocks map[string]int
+}
+
+// Ratio returns RawBytes / StoredBytes, 1 for an empty tree.
+func (s CompressionStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.RawBytes) / float64(s.StoredBytes)
+}
+
+// CompressionStats returns how much the segments of t are compressed.
+func (t *Tree) CompressionStats() (CompressionStats, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	stats := CompressionStats{Blocks: map[string]int{}}
+	for _, segment := range t.segments {
+		err := t.addSegmentStats(segment, &stats)
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func (t *Tree) addSegmentStats(segment string, stats *CompressionStats) error {
+	var (
+		r    io.ReaderAt
+		size int64
+	)
+	if file, pinnedSize, ok := t.secondary.pinned(segment); ok {
+		r, size = file, pinnedSize
+	} else {
+		file, err := t.opts.FS.OpenFile(t.segmentPath(segment), os.O_RDONLY, 0)
+		if err != nil {
+			return fmt.Errorf("open file err: %s", err)
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("stat file err: %s", err)
+		}
+		r, size = file, info.Size()
+	}
+	header, err := readSegmentHeader(r, size)
+	if err != nil {
+		return err
+	}
+	if !header.blocked {
+		stats.RawBytes += size
+		stats.StoredBytes += size
+		return nil
+	}
+	stats.StoredBytes += header.size
+	for pos := header.size; pos < size; {
+		id, rawLen, storedLen, n, err := readBlockHeader(r, pos, size)
+		if err != nil {
+			return err
+		}
+		stats.Blocks[codecName(id)]++
+		stats.RawBytes += rawLen
+		stats.StoredBytes += int64(n) + storedLen
+		pos += int64(n) + storedLen
+	}
+	return nil
+}
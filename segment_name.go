@@ -0,0 +1,105 @@
+package simplekv
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrFileNumbersExhausted is returned when a tree has used every segment
+// file number.
+var ErrFileNumbersExhausted = errors.New("segment file numbers exhausted")
+
+const segmentSuffix = ".sst"
+
+// segmentFileName returns the name of the segment numbered num.
+func segmentFileName(num uint64) string {
+	return fmt.Sprintf("%06d%s", num, segmentSuffix)
+}
+
+// parseSegmentFileName returns the number of the segment name, ok is false
+// when name isn't named like a segment.
+func parseSegmentFileName(name string) (num uint64, ok bool) {
+	digits := strings.TrimSuffix(name, segmentSuffix)
+	if digits == name || len(digits) < 6 || strings.IndexFunc(digits, isNotDigit) >= 0 {
+		return 0, false
+	}
+	num, err := strconv.ParseUint(digits, 10, 64)
+	return num, err == nil
+}
+
+// parseLegacySegmentName splits the names of the segments written before
+// they were numbered, name-N, in their prefix, name- included, and N.
+func parseLegacySegmentName(name string) (prefix string, num uint64, ok bool) {
+	i := strings.LastIndex(name, "-")
+	if i <= 0 || i == len(name)-1 || strings.IndexFunc(name[i+1:], isNotDigit) >= 0 {
+		return "", 0, false
+	}
+	num, err := strconv.ParseUint(name[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return name[:i+1], num, true
+}
+
+func isNotDigit(r rune) bool {
+	return r < '0' || r > '9'
+}
+
+// reservedFilenames are the files of a tree directory a base name must
+// not collide with.
+var reservedFilenames = map[string]bool{
+	lockFilename:     true,
+	optionsFilename:  true,
+	metadataFilename: true,
+	infoLogFilename:  true,
+}
+
+// validateBasename checks that name, the base name of option, can name a
+// file of the tree directory.
+func validateBasename(option, name string) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("%w: %s %q is not a file name", ErrInvalidOptions, option, name)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("%w: %s %q must not contain a path separator", ErrInvalidOptions, option, name)
+	case reservedFilenames[name] || strings.HasPrefix(name, infoLogOldPrefix) ||
+		strings.HasSuffix(name, ".tmp"):
+		return fmt.Errorf("%w: %s %q is reserved", ErrInvalidOptions, option, name)
+	}
+	if _, ok := parseSegmentFileName(name); ok {
+		return fmt.Errorf("%w: %s %q is named like a segment", ErrInvalidOptions, option, name)
+	}
+	return nil
+}
+
+// newSegmentName returns the name of a new segment file, from the next
+// file number. Names are never reused, a segment is never rewritten in
+// place.
+func (t *Tree) newSegmentName() (string, error) {
+	if t.nextFileNumber == math.MaxUint64 {
+		return "", ErrFileNumbersExhausted
+	}
+	name := segmentFileName(t.nextFileNumber)
+	t.nextFileNumber++
+	return name, nil
+}
+
+// isSegmentName tells whether name is named like the segments of t, the
+// legacy ones included.
+func (t *Tree) isSegmentName(name string) bool {
+	if _, ok := parseSegmentFileName(name); ok {
+		return true
+	}
+	prefix, _, ok := parseLegacySegmentName(name)
+	return ok && prefix == t.legacySegmentPrefix()
+}
+
+// legacySegmentPrefix returns the prefix of the segments of t written
+// before they were numbered.
+func (t *Tree) legacySegmentPrefix() string {
+	prefix, _, _ := parseLegacySegmentName(t.opts.SegmentBasename)
+	return prefix
+}
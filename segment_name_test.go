@@ -0,0 +1,178 @@
+package simplekv
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegmentFileName(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	assert.Equal(segmentFileName(1), "000001.sst")
+	assert.Equal(segmentFileName(1234567), "1234567.sst")
+
+	for name, num := range map[string]uint64{"000001.sst": 1, "1234567.sst": 1234567} {
+		parsed, ok := parseSegmentFileName(name)
+		assert.True(ok, name)
+		assert.Equal(parsed, num)
+	}
+	for _, name := range []string{"1.sst", "000001", "00000a.sst", "-00001.sst", "000001.sst.tmp"} {
+		_, ok := parseSegmentFileName(name)
+		assert.False(ok, name)
+	}
+
+	prefix, num, ok := parseLegacySegmentName("segment-12")
+	assert.True(ok)
+	assert.Equal(prefix, "segment-")
+	assert.Equal(num, uint64(12))
+	for _, name := range []string{"segment", "segment-", "-1", "segment-x", "segment-+1"} {
+		_, _, ok := parseLegacySegmentName(name)
+		assert.False(ok, name)
+	}
+}
+
+func TestNewTreeRejectsInvalidBasenames(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	_, err := Open("db", &Options{FS: fs, SegmentBasename: "segment"})
+	assert.True(errors.Is(err, ErrInvalidOptions))
+	_, err = Open("db", &Options{FS: fs, WalBasename: "database_metadata"})
+	assert.True(errors.Is(err, ErrInvalidOptions))
+}
+
+func TestSegmentsAreNumbered(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	opts := &Options{MemtableSize: 100, SparsityFactor: 2, FS: fs}
+	db, err := Open("db", opts)
+	assert.Nil(err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+	}
+	assert.True(len(db.segments) > 0)
+	for _, segment := range db.segments {
+		_, ok := parseSegmentFileName(segment)
+		assert.True(ok, segment)
+	}
+	next := db.nextFileNumber
+	old := append([]string(nil), db.segments...)
+	assert.Nil(db.Close())
+
+	// the file number survives a reopen, names are never reused
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	assert.Equal(db.nextFileNumber, next)
+	assert.Nil(db.Set("key", "value"))
+	assert.Nil(db.flush())
+	assert.True(db.nextFileNumber > next)
+	previous := map[string]bool{}
+	for _, segment := range old {
+		previous[segment] = true
+	}
+	for _, segment := range db.segments {
+		num, ok := parseSegmentFileName(segment)
+		assert.True(ok, segment)
+		assert.True(previous[segment] || num >= next, segment)
+	}
+	assert.Nil(db.Close())
+}
+
+func TestOpenLegacySegmentNames(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	opts := &Options{MemtableSize: 100, SparsityFactor: 2, FS: fs}
+	db, err := Open("db", opts)
+	assert.Nil(err)
+	assert.Nil(db.Set("key", "value"))
+	assert.Nil(db.flush())
+	assert.Nil(db.Close())
+
+	// rename the segment like the trees written before segments were
+	// numbered
+	assert.Nil(fs.Rename("db/"+segmentFileName(1), "db/segment-1"))
+	data, err := readFile(fs, "db/"+metadataFilename)
+	assert.Nil(err)
+	meta := &treeMetadata{}
+	assert.Nil(meta.load(data))
+	assert.Equal(meta.Segments, []string{segmentFileName(1)})
+	meta.Segments = []string{"segment-1"}
+	meta.CurrentSegment, meta.NextFileNumber = "segment-1", 0
+	for _, item := range meta.Index {
+		item.Segment = "segment-1"
+	}
+	data, err = meta.dump()
+	assert.Nil(err)
+	assert.Nil(writeFile(fs, "db/"+metadataFilename, data))
+
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	assert.Equal(db.nextFileNumber, uint64(1))
+	assert.True(db.isSegmentName("segment-1"))
+	assert.True(fileExists(fs, "db/segment-1"))
+	val, err := db.Get("key")
+	assert.Nil(err)
+	assert.Equal(val, "value")
+	assert.Nil(db.Close())
+}
+
+func TestFileNumbersExhausted(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	db, err := Open("db", &Options{FS: NewMemFS()})
+	assert.Nil(err)
+	assert.Nil(db.Set("key", "value"))
+	db.nextFileNumber = math.MaxUint64
+	assert.True(errors.Is(db.flush(), ErrFileNumbersExhausted))
+	val, err := db.Get("key")
+	assert.Nil(err)
+	assert.Equal(val, "value")
+	assert.Nil(db.Close())
+}
+
+func TestOpenBaselineDirectory(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	// laid out like the trees written before the metadata was saved: legacy
+	// segments, the oldest first, a WAL and no metadata
+	assert.Nil(fs.MkdirAll("db", 0777))
+	assert.Nil(writeFile(fs, "db/segment-1", []byte("a,1\nb,2\n")))
+	assert.Nil(writeFile(fs, "db/segment-2", []byte("b,3\nc,4\n")))
+	assert.Nil(writeFile(fs, "db/wal", []byte("d,5\n")))
+	opts := &Options{MemtableSize: 100, SparsityFactor: 2, FS: fs}
+
+	for i := 0; i < 2; i++ {
+		db, err := Open("db", opts)
+		assert.Nil(err)
+		assert.Equal(db.segments, []string{"segment-1", "segment-2"})
+		for key, value := range map[string]string{"a": "1", "b": "3", "c": "4", "d": "5"} {
+			val, err := db.Get(key)
+			assert.Nil(err, key)
+			assert.Equal(val, value, key)
+		}
+		assert.True(fileExists(fs, "db/"+metadataFilename))
+		assert.Nil(db.Close())
+	}
+
+	// compacting the legacy segments rewrites them as numbered ones
+	db, err := Open("db", opts)
+	assert.Nil(err)
+	assert.Nil(db.Set("b", "6"))
+	assert.Nil(db.flush())
+	assert.Nil(db.Close())
+	db, err = Open("db", opts)
+	assert.Nil(err)
+	for key, value := range map[string]string{"a": "1", "b": "6", "c": "4", "d": "5"} {
+		val, err := db.Get(key)
+		assert.Nil(err, key)
+		assert.Equal(val, value, key)
+	}
+	assert.Nil(db.Close())
+}
@@ -0,0 +1,323 @@
+package simplekv
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats counters and latency histograms of a tree, its column families
+// included, since it was opened.
+type Stats struct {
+	// Gets is the number of point lookups, the reads of the conditional
+	// writes included.
+	Gets int64
+	// Sets is the number of records written, batches count their records.
+	Sets int64
+	// MemtableHits is the number of gets answered by a memtable.
+	MemtableHits int64
+	// BloomUseful is the number of gets the bloom filter kept from reading
+	// the segments.
+	BloomUseful int64
+	// BloomFalsePositives is the number of gets that read the segments for
+	// a key they don't hold.
+	BloomFalsePositives int64
+	// SegmentReads is the number of segment lookups of the gets.
+	SegmentReads int64
+	Flushes      int64
+	// FlushBytes is the size of the segments written by flushes.
+	FlushBytes int64
+	// Compactions counts the compactions that replaced segments.
+	Compactions int64
+	// CompactionBytes is the size of the segments written by compactions.
+	CompactionBytes int64
+	ReadLatency     Histogram
+	WriteLatency    Histogram
+}
+
+func (s Stats) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "gets: %d\n", s.Gets)
+	fmt.Fprintf(&b, "sets: %d\n", s.Sets)
+	fmt.Fprintf(&b, "memtable hits: %d\n", s.MemtableHits)
+	fmt.Fprintf(&b, "bloom useful: %d\n", s.BloomUseful)
+	fmt.Fprintf(&b, "bloom false positives: %d\n", s.BloomFalsePositives)
+	fmt.Fprintf(&b, "segment reads: %d\n", s.SegmentReads)
+	fmt.Fprintf(&b, "flushes: %d, %d bytes\n", s.Flushes, s.FlushBytes)
+	fmt.Fprintf(&b, "compactions: %d, %d bytes\n", s.Compactions, s.CompactionBytes)
+	fmt.Fprintf(&b, "read latency: %s\n", s.ReadLatency)
+	fmt.Fprintf(&b, "write latency: %s\n", s.WriteLatency)
+	return b.String()
+}
+
+// Histogram distribution of durations in exponential buckets.
+type Histogram struct {
+	Count int64
+	Sum   time.Duration
+	Min   time.Duration
+	Max   time.Duration
+	// Buckets count the durations up to their bound, which the previous
+	// bucket doesn't count.
+	Buckets []HistogramBucket
+}
+
+// HistogramBucket bucket of a Histogram.
+type HistogramBucket struct {
+	UpperBound time.Duration
+	Count      int64
+}
+
+// Mean returns the average duration, 0 for an empty histogram.
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Percentile returns the upper bound of the bucket holding the p-th
+// percentile, p in [0, 100], capped by Max.
+func (h Histogram) Percentile(p float64) time.Duration {
+	rank := int64(math.Ceil(p / 100 * float64(h.Count)))
+	var seen int64
+	for _, bucket := range h.Buckets {
+		seen += bucket.Count
+		if seen >= rank && seen > 0 {
+			if bucket.UpperBound > h.Max {
+				return h.Max
+			}
+			return bucket.UpperBound
+		}
+	}
+	return h.Max
+}
+
+func (h Histogram) String() string {
+	return fmt.Sprintf("count %d, mean %s, p50 %s, p99 %s, max %s",
+		h.Count, h.Mean(), h.Percentile(50), h.Percentile(99), h.Max)
+}
+
+// histogramBounds are the upper bounds of the buckets, from 1µs to about
+// 17s, the last bucket counts the rest.
+var histogramBounds = func() []time.Duration {
+	bounds := make([]time.Duration, 25)
+	for i := range bounds {
+		bounds[i] = time.Microsecond << i
+	}
+	return append(bounds, math.MaxInt64)
+}()
+
+type histogram struct {
+	mu       sync.Mutex
+	count    int64
+	sum      time.Duration
+	min, max time.Duration
+	buckets  [26]int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(histogramBounds), func(i int) bool { return histogramBounds[i] >= d })
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+	h.buckets[i]++
+}
+
+func (h *histogram) snapshot() Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := Histogram{Count: h.count, Sum: h.sum, Min: h.min, Max: h.max}
+	s.Buckets = make([]HistogramBucket, len(h.buckets))
+	for i, count := range h.buckets {
+		s.Buckets[i] = HistogramBucket{UpperBound: histogramBounds[i], Count: count}
+	}
+	return s
+}
+
+type counter int64
+
+func (c *counter) add(n int64) {
+	atomic.AddInt64((*int64)(c), n)
+}
+
+func (c *counter) load() int64 {
+	return atomic.LoadInt64((*int64)(c))
+}
+
+// statistics of a tree, shared by its column families. Gets update it
+// under the read lock, so it is safe for concurrent use.
+type statistics struct {
+	gets                counter
+	sets                counter
+	memtableHits        counter
+	bloomUseful         counter
+	bloomFalsePositives counter
+	segmentReads        counter
+	flushes             counter
+	flushBytes          counter
+	compactions         counter
+	compactionBytes     counter
+	readLatency         histogram
+	writeLatency        histogram
+}
+
+// observeRead records the latency of the read op started at start, slow
+// reads are logged.
+func (t *Tree) observeRead(op string, start time.Time) {
+	d := time.Since(start)
+	t.stats.readLatency.observe(d)
+	t.logIfSlow(op, d)
+}
+
+// observeWrite records the latency of the write op started at start, slow
+// writes are logged.
+func (t *Tree) observeWrite(op string, start time.Time) {
+	d := time.Since(start)
+	t.stats.writeLatency.observe(d)
+	t.logIfSlow(op, d)
+}
+
+// logIfSlow warns about op when it took longer than the slow operation
+// threshold.
+func (t *Tree) logIfSlow(op string, d time.Duration, args ...any) {
+	if threshold := t.opts.SlowOperationThreshold; threshold > 0 && d > threshold {
+		t.opts.Logger.Warn("slow operation", append([]any{"op", op, "duration", d}, args...)...)
+	}
+}
+
+// Stats returns the statistics of t and of the other column families of
+// its tree.
+func (t *Tree) Stats() Stats {
+	s := t.stats
+	return Stats{
+		Gets:                s.gets.load(),
+		Sets:                s.sets.load(),
+		MemtableHits:        s.memtableHits.load(),
+		BloomUseful:         s.bloomUseful.load(),
+		BloomFalsePositives: s.bloomFalsePositives.load(),
+		SegmentReads:        s.segmentReads.load(),
+		Flushes:             s.flushes.load(),
+		FlushBytes:          s.flushBytes.load(),
+		Compactions:         s.compactions.load(),
+		CompactionBytes:     s.compactionBytes.load(),
+		ReadLatency:         s.readLatency.snapshot(),
+		WriteLatency:        s.writeLatency.snapshot(),
+	}
+}
+
+// Properties of GetProperty, level<N> properties take the level as suffix,
+// e.g. "segment-bytes-at-level0".
+const (
+	// PropertyNumSegments number of segments.
+	PropertyNumSegments = "num-segments"
+	// PropertyMemtableSize size of the keys and values of the memtable.
+	PropertyMemtableSize = "memtable-size"
+	// PropertyMemtableKeys number of keys of the memtable.
+	PropertyMemtableKeys = "memtable-keys"
+	// PropertyEstimateNumKeys estimate of the number of keys, the records
+	// of the memtable and of the segments added up, without reading them.
+	PropertyEstimateNumKeys = "estimate-num-keys"
+	// PropertyTotalSegmentBytes size of the segment files.
+	PropertyTotalSegmentBytes = "total-segment-bytes"
+	// PropertyCompressionRatio raw over stored bytes of the segments.
+	PropertyCompressionRatio = "compression-ratio"
+	// PropertyLevelStats table of the segment and size of every level.
+	PropertyLevelStats = "level-stats"
+	// PropertySegmentAtLevel name of the segment of a level.
+	PropertySegmentAtLevel = "segment-at-level"
+	// PropertySegmentBytesAtLevel size of the segment of a level.
+	PropertySegmentBytesAtLevel = "segment-bytes-at-level"
+	// PropertyStats Stats of the tree, as text.
+	PropertyStats = "stats"
+)
+
+// GetProperty returns the value of the property name of the column family
+// of t, ok is false for unknown properties. Level 0 is the newest segment.
+func (t *Tree) GetProperty(name string) (value string, ok bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	switch name {
+	case PropertyNumSegments:
+		return strconv.Itoa(len(t.segments)), true
+	case PropertyMemtableSize:
+		return strconv.Itoa(t.memtable.GetTotalSize()), true
+	case PropertyMemtableKeys:
+		return strconv.Itoa(t.memtable.inner.Size()), true
+	case PropertyEstimateNumKeys:
+		keys := t.memtable.inner.Size()
+		for _, segment := range t.segments {
+			if n, ok := t.segmentKeys[segment]; ok {
+				keys += n
+				continue
+			}
+			// counted by reading it for segments written before the
+			// counts were kept
+			err := t.iterLineOfSegment(segment, func(rec *record) (bool, error) {
+				if rec.kind != kindRangeDelete {
+					keys++
+				}
+				return false, nil
+			})
+			if err != nil {
+				return "", false
+			}
+		}
+		return strconv.Itoa(keys), true
+	case PropertyTotalSegmentBytes:
+		return strconv.FormatInt(t.segmentsSize(t.segments), 10), true
+	case PropertyCompressionRatio:
+		stats := CompressionStats{Blocks: map[string]int{}}
+		for _, segment := range t.segments {
+			if err := t.addSegmentStats(segment, &stats); err != nil {
+				return "", false
+			}
+		}
+		return strconv.FormatFloat(stats.Ratio(), 'f', 2, 64), true
+	case PropertyLevelStats:
+		var b strings.Builder
+		fmt.Fprintf(&b, "%-6s %-24s %s\n", "level", "segment", "bytes")
+		for level := 0; level < len(t.segments); level++ {
+			segment := t.segments[len(t.segments)-1-level]
+			fmt.Fprintf(&b, "%-6d %-24s %d\n", level, segment, t.segmentsSize([]string{segment}))
+		}
+		return b.String(), true
+	case PropertyStats:
+		return t.Stats().String(), true
+	}
+	if level, ok := propertyLevel(name, PropertySegmentAtLevel); ok && level < len(t.segments) {
+		return t.segments[len(t.segments)-1-level], true
+	}
+	if level, ok := propertyLevel(name, PropertySegmentBytesAtLevel); ok && level < len(t.segments) {
+		segment := t.segments[len(t.segments)-1-level]
+		return strconv.FormatInt(t.segmentsSize([]string{segment}), 10), true
+	}
+	return "", false
+}
+
+// propertyLevel returns the level of the level property name of prefix.
+func propertyLevel(name, prefix string) (int, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false
+	}
+	level, err := strconv.Atoi(strings.TrimPrefix(name, prefix))
+	if err != nil || level < 0 {
+		return 0, false
+	}
+	return level, true
+}
@@ -0,0 +1,143 @@
+package simplekv
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	db, err := Open("db", &Options{MemtableSize: 100, SparsityFactor: 2, FS: NewMemFS()})
+	assert.Nil(err)
+	for i := 0; i < 30; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+	}
+	// the flushes of new keys replace no segment
+	assert.True(db.Stats().Flushes > 1)
+	assert.Equal(db.Stats().Compactions, int64(0))
+	for i := 0; i < 10; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "new"))
+	}
+	b := &WriteBatch{}
+	b.Set("batch1", "value")
+	b.Set("batch2", "value")
+	assert.Nil(db.Write(b))
+
+	stats := db.Stats()
+	assert.Equal(stats.Sets, int64(42))
+	assert.Equal(stats.WriteLatency.Count, int64(41))
+	assert.True(stats.Flushes > 1)
+	assert.True(stats.FlushBytes > 0)
+	assert.True(stats.Compactions > 0)
+	assert.True(stats.CompactionBytes > 0)
+
+	memtableHits := int64(0)
+	for _, key := range []string{"batch1", "key0", "key29", "missing"} {
+		if db.memtable.Get(key) != nil {
+			memtableHits++
+		}
+		_, _ = db.Get(key)
+	}
+	has, err := db.Has("batch1")
+	assert.Nil(err)
+	assert.True(has)
+	before := stats
+	stats = db.Stats()
+	assert.Equal(stats.Gets-before.Gets, int64(5))
+	assert.Equal(stats.ReadLatency.Count, int64(5))
+	assert.Equal(stats.MemtableHits-before.MemtableHits, memtableHits+1)
+	assert.True(stats.SegmentReads > before.SegmentReads)
+	assert.Equal(stats.BloomUseful+stats.BloomFalsePositives-before.BloomUseful-before.BloomFalsePositives, int64(1))
+	assert.True(strings.Contains(stats.String(), "gets: "))
+	assert.Nil(db.Close())
+}
+
+func TestHistogram(t *testing.T) {
+	assert := assert.New(t)
+	h := &histogram{}
+	assert.Equal(h.snapshot().Percentile(50), time.Duration(0))
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Microsecond)
+	}
+	s := h.snapshot()
+	assert.Equal(s.Count, int64(100))
+	assert.Equal(s.Min, time.Microsecond)
+	assert.Equal(s.Max, 100*time.Microsecond)
+	assert.Equal(s.Mean(), 50500*time.Nanosecond)
+	assert.Equal(s.Percentile(50), 64*time.Microsecond)
+	assert.Equal(s.Percentile(100), 100*time.Microsecond)
+	h.observe(time.Hour)
+	assert.Equal(h.snapshot().Percentile(100), time.Hour)
+}
+
+func TestGetProperty(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	db, err := Open("db", &Options{MemtableSize: 100, SparsityFactor: 2, FS: NewMemFS(),
+		CompactionStrategy: CompactionMergeSegments})
+	assert.Nil(err)
+	for i := 0; i < 30; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"))
+	}
+	property := func(name string) string {
+		value, ok := db.GetProperty(name)
+		assert.True(ok, name)
+		return value
+	}
+	assert.Equal(property(PropertyNumSegments), "1")
+	assert.Equal(property(PropertySegmentAtLevel+"0"), db.segments[0])
+	assert.Equal(property(PropertySegmentBytesAtLevel+"0"), property(PropertyTotalSegmentBytes))
+	assert.Equal(property(PropertyMemtableKeys), strconv.Itoa(db.memtable.inner.Size()))
+	assert.Equal(property(PropertyMemtableSize), strconv.Itoa(db.memtable.GetTotalSize()))
+	assert.Equal(property(PropertyCompressionRatio), "1.00")
+	assert.True(strings.Contains(property(PropertyLevelStats), db.segments[0]))
+	assert.True(strings.HasPrefix(property(PropertyStats), "gets: 0\n"))
+	estimate, err := strconv.Atoi(property(PropertyEstimateNumKeys))
+	assert.Nil(err)
+	assert.Equal(estimate, 30)
+
+	for _, name := range []string{"unknown", PropertySegmentAtLevel + "1", PropertySegmentAtLevel + "-1"} {
+		_, ok := db.GetProperty(name)
+		assert.False(ok, name)
+	}
+
+	cf, err := db.CreateColumnFamily("users", nil)
+	assert.Nil(err)
+	assert.Nil(cf.Set("key", "value"))
+	value, ok := cf.GetProperty(PropertyMemtableKeys)
+	assert.True(ok)
+	assert.Equal(value, "1")
+	assert.Nil(db.Close())
+}
+
+func TestEstimateNumKeysReadsNoSegment(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	for _, strategy := range []CompactionStrategy{CompactionDeleteKeys, CompactionMergeSegments} {
+		opts := &Options{MemtableSize: 100, SparsityFactor: 2, FS: NewMemFS(), CompactionStrategy: strategy}
+		db, err := Open("db", opts)
+		assert.Nil(err)
+		for i := 0; i < 40; i++ {
+			assert.Nil(db.Set("key"+strconv.Itoa(i%30), "value"))
+		}
+		assert.Nil(db.Delete("key0"))
+		assert.Nil(db.flush())
+		assert.Nil(db.Close())
+
+		// the counts are kept in the metadata
+		db, err = Open("db", opts)
+		assert.Nil(err)
+		for _, segment := range db.segments {
+			assert.Nil(writeFile(opts.FS, db.segmentPath(segment), []byte("unreadable")))
+		}
+		estimate, ok := db.GetProperty(PropertyEstimateNumKeys)
+		assert.True(ok, strategy.String())
+		assert.Equal(estimate, "29", strategy.String())
+		assert.Nil(db.Close())
+	}
+}
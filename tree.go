@@ -4,13 +4,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
-	"strconv"
+	"sort"
 	"strings"
-	"unsafe"
+	"sync"
+	"time"
+)
 
-	rbtree "github.com/pedrogao/RbTree"
+var (
+	// ErrReadOnly is returned by write APIs of a tree opened with OpenReadOnly.
+	ErrReadOnly = errors.New("tree is opened read-only")
+	// ErrNotFound is returned by reads of an absent, deleted or expired key.
+	ErrNotFound = errors.New("key not found")
 )
 
 // Tree LSM tree(og structure tree)
@@ -18,14 +23,62 @@ type Tree struct {
 	appendLog   *AppendLog
 	bloomFilter *BloomFilter
 	segments    []string
-	index       *rbtree.Tree // 磁盘文件稀疏索引
-	memtable    *SizedMap
+	// obsolete segments replaced by a compaction, removed once the
+	// metadata no longer references them
+	obsolete []string
+	index    *orderedTree // 磁盘文件稀疏索引
+	memtable *SizedMap
+	// range tombstones of the memtable, flushed at the head of the segment
+	rangeTombstones []rangeTombstone
+	// segmentTombstones range tombstones at the head of the segments, they
+	// mask the keys of the older segments
+	segmentTombstones map[string][]rangeTombstone
+	// segmentKeys number of records of the segments, tombstones left out
+	segmentKeys map[string]int
+
+	cache *segmentCache
+	opts  *Options
+	lock  *fileLock
+	// infoLog is the LOG file the logger of the tree writes to
+	infoLog *infoLog
+
+	// mu is shared by all the column families of a tree
+	mu        *sync.RWMutex
+	readOnly  bool
+	secondary *secondaryState
+	// closed is set once Close released the tree
+	closed bool
+
+	// cfID is 0 for the default column family, which holds the others
+	cfID     uint32
+	parent   *Tree
+	families *columnFamilies
+	// family is the handle of the column family of t, nil for the default
+	// one
+	family *ColumnFamily
+
+	// walCipher encrypts the records appended to the WAL
+	walCipher *fileCipher
+	// stats is shared by all the column families of a tree
+	stats *statistics
 
 	threshold         int
 	sparsityFactor    int
 	segmentsDirectory string
 	walBasename       string
-	currentSegment    string
+	// nextFileNumber numbers the next segment written
+	nextFileNumber uint64
+	// lastSequence numbers the records written to the WAL, only the root's
+	// is used
+	lastSequence uint64
+	// flushedSequence is the sequence number of the last record flushed to
+	// the segments of the column family
+	flushedSequence uint64
+	// compactions counts the compactions that changed the segments of any
+	// column family, only the root's is used
+	compactions uint64
+	// expvarNames names the root is published as, guarded by expvarMu
+	expvarNames []string
 }
 
 type indexItem struct {
@@ -40,39 +93,120 @@ type indexItem struct {
 // - A memtable write ahead log (WAL) called wal_basename
 func NewTree(segmentBasename, segmentsDirectory,
 	walBasename string) (*Tree, error) {
-	// create lsm tree
-	tree := &Tree{
-		segments:          make([]string, 0),
-		index:             rbtree.NewTree(),
-		memtable:          NewSizedMap(),
-		threshold:         1000000,
-		sparsityFactor:    100,
-		segmentsDirectory: segmentsDirectory,
-		walBasename:       walBasename,
-		currentSegment:    segmentBasename,
-	}
+	opts := DefaultOptions()
+	opts.SegmentBasename = segmentBasename
+	opts.WalBasename = walBasename
+	return Open(segmentsDirectory, opts)
+}
 
-	// create bloom filter
-	bloomFilter := NewBloomFilter(100, 0.2)
-	tree.bloomFilter = bloomFilter
+// Open opens the LSM tree stored in dir, creating it when missing.
+// A nil opts means DefaultOptions, zero fields are filled with defaults.
+// The options in effect are persisted to the OPTIONS file of dir.
+func Open(dir string, opts *Options) (*Tree, error) {
+	tree, err := newTree(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	dir = tree.segmentsDirectory
+	opts = tree.opts
 
 	// create the segments directory
-	if _, err := os.Stat(segmentsDirectory); err != nil && os.IsNotExist(err) {
+	if !fileExists(opts.FS, dir) {
 		// directory not exist
-		err = os.MkdirAll(segmentsDirectory, 0777)
+		err = opts.FS.MkdirAll(dir, 0777)
 		if err != nil {
-			return nil, fmt.Errorf("make dir: %s err: %s", segmentsDirectory, err)
+			return nil, fmt.Errorf("make dir: %s err: %s", dir, err)
 		}
 	}
 
+	// only one process may write to the directory
+	lock, err := acquireLock(opts.FS, tree.lockPath())
+	if err != nil {
+		return nil, err
+	}
+	tree.lock = lock
+
+	if !opts.DisableInfoLog {
+		tree.infoLog, err = openInfoLog(opts.FS, dir, opts)
+		if err != nil {
+			lock.release()
+			return nil, err
+		}
+		opts.Logger = teeLogger{opts.Logger, tree.infoLog.logger()}
+	}
+
 	// create write ahead log.
-	appendLog, err := NewAppendLog(tree.memtableWalPath())
+	appendLog, err := newAppendLog(opts.FS, tree.memtableWalPath())
 	if err != nil {
+		tree.closeInfoLog()
+		lock.release()
 		return nil, fmt.Errorf("new wal: %s err: %s", tree.memtableWalPath(), err)
 	}
 	tree.appendLog = appendLog
 
+	tree.families = newColumnFamilies(tree)
+	created := !fileExists(opts.FS, tree.metadataPath())
 	err = tree.loadMetadata()
+	if err == nil {
+		err = tree.openColumnFamilies()
+	}
+	for _, family := range tree.familyTrees() {
+		if err == nil {
+			err = family.removeOrphanFiles()
+		}
+	}
+	if err == nil {
+		err = tree.restoreMemtable()
+	}
+	if err == nil && opts.KeyProvider != nil && tree.walCipher == nil {
+		// the records appended from now on are encrypted
+		tree.walCipher, err = newFileCipher(opts.KeyProvider)
+		if err == nil {
+			err = appendLog.WriteString(tree.walCipher.walHeader())
+		}
+	}
+	if err == nil && created {
+		// the comparator is persisted before any key is, a tree that
+		// crashes before its first flush can't be reopened with another
+		err = tree.saveMetadata()
+	}
+	if err == nil {
+		err = opts.save(opts.FS, tree.optionsPath())
+	}
+	if err != nil {
+		opts.Logger.Error("open failed", "dir", dir, "err", err)
+		appendLog.Close()
+		tree.closeInfoLog()
+		lock.release()
+		return nil, err
+	}
+	opts.Logger.Info("tree opened", "dir", dir,
+		"segments", len(tree.segments), "memtable_keys", tree.memtable.inner.Size(),
+		"column_families", len(tree.familyTrees()), "compaction", opts.CompactionStrategy)
+	return tree, nil
+}
+
+// OpenReadOnly opens the LSM tree stored in dir without ever writing to it.
+// The WAL is replayed into memory but left untouched, the directory lock is
+// not taken so a writer may keep the database open, and every write API
+// returns ErrReadOnly.
+func OpenReadOnly(dir string, opts *Options) (*Tree, error) {
+	tree, err := newTree(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	tree.readOnly = true
+	dir = tree.segmentsDirectory
+
+	if _, err := tree.opts.FS.Stat(dir); err != nil {
+		return nil, fmt.Errorf("stat dir: %s err: %s", dir, err)
+	}
+	tree.families = newColumnFamilies(tree)
+	err = tree.loadMetadata()
+	if err != nil {
+		return nil, err
+	}
+	err = tree.openColumnFamilies()
 	if err != nil {
 		return nil, err
 	}
@@ -80,54 +214,426 @@ func NewTree(segmentBasename, segmentsDirectory,
 	if err != nil {
 		return nil, err
 	}
+	tree.opts.Logger.Info("tree opened read-only", "dir", dir,
+		"segments", len(tree.segments), "memtable_keys", tree.memtable.inner.Size())
+	return tree, nil
+}
+
+// newTree validates opts and builds an in-memory tree for dir, nothing is
+// read from or written to disk.
+func newTree(dir string, opts *Options) (*Tree, error) {
+	opts = opts.withDefaults()
+	err := opts.validate()
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("%w: empty directory", ErrInvalidOptions)
+	}
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+
+	// create lsm tree
+	tree := &Tree{
+		segments:          make([]string, 0),
+		mu:                &sync.RWMutex{},
+		index:             newOrderedTree(opts.Comparator),
+		memtable:          NewSizedMapWithComparator(opts.Comparator),
+		segmentTombstones: map[string][]rangeTombstone{},
+		segmentKeys:       map[string]int{},
+		cache:             newSegmentCache(opts.CacheSize),
+		stats:             &statistics{},
+		opts:              opts,
+		threshold:         opts.MemtableSize,
+		sparsityFactor:    opts.SparsityFactor,
+		segmentsDirectory: dir,
+		walBasename:       opts.WalBasename,
+		nextFileNumber:    1,
+	}
+
+	// create bloom filter
+	bloomFilter := NewBloomFilter(opts.BloomFilterNumItems, opts.bloomFalsePosProb())
+	tree.bloomFilter = bloomFilter
 	return tree, nil
 }
 
+// Close persists the metadata, closes the WAL and releases the directory lock.
+// A read-only tree has nothing to release. Closing a closed tree does
+// nothing.
+func (t *Tree) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.unpublishExpvar()
+	if t.secondary != nil {
+		return t.secondary.close()
+	}
+	if t.readOnly {
+		return nil
+	}
+	for _, tree := range t.familyTrees() {
+		err := tree.saveMetadata()
+		if err != nil {
+			return err
+		}
+	}
+	err := t.appendLog.Close()
+	if err != nil {
+		return err
+	}
+	t.opts.Logger.Info("tree closed", "dir", t.segmentsDirectory, "segments", len(t.segments))
+	t.closeInfoLog()
+	t.closed = true
+	return t.lock.release()
+}
+
+// closeInfoLog closes the LOG file, the records logged afterwards only go
+// to the Logger option.
+func (t *Tree) closeInfoLog() {
+	if t.infoLog != nil {
+		t.infoLog.Close()
+		t.infoLog = nil
+	}
+}
+
 func (t *Tree) Set(key, value string) error {
-	entry := t.toLogEntry(key, value)
-	node := t.memtable.Get(key)
-	if node != nil {
-		if err := t.appendLog.WriteString(entry); err != nil {
+	return t.put(&record{key: key, value: value})
+}
+
+// SetWithTTL sets key to value for ttl, the key then reads as absent and is
+// dropped by the next compaction.
+func (t *Tree) SetWithTTL(key, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive: %s", ttl)
+	}
+	expireAt := t.opts.Clock.Now().Add(ttl).UnixNano()
+	return t.put(&record{key: key, value: value, expireAt: expireAt})
+}
+
+// Delete removes key, deleting an absent key is not an error.
+func (t *Tree) Delete(key string) error {
+	return t.put(&record{key: key, kind: kindDelete})
+}
+
+func (t *Tree) put(rec *record) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	defer t.observeWrite("put", time.Now())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.putLocked(rec)
+}
+
+// putLocked writes rec, t.mu must be held.
+func (t *Tree) putLocked(rec *record) error {
+	if err := t.checkFamily(); err != nil {
+		return err
+	}
+	rec.cf = t.cfID
+	t.stats.sets.add(1)
+	if t.memtable.Get(rec.key) == nil {
+		additionalSize := len(rec.key) + sizeof(rec.memtableValue())
+		if t.memtable.GetTotalSize()+additionalSize > t.threshold {
+			if err := t.flushForWrite(); err != nil {
+				return err
+			}
+		}
+	}
+	// numbered after the stall, whose flush doesn't hold rec
+	rec.seq = t.root().nextSequence()
+	if err := t.writeLog(rec.encode()); err != nil {
+		return err
+	}
+	return t.applyRecord(rec)
+}
+
+// applyRecord applies a record of the WAL to the memtable.
+func (t *Tree) applyRecord(rec *record) error {
+	switch rec.kind {
+	case kindMerge:
+		if t.opts.MergeOperator == nil {
+			return ErrNoMergeOperator
+		}
+		t.memtable.Set(rec.key, t.mergeInto(rec.key, rec.value))
+	case kindRangeDelete:
+		t.deleteRange(rangeTombstone{Start: rec.key, End: rec.value})
+	default:
+		t.memtable.Set(rec.key, rec.memtableValue())
+	}
+	return nil
+}
+
+// nextSequence numbers the next record written to the WAL, t must be the
+// root.
+func (t *Tree) nextSequence() uint64 {
+	t.lastSequence++
+	return t.lastSequence
+}
+
+// writeLog appends entry to the WAL, syncing it when SyncWrites is set.
+func (t *Tree) writeLog(entry string) error {
+	if c := t.root().walCipher; c != nil {
+		entry = c.sealLines(entry)
+	}
+	if err := t.appendLog.WriteString(entry); err != nil {
+		return err
+	}
+	if t.opts.SyncWrites {
+		return t.appendLog.Sync()
+	}
+	return nil
+}
+
+// flush writes the memtable of every column family to a new segment,
+// compacting the older segments according to the compaction strategy. The
+// families share the WAL, so it is cleared once all of them are flushed and
+// their metadata saved, so that secondaries and restarts never lose the
+// flushed keys.
+func (t *Tree) flush() error {
+	root := t.root()
+	for _, tree := range root.familyTrees() {
+		err := tree.flushMemtable()
+		if err != nil {
 			return err
 		}
-		t.memtable.Set(key, value)
+	}
+	err := root.resetWal()
+	if err != nil {
+		root.opts.Logger.Error("wal reset failed", "err", err)
+		info := BackgroundErrorInfo{ColumnFamily: DefaultColumnFamilyName, Reason: BackgroundErrorFlush, Err: err}
+		root.notify(func(l EventListener) { l.OnBackgroundError(info) })
+	}
+	return err
+}
+
+// resetWal clears the WAL of the flushed records, t must be the root.
+func (t *Tree) resetWal() error {
+	if t.opts.KeyProvider == nil {
+		return t.appendLog.Clear()
+	}
+	// every new log gets its own data key
+	c, err := newFileCipher(t.opts.KeyProvider)
+	if err != nil {
+		return err
+	}
+	err = t.appendLog.Reset(c.walHeader())
+	if err != nil {
+		return err
+	}
+	t.walCipher = c
+	return nil
+}
+
+// flushMemtable writes the memtable of t to a new segment.
+func (t *Tree) flushMemtable() (err error) {
+	if t.parent != nil && t.memtable.inner.Empty() && len(t.rangeTombstones) == 0 {
+		// nothing written to the column family since its last flush
 		return nil
 	}
-	additionalSize := len(key) + len(value)
-	if t.memtable.GetTotalSize()+additionalSize > t.threshold {
-		err := t.compact()
+	info := FlushInfo{ColumnFamily: t.columnFamilyName(), Keys: t.memtable.inner.Size()}
+	// stage tells what failed
+	stage := BackgroundErrorFlush
+	t.opts.Logger.Info("flushing memtable", "cf", info.ColumnFamily, "keys", info.Keys,
+		"bytes", t.memtable.GetTotalSize(), "range_tombstones", len(t.rangeTombstones),
+		"compaction", t.opts.CompactionStrategy)
+	t.notify(func(l EventListener) { l.OnFlushBegin(info) })
+	start := time.Now()
+	defer func() {
+		info.Duration = time.Since(start)
+		info.Err = err
+		t.notify(func(l EventListener) { l.OnFlushCompleted(info) })
+		if err != nil {
+			t.opts.Logger.Error("flush failed", "cf", info.ColumnFamily, "stage", stage, "err", err)
+			bgErr := BackgroundErrorInfo{ColumnFamily: info.ColumnFamily, Reason: stage, Err: err}
+			t.notify(func(l EventListener) { l.OnBackgroundError(bgErr) })
+			return
+		}
+		t.opts.Logger.Info("memtable flushed", "cf", info.ColumnFamily, "segment", info.Segment,
+			"bytes", info.Bytes, "segments", len(t.segments), "duration", info.Duration)
+		t.logIfSlow("flush", info.Duration, "cf", info.ColumnFamily)
+	}()
+
+	stage = BackgroundErrorCompaction
+	switch t.opts.CompactionStrategy {
+	case CompactionDeleteKeys:
+		err := t.compaction(CompactionReasonDeleteKeys, t.compact)
 		if err != nil {
 			return fmt.Errorf("compact err: %s", err)
 		}
-		err = t.flushMemtableToDisk(t.currentSegmentPath())
+		// the rewritten segments moved their keys
+		err = t.repopulateIndex()
 		if err != nil {
-			return fmt.Errorf("flushMemtableToDisk err: %s", err)
+			return fmt.Errorf("repopulate index err: %s", err)
 		}
-		t.memtable = NewSizedMap()
-		if err := t.appendLog.Clear(); err != nil {
-			return err
+	case CompactionMergeSegments:
+		// deletions are not flushed, so the merge can't drop the keys
+		err := t.compaction(CompactionReasonDeleteKeys, func() error {
+			return t.deleteKeysFromSegments(t.deletedKeys())
+		})
+		if err != nil {
+			return fmt.Errorf("delete keys err: %s", err)
 		}
-		t.segments = append(t.segments, t.currentSegment)
-		t.currentSegment = t.incrementedSegmentName()
 	}
-	if err := t.appendLog.WriteString(entry); err != nil {
+	// compaction handed the merge operands their base
+	err = t.resolveMerges()
+	if err != nil {
+		return fmt.Errorf("resolve merges err: %s", err)
+	}
+	stage = BackgroundErrorFlush
+	info.Segment, err = t.newSegmentName()
+	if err != nil {
 		return err
 	}
-	t.memtable.Set(key, value)
-	return nil
+	err = t.flushMemtableToDisk(info.Segment)
+	if err != nil {
+		return fmt.Errorf("flushMemtableToDisk err: %s", err)
+	}
+	t.memtable = NewSizedMapWithComparator(t.opts.Comparator)
+	t.rangeTombstones = nil
+	t.segments = append(t.segments, info.Segment)
+	info.Bytes = t.segmentsSize([]string{info.Segment})
+	t.stats.flushes.add(1)
+	t.stats.flushBytes.add(info.Bytes)
+
+	if t.opts.CompactionStrategy == CompactionMergeSegments {
+		stage = BackgroundErrorCompaction
+		err = t.compaction(CompactionReasonMergeSegments, t.mergeSegments)
+		if err != nil {
+			return fmt.Errorf("merge segments err: %s", err)
+		}
+		stage = BackgroundErrorFlush
+	}
+	// the WAL records written so far are in the segments
+	t.flushedSequence = t.root().lastSequence
+	err = t.saveMetadata()
+	if err != nil {
+		return err
+	}
+	return t.removeObsoleteSegments()
 }
 
+// Get returns the value of key, or ErrNotFound.
 func (t *Tree) Get(key string) (string, error) {
+	defer t.observeRead("get", time.Now())
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	val, found, err := t.get(key)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", ErrNotFound
+	}
+	return val, nil
+}
+
+// Has tells whether key is present, a bloom filter miss answers without
+// reading any segment. Values are not decoded nor merged.
+func (t *Tree) Has(key string) (bool, error) {
+	defer t.observeRead("has", time.Now())
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	t.stats.gets.add(1)
+	now := t.opts.Clock.Now()
 	if got := t.memtable.Get(key); got != nil {
-		return got.(string), nil
+		t.stats.memtableHits.add(1)
+		if m, ok := got.(*mergeEntry); ok {
+			// operands always merge into a value, which expires with its base
+			return m.ExpireAt == 0 || m.ExpireAt > now.UnixNano(), nil
+		}
+		_, found := t.liveValue(recordFromMemtable(key, got))
+		return found, nil
+	}
+	if t.rangeDeleted(key) {
+		return false, nil
 	}
+	if !t.bloomFilter.Check(key) {
+		t.stats.bloomUseful.add(1)
+		return false, nil
+	}
+	for i := len(t.segments) - 1; i >= 0; i-- {
+		t.stats.segmentReads.add(1)
+		block, err := t.segmentBlock(t.segments[i])
+		if err != nil {
+			return false, err
+		}
+		line, err := block.search(key, t.opts.Comparator)
+		if err != nil {
+			return false, err
+		}
+		if line != nil {
+			_, _, attrs, _ := splitLine(line)
+			return liveLine(attrs, now)
+		}
+		if coveredBy(t.segmentTombstones[t.segments[i]], key, t.opts.Comparator) {
+			return false, nil
+		}
+	}
+	t.stats.bloomFalsePositives.add(1)
+	return false, nil
+}
 
+// get returns the live value of key, found is false when key is absent or
+// has expired.
+func (t *Tree) get(key string) (string, bool, error) {
+	t.stats.gets.add(1)
+	if got := t.memtable.Get(key); got != nil {
+		t.stats.memtableHits.add(1)
+		return t.resolve(key, got)
+	}
+	if t.rangeDeleted(key) {
+		return "", false, nil
+	}
+	return t.getFromSegments(key)
+}
+
+// resolve returns the live value of the memtable value v of key, merge
+// operands are applied to their base value.
+func (t *Tree) resolve(key string, v any) (string, bool, error) {
+	if m, ok := v.(*mergeEntry); ok {
+		return t.fullMerge(key, m)
+	}
+	val, found := t.liveValue(recordFromMemtable(key, v))
+	return val, found, nil
+}
+
+// getFromSegments returns the live value of key in the segments.
+func (t *Tree) getFromSegments(key string) (string, bool, error) {
+	rec, err := t.findRecord(key)
+	if err != nil || rec == nil {
+		return "", false, err
+	}
+	val, found := t.liveValue(rec)
+	return val, found, nil
+}
+
+// findRecord returns the record of key in the segments, nil when absent.
+func (t *Tree) findRecord(key string) (*record, error) {
 	if !t.bloomFilter.Check(key) {
-		return "", nil
+		t.stats.bloomUseful.add(1)
+		return nil, nil
 	}
+	rec, err := t.searchRecord(key)
+	if err == nil && rec == nil {
+		t.stats.bloomFalsePositives.add(1)
+	}
+	return rec, err
+}
+
+// searchRecord looks key up in the segment the sparse index points to,
+// then in every segment.
+func (t *Tree) searchRecord(key string) (*record, error) {
 	// 1. floor key => key1
 	// 2. key1 => val1
-	floorKey := t.index.FloorKey(keyType(key))
+	floorKey := t.index.FloorKey(t.index.key(key))
 	if floorKey == nil {
 		return t.searchAllSegments(key)
 	}
@@ -136,51 +642,70 @@ func (t *Tree) Get(key string) (string, error) {
 		return t.searchAllSegments(key)
 	}
 	item := val.(*indexItem)
-	segment := item.Segment
-	offset := item.Offset
-	path := t.segmentPath(segment)
-
-	reader, err := NewLineReader(path, offset)
+	t.stats.segmentReads.add(1)
+	reader, err := t.openSegment(item.Segment, item.Offset)
 	if err != nil {
-		return "", fmt.Errorf("can't open segment file: %s", err)
+		return nil, fmt.Errorf("can't open segment file: %s", err)
 	}
 	defer reader.Close()
 
 	for {
-		ikey, ival, err := reader.ReadLineKV()
+		line, err := reader.ReadLine()
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			return "", fmt.Errorf("read segment file err: %s", err)
+			return nil, fmt.Errorf("read segment file err: %s", err)
 		}
-		if ikey == key {
-			return ival, nil
+		rec, err := decodeRecord(line)
+		if err != nil {
+			return nil, fmt.Errorf("read segment file err: %s", err)
+		}
+		if rec.key == key {
+			if t.rangeDeletedAfter(key, item.Segment) {
+				// a newer segment may hold the key again
+				break
+			}
+			return rec, nil
 		}
 	}
 	return t.searchAllSegments(key)
 }
 
-func (t *Tree) searchAllSegments(key string) (string, error) {
+// liveValue returns the value of rec, or "" and false once it has expired
+// or when rec deletes its key.
+func (t *Tree) liveValue(rec *record) (string, bool) {
+	if rec.kind == kindDelete || rec.expired(t.opts.Clock.Now()) {
+		return "", false
+	}
+	return rec.value, true
+}
+
+// searchAllSegments looks key up in every segment, newest first, until a
+// range tombstone masks it in the older ones.
+func (t *Tree) searchAllSegments(key string) (*record, error) {
 	// TODO 优化，缓存 segments 文件
-	for _, segment := range t.segments {
-		val, err := t.binarySearchSegment(key, segment)
+	for i := len(t.segments) - 1; i >= 0; i-- {
+		rec, err := t.binarySearchRecord(key, t.segments[i])
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		if val != "" {
-			return val, nil
+		if rec != nil {
+			return rec, nil
+		}
+		if coveredBy(t.segmentTombstones[t.segments[i]], key, t.opts.Comparator) {
+			return nil, nil
 		}
 	}
-	return "", nil
+	return nil, nil
 }
 
 func (t *Tree) searchSegment(key, segment string) (string, error) {
 	path := t.segmentPath(segment)
 	val := ""
-	err := t.iterLineOfSegmentFile(path, func(ikey, ival string) (bool, error) {
-		if ikey == key {
-			val = ival
+	err := t.iterLineOfSegmentFile(path, func(rec *record) (bool, error) {
+		if rec.key == key && rec.kind != kindRangeDelete {
+			val, _ = t.liveValue(rec)
 			return true, nil
 		}
 		return false, nil
@@ -190,54 +715,73 @@ func (t *Tree) searchSegment(key, segment string) (string, error) {
 
 // binarySearchSegment searchSegment 优化版
 func (t *Tree) binarySearchSegment(key, segment string) (string, error) {
+	rec, err := t.binarySearchRecord(key, segment)
+	if err != nil || rec == nil {
+		return "", err
+	}
+	val, _ := t.liveValue(rec)
+	return val, nil
+}
+
+// binarySearchRecord returns the record of key in segment, nil when absent.
+func (t *Tree) binarySearchRecord(key, segment string) (*record, error) {
+	t.stats.segmentReads.add(1)
 	// 一次性全部读出来然后二分，因为 segment 文件是有序的
-	path := t.segmentPath(segment)
-	file, err := os.OpenFile(path, os.O_RDONLY, 0666)
+	block, err := t.segmentBlock(segment)
 	if err != nil {
-		return "", fmt.Errorf("open file err: %s", err)
+		return nil, err
 	}
-	defer file.Close()
-
-	allBytes, err := ioutil.ReadAll(file)
+	line, err := block.search(key, t.opts.Comparator)
 	if err != nil {
-		return "", fmt.Errorf("read file err: %s", err)
+		return nil, fmt.Errorf("segment file data format err, %s", err)
 	}
-	// bytes to string without memory copy
-	content := *(*string)(unsafe.Pointer(&allBytes))
-	lines := strings.Split(content, "\n")
-	if len(lines) == 0 {
-		return "", nil
+	if line == nil {
+		return nil, nil
 	}
-	lines = lines[:len(lines)-1] // remove last ""
+	return decodeRecord(string(line))
+}
 
-	for len(lines) > 0 {
-		ptr := (len(lines) - 1) / 2
-		parts := strings.Split(lines[ptr], ",")
-		if len(parts) != 2 {
-			return "", fmt.Errorf("segment file data format err, %v", parts)
-		}
-		if parts[0] == key {
-			return parts[1], nil
-		}
+// segmentBlock returns the content of segment, through the cache.
+func (t *Tree) segmentBlock(segment string) (*segmentBlock, error) {
+	block, _, err := t.cachedSegmentBlock(segment)
+	return block, err
+}
 
-		if key < parts[0] {
-			lines = lines[0:ptr]
-		} else {
-			lines = lines[ptr+1:]
-		}
+// cachedSegmentBlock returns the content of segment, cached tells whether
+// it was found in the cache.
+func (t *Tree) cachedSegmentBlock(segment string) (block *segmentBlock, cached bool, err error) {
+	path := t.segmentPath(segment)
+	if block, ok := t.cache.GetBlock(path); ok {
+		return block, true, nil
 	}
-
-	return "", nil
+	data, err := t.readSegment(segment)
+	if err != nil {
+		return nil, false, err
+	}
+	block = newSegmentBlock(data)
+	t.cache.PutBlock(path, block)
+	return block, false, nil
 }
 
-type iterFunc func(key, val string) (bool, error)
+type iterFunc func(rec *record) (bool, error)
 
 func (t *Tree) iterLineOfSegmentFile(path string, callback iterFunc) error {
-	reader, err := NewLineReader(path, 0)
+	reader, err := t.openSegmentFile(path, 0)
+	if err != nil {
+		return err
+	}
+	return t.iterLines(reader, callback)
+}
+
+func (t *Tree) iterLineOfSegment(segment string, callback iterFunc) error {
+	reader, err := t.openSegment(segment, 0)
 	if err != nil {
 		return err
 	}
+	return t.iterLines(reader, callback)
+}
 
+func (t *Tree) iterLines(reader *LineReader, callback iterFunc) error {
 	defer reader.Close()
 
 	for {
@@ -248,11 +792,11 @@ func (t *Tree) iterLineOfSegmentFile(path string, callback iterFunc) error {
 			}
 			return fmt.Errorf("read file err: %s", err)
 		}
-		parts := strings.Split(line, ",")
-		if len(parts) != 2 {
-			return fmt.Errorf("segment file data err: %v", parts)
+		rec, err := decodeRecord(line)
+		if err != nil {
+			return fmt.Errorf("segment file data err: %s", err)
 		}
-		done, err := callback(parts[0], parts[1])
+		done, err := callback(rec)
 		if err != nil {
 			return err
 		}
@@ -269,139 +813,380 @@ func (t *Tree) compact() error {
 	if !t.memtable.inner.Empty() {
 		iter := t.memtable.inner.Iterator()
 		for iter != nil {
-			k := iter.Key.(keyType)
-			if t.bloomFilter.Check(string(k)) {
-				keysOnDisk[string(k)] = struct{}{}
+			k := iter.Key.(keyType).key
+			if t.bloomFilter.Check(k) {
+				keysOnDisk[k] = struct{}{}
 			}
 			iter = iter.Next()
 		}
 	}
 
-	return t.deleteKeysFromSegments(keysOnDisk, t.segments)
+	return t.deleteKeysFromSegments(keysOnDisk)
 }
 
-func (t *Tree) deleteKeysFromSegments(deletionKeys map[string]struct{},
-	segments []string) error {
-	for _, segment := range segments {
-		segmentPath := t.segmentPath(segment)
-		err := t.deleteKeysFromSegment(deletionKeys, segmentPath)
+// deletedKeys returns the keys the memtable deletes, and the keys of its
+// merge operands whose base may be in the segments: compaction removes it
+// and hands it to them.
+func (t *Tree) deletedKeys() map[string]struct{} {
+	keys := map[string]struct{}{}
+	if t.memtable.inner.Empty() {
+		return keys
+	}
+	for iter := t.memtable.inner.Iterator(); iter != nil; iter = iter.Next() {
+		switch v := iter.Value.(type) {
+		case *deletedEntry:
+			keys[iter.Key.(keyType).key] = struct{}{}
+		case *mergeEntry:
+			if !v.HasBase && t.bloomFilter.Check(iter.Key.(keyType).key) {
+				keys[iter.Key.(keyType).key] = struct{}{}
+			}
+		}
+	}
+	return keys
+}
+
+// deleteKeysFromSegments rewrites the segments holding deletionKeys. The
+// values the merge operands of the memtable apply to are handed to them as
+// they are removed.
+func (t *Tree) deleteKeysFromSegments(deletionKeys map[string]struct{}) error {
+	bases := map[string]*record{}
+	segments := append([]string(nil), t.segments...)
+	var err error
+	// newest first, the operands apply to the newest value
+	for i := len(segments) - 1; i >= 0; i-- {
+		var rewritten string
+		rewritten, err = t.deleteKeysFromSegment(deletionKeys, segments[i], bases)
 		if err != nil {
-			return err
+			// the segments rewritten so far stay in use
+			break
+		}
+		if rewritten != segments[i] {
+			t.obsolete = append(t.obsolete, segments[i])
+			segments[i] = rewritten
 		}
 	}
-	return nil
+	t.segments = t.segments[:0]
+	for _, segment := range segments {
+		if segment != "" {
+			t.segments = append(t.segments, segment)
+		}
+	}
+	// the bases removed so far are no longer in the segments
+	t.setMergeBases(bases)
+	return err
 }
 
+// deleteKeysFromSegment writes the records of segment left once deletionKeys
+// are deleted and compaction applied to a new segment, whose name it
+// returns. A segment left unchanged is kept and its name returned, a segment
+// left without records is dropped and "" returned. The records masked by a
+// range tombstone are only dropped when the segment is rewritten anyway,
+// the tombstones of the oldest segment likewise. The deleted records the
+// unresolved merge operands of the memtable apply to are added to bases,
+// unless a newer segment already gave one, nil for an expired record; bases
+// may be nil.
 func (t *Tree) deleteKeysFromSegment(deletionKeys map[string]struct{},
-	segmentPath string) error {
-	tempPath := segmentPath + "_temp"
-	output, err := os.Create(tempPath)
+	segment string, bases map[string]*record) (string, error) {
+	rewritten, err := t.newSegmentName()
+	if err != nil {
+		return "", err
+	}
+	output, err := t.createSegment(t.segmentPath(rewritten))
 	if err != nil {
-		return fmt.Errorf("open segment temp file err: %s", err)
+		return "", fmt.Errorf("open segment file err: %s", err)
 	}
 
-	err = t.iterLineOfSegmentFile(segmentPath, func(ikey, ival string) (bool, error) {
-		_, ok := deletionKeys[ikey]
-		if !ok {
-			_, err = output.WriteString(t.toLogEntry(ikey, ival))
+	changed := false
+	// the tombstones of the oldest segment mask nothing
+	bottom := len(t.segments) > 0 && t.segments[0] == segment
+	var tombstones []rangeTombstone
+	records := 0
+	now := t.opts.Clock.Now()
+	level := t.segmentLevel(segment)
+	err = t.iterLineOfSegment(segment, func(rec *record) (bool, error) {
+		if rec.kind == kindRangeDelete {
+			if bottom {
+				return false, nil
+			}
+			tombstones = append(tombstones, rangeTombstone{Start: rec.key, End: rec.value})
+			return false, output.WriteString(rec.encode())
+		}
+		masked := t.rangeDeleted(rec.key) || t.rangeDeletedAfter(rec.key, segment)
+		if _, ok := deletionKeys[rec.key]; ok {
+			if _, seen := bases[rec.key]; !seen && !masked && bases != nil && t.unresolvedMerge(rec.key) {
+				base := rec
+				if _, found := t.liveValue(rec); !found {
+					base = nil
+				}
+				bases[rec.key] = base
+			}
+			changed = true
+			return false, nil
+		}
+		if masked {
+			return false, nil
+		}
+		compacted, err := t.compactRecord(rec, level, now)
+		if err != nil {
+			return false, err
+		}
+		if compacted != rec {
+			changed = true
+		}
+		if compacted != nil {
+			records++
+			err = output.WriteString(compacted.encode())
 			if err != nil {
-				return false, fmt.Errorf("write segment temp file err: %s", err)
+				return false, fmt.Errorf("write segment file err: %s", err)
 			}
 		}
 		return false, nil
 	})
 	if err != nil {
-		return err
+		output.file.Close()
+	} else {
+		err = output.Close()
 	}
-
-	err = output.Sync()
 	if err != nil {
-		return fmt.Errorf("flush file err: %s", err)
+		// nothing references the unfinished file
+		t.opts.FS.Remove(output.path)
+		return "", err
 	}
-	err = output.Close()
-	if err != nil {
-		return fmt.Errorf("close file err: %s", err)
+	dropped := records == 0 && len(tombstones) == 0
+	if dropped || !changed {
+		// nothing references the new file yet
+		err = t.opts.FS.Remove(t.segmentPath(rewritten))
+		if err != nil {
+			return "", fmt.Errorf("remove segment file err: %s", err)
+		}
+		if dropped {
+			return "", nil
+		}
+		return segment, nil
+	}
+	if len(tombstones) > 0 {
+		t.segmentTombstones[rewritten] = tombstones
 	}
+	t.segmentKeys[rewritten] = records
+	return rewritten, nil
+}
 
-	err = os.Remove(segmentPath)
-	if err != nil {
-		return fmt.Errorf("remove segment file err: %s", err)
+// removeObsoleteSegments deletes the segments replaced by compactions, once
+// the saved metadata no longer references them.
+func (t *Tree) removeObsoleteSegments() error {
+	for len(t.obsolete) > 0 {
+		path := t.segmentPath(t.obsolete[0])
+		t.cache.Evict(path)
+		err := t.opts.FS.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove segment file err: %s", err)
+		}
+		if err == nil {
+			t.segmentDeleted(t.obsolete[0], false)
+		}
+		delete(t.segmentTombstones, t.obsolete[0])
+		delete(t.segmentKeys, t.obsolete[0])
+		t.obsolete = t.obsolete[1:]
 	}
-	err = os.Rename(tempPath, segmentPath)
+	return nil
+}
+
+// removeOrphanFiles deletes what a crash left in the directory of t: the
+// temporary files, the segments numbered from the saved next file number
+// on, compaction outputs or flushes never installed, and the segments the
+// saved metadata lists as replaced but which were not removed yet. Other
+// files are left alone, whatever their name.
+func (t *Tree) removeOrphanFiles() error {
+	infos, err := t.opts.FS.ReadDir(t.segmentsDirectory)
 	if err != nil {
-		return fmt.Errorf("rename segment file err: %s", err)
+		return fmt.Errorf("read dir: %s err: %s", t.segmentsDirectory, err)
+	}
+	live := map[string]bool{}
+	for _, segment := range t.segments {
+		live[segment] = true
+	}
+	obsolete := map[string]bool{}
+	for _, segment := range t.obsolete {
+		obsolete[segment] = true
+	}
+	t.obsolete = nil
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || live[name] || !obsolete[name] && !t.isOrphanFile(name) {
+			continue
+		}
+		t.opts.Logger.Info("removing orphan file", "dir", t.segmentsDirectory, "file", name)
+		err = t.opts.FS.Remove(t.segmentPath(name))
+		if err != nil {
+			return fmt.Errorf("remove orphan file: %s err: %s", name, err)
+		}
+		if t.isSegmentName(name) {
+			t.segmentDeleted(name, true)
+		}
 	}
 	return nil
 }
 
-func (t *Tree) flushMemtableToDisk(path string) error {
+// isOrphanFile tells whether name, which the metadata doesn't reference, is
+// a temporary file or a segment numbered after the saved metadata was.
+// Temporary segments were called temp and <segment>_temp before compactions
+// wrote new segments.
+func (t *Tree) isOrphanFile(name string) bool {
+	if name == "temp" || strings.HasSuffix(name, "_temp") || strings.HasSuffix(name, ".tmp") {
+		return true
+	}
+	num, ok := parseSegmentFileName(name)
+	return ok && num >= t.nextFileNumber
+}
+
+// importLegacySegments adopts the segments of a tree written before the
+// metadata was saved, named from SegmentBasename, the oldest first. Their
+// keys are indexed and added to the bloom filter.
+func (t *Tree) importLegacySegments() error {
+	infos, err := t.opts.FS.ReadDir(t.segmentsDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read dir: %s err: %s", t.segmentsDirectory, err)
+	}
+	prefix := t.legacySegmentPrefix()
+	nums := map[string]uint64{}
+	var segments []string
+	for _, info := range infos {
+		name := info.Name()
+		p, num, ok := parseLegacySegmentName(name)
+		if info.IsDir() || !ok || p != prefix {
+			continue
+		}
+		nums[name] = num
+		segments = append(segments, name)
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+	sort.Slice(segments, func(i, j int) bool { return nums[segments[i]] < nums[segments[j]] })
+	for _, segment := range segments {
+		records := 0
+		err = t.iterLineOfSegment(segment, func(rec *record) (bool, error) {
+			if rec.kind != kindRangeDelete {
+				t.bloomFilter.Add(rec.key)
+				records++
+			}
+			return false, nil
+		})
+		if err != nil {
+			return err
+		}
+		t.segmentKeys[segment] = records
+	}
+	t.segments = segments
+	t.opts.Logger.Info("legacy segments imported", "dir", t.segmentsDirectory, "segments", len(segments))
+	return t.repopulateIndex()
+}
+
+// flushMemtableToDisk writes the memtable to the new segment, its range
+// tombstones first when there are older segments for them to mask.
+func (t *Tree) flushMemtableToDisk(segment string) error {
+	path := t.segmentPath(segment)
 	sparsityCounter := t.sparsity()
 	var keyOffset int64 = 0
-	file, err := os.Create(path) // 0666
+	records := 0
+	t.cache.Evict(path)
+	file, err := t.createSegment(path)
 	if err != nil {
-		return fmt.Errorf("open file: %s err: %s", path, err)
+		return err
+	}
+	if len(t.segments) > 0 && len(t.rangeTombstones) > 0 {
+		for _, tombstone := range t.rangeTombstones {
+			entry := tombstone.record().encode()
+			err := file.WriteString(entry)
+			if err != nil {
+				file.Close()
+				return err
+			}
+			keyOffset += int64(len(entry))
+		}
+		t.segmentTombstones[segment] = append([]rangeTombstone(nil), t.rangeTombstones...)
 	}
 	if !t.memtable.inner.Empty() {
 		iter := t.memtable.inner.Iterator()
-		for iter != nil {
-			k := iter.Key.(keyType)
-			v := iter.Value.(string)
-			entry := t.toLogEntry(string(k), v)
+		for ; iter != nil; iter = iter.Next() {
+			k := iter.Key.(keyType).key
+			rec := recordFromMemtable(k, iter.Value)
+			if rec.kind == kindDelete {
+				continue
+			}
+			v := rec.value
+			entry := rec.encode()
 			if sparsityCounter == 1 {
-				if n := t.index.Find(k); n != nil {
+				if n := t.index.Find(t.index.key(k)); n != nil {
 					pre := n.(*indexItem)
-					t.index.Insert(k, &indexItem{
+					t.index.Insert(t.index.key(k), &indexItem{
 						Segment: pre.Segment,
 						Offset:  pre.Offset,
 						Val:     v,
 					})
 				} else {
-					t.index.Insert(k, &indexItem{
-						Segment: t.currentSegment,
+					t.index.Insert(t.index.key(k), &indexItem{
+						Segment: segment,
 						Offset:  keyOffset,
 						Val:     v,
 					})
 				}
 				sparsityCounter = t.sparsity() + 1
 			}
-			t.bloomFilter.Add(string(k))
-			_, err := file.WriteString(entry)
+			t.bloomFilter.Add(k)
+			err := file.WriteString(entry)
 			if err != nil {
-				return fmt.Errorf("write %s err: %s", path, err)
+				file.Close()
+				return err
 			}
 			keyOffset += int64(len(entry))
 			sparsityCounter -= 1
-
-			iter = iter.Next()
+			records++
 		}
 	}
+	t.segmentKeys[segment] = records
 
-	err = file.Sync()
-	if err != nil {
-		return fmt.Errorf("flush file err: %s", err)
-	}
-	err = file.Close()
-	if err != nil {
-		return fmt.Errorf("close file err: %s", err)
-	}
-	return nil
+	return file.Close()
 }
 
 func (t *Tree) loadMetadata() error {
 	path := t.metadataPath()
-	if _, err := os.Stat(path); err != nil && os.IsNotExist(err) {
-		return nil
+	if !fileExists(t.opts.FS, path) {
+		return t.importLegacySegments()
 	}
-	bytes, err := ioutil.ReadFile(path)
+	bytes, err := readFile(t.opts.FS, path)
 	if err != nil {
 		return fmt.Errorf("read meta data err: %s", err)
 	}
+	bytes, err = t.openFile(bytes)
+	if err != nil {
+		t.opts.Logger.Error("metadata unreadable", "path", path, "err", err)
+		return fmt.Errorf("read meta data err: %w", err)
+	}
+	return t.applyMetadata(bytes)
+}
+
+func (t *Tree) applyMetadata(bytes []byte) error {
 	meta := &treeMetadata{}
-	err = meta.load(bytes)
+	err := meta.load(bytes)
+	if err != nil {
+		return err
+	}
+	comparator := meta.Comparator
+	if comparator == "" {
+		comparator = BytewiseComparator{}.Name()
+	}
+	if comparator != t.opts.Comparator.Name() {
+		return fmt.Errorf("%w: tree ordered by %s, opened with %s",
+			ErrComparatorMismatch, comparator, t.opts.Comparator.Name())
+	}
 
-	t.index = rbtree.NewTree()
+	t.index = newOrderedTree(t.opts.Comparator)
 	for k, v := range meta.Index {
-		t.index.Insert(keyType(k), v)
+		t.index.Insert(t.index.key(k), v)
 	}
 
 	t.bloomFilter = &BloomFilter{}
@@ -411,173 +1196,349 @@ func (t *Tree) loadMetadata() error {
 	}
 
 	t.segments = meta.Segments
-	t.currentSegment = meta.CurrentSegment
+	t.segmentTombstones = meta.SegmentTombstones
+	if t.segmentTombstones == nil {
+		t.segmentTombstones = map[string][]rangeTombstone{}
+	}
+	t.segmentKeys = meta.SegmentKeys
+	if t.segmentKeys == nil {
+		t.segmentKeys = map[string]int{}
+	}
+	t.obsolete = meta.ObsoleteSegments
+	t.flushedSequence = meta.FlushedSequence
+	// trees written before segments were numbered named them from
+	// CurrentSegment, new names never collide with theirs
+	t.nextFileNumber = meta.NextFileNumber
+	if t.nextFileNumber == 0 {
+		t.nextFileNumber = 1
+	}
+	if t.families != nil {
+		t.families.load(meta)
+	}
 
 	return nil
 }
 
 func (t *Tree) saveMetadata() error {
+	bytes, err := t.dumpMetadata()
+	if err == nil {
+		bytes, err = t.sealFile(bytes)
+	}
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomically(t.opts.FS, t.metadataPath(), bytes)
+	if err != nil {
+		return fmt.Errorf("write file err: %s", err)
+	}
+	return nil
+}
+
+func (t *Tree) dumpMetadata() ([]byte, error) {
 	indexMap := map[string]*indexItem{}
 	if !t.index.Empty() {
 		iter := t.index.Iterator()
 		for iter != nil {
-			k := iter.Key.(keyType)
-			indexMap[string(k)] = iter.Value.(*indexItem)
+			k := iter.Key.(keyType).key
+			indexMap[k] = iter.Value.(*indexItem)
 			iter = iter.Next()
 		}
 	}
 	bloom := t.bloomFilter.Pack()
 	m := &treeMetadata{
-		Segments:       t.segments,
-		CurrentSegment: t.currentSegment,
-		Index:          indexMap,
-		BloomFilter:    bloom,
+		Segments:        t.segments,
+		NextFileNumber:  t.nextFileNumber,
+		Index:           indexMap,
+		BloomFilter:     bloom,
+		Comparator:      t.opts.Comparator.Name(),
+		FlushedSequence: t.flushedSequence,
+		// removed on open when a crash keeps them from being removed now
+		ObsoleteSegments: t.obsolete,
 	}
-	bytes, err := m.dump()
-	if err != nil {
-		return err
+	for _, segment := range t.segments {
+		if tombstones, ok := t.segmentTombstones[segment]; ok {
+			if m.SegmentTombstones == nil {
+				m.SegmentTombstones = map[string][]rangeTombstone{}
+			}
+			m.SegmentTombstones[segment] = tombstones
+		}
+		if keys, ok := t.segmentKeys[segment]; ok {
+			if m.SegmentKeys == nil {
+				m.SegmentKeys = map[string]int{}
+			}
+			m.SegmentKeys[segment] = keys
+		}
 	}
-	err = ioutil.WriteFile(t.metadataPath(), bytes, 0666)
-	if err != nil {
-		return fmt.Errorf("write file err: %s", err)
+	if t.families != nil {
+		t.families.dump(m)
 	}
-	return nil
+	return m.dump()
 }
 
 func (t *Tree) restoreMemtable() error {
+	// new records are numbered after the flushed ones, and after the ones
+	// replayed below
+	for _, tree := range t.familyTrees() {
+		if tree.flushedSequence > t.lastSequence {
+			t.lastSequence = tree.flushedSequence
+		}
+	}
 	path := t.memtableWalPath()
-	if _, err := os.Stat(path); err != nil && os.IsNotExist(err) {
+	if !fileExists(t.opts.FS, path) {
 		return nil
 	}
 
-	err := t.iterLineOfSegmentFile(path, func(key, val string) (bool, error) {
-		t.memtable.Set(key, val)
-		return false, nil
-	})
-
-	return err
-}
-
-func (t *Tree) merge(segment1, segment2 string) error {
-	path1 := t.segmentsDirectory + segment1
-	path2 := t.segmentsDirectory + segment2
-	newPath := t.segmentsDirectory + "temp"
-	var (
-		line1, line2 string
-		err          error
-	)
-	writer, err := os.OpenFile(newPath, os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		return fmt.Errorf("open file err: %s", err)
-	}
-
-	reader1, err := NewLineReader(path1, 0)
+	reader, err := newLineReader(t.opts.FS, path, 0)
 	if err != nil {
 		return err
 	}
-	reader2, err := NewLineReader(path2, 0)
+	consumed, err := t.replayWal(reader)
 	if err != nil {
+		t.opts.Logger.Error("wal corrupted", "path", path, "offset", consumed, "err", err)
 		return err
 	}
-	line1, err = reader1.ReadLine()
-	if err != nil && !errors.Is(err, io.EOF) {
-		return err
-	}
-	line2, err = reader2.ReadLine()
-	if err != nil && !errors.Is(err, io.EOF) {
-		return err
+	info, err := t.opts.FS.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat wal err: %s", err)
 	}
-	for {
-		if line1 == "" && line2 == "" {
-			break
-		}
-		parts1 := strings.Split(line1, ",")
-		parts2 := strings.Split(line2, ",")
-		key1 := parts1[0]
-		key2 := parts2[0]
-		if key1 == "" || key1 == key2 {
-			_, err = writer.WriteString(line2 + "\n")
+	if dropped := info.Size() - consumed; dropped > 0 {
+		t.opts.Logger.Warn("wal torn tail dropped", "path", path, "offset", consumed, "bytes", dropped)
+		if !t.readOnly {
+			// the records appended from now on must not extend the torn one
+			err = t.appendLog.truncate(consumed)
 			if err != nil {
-				return fmt.Errorf("write file err: %s", err)
-			}
-			line1, err = reader1.ReadLine()
-			if err != nil && !errors.Is(err, io.EOF) {
-				return err
-			}
-			line2, err = reader2.ReadLine()
-			if err != nil && !errors.Is(err, io.EOF) {
 				return err
 			}
-		} else if key2 == "" || key1 < key2 {
-			_, err = writer.WriteString(line1 + "\n")
-			if err != nil && !errors.Is(err, io.EOF) {
-				return fmt.Errorf("write file err: %s", err)
-			}
-			line1, err = reader1.ReadLine()
-			if err != nil && !errors.Is(err, io.EOF) {
-				return err
+		}
+	}
+	t.opts.Logger.Info("wal replayed", "path", path, "bytes", consumed)
+	return nil
+}
+
+// replayWal applies the complete records of reader to the memtables of
+// their column family and returns the number of bytes they span. A torn
+// last line, or the records of a WriteBatch torn before its end, are left
+// out: a torn batch followed by other records is skipped, at the end of the
+// log its records are not consumed.
+func (t *Tree) replayWal(reader *LineReader) (int64, error) {
+	defer reader.Close()
+
+	var (
+		consumed int64
+		batch    []*record
+		size     int64
+	)
+	dropBatch := func() {
+		if len(batch) > 0 {
+			t.opts.Logger.Warn("wal torn batch dropped", "offset", consumed, "records", len(batch))
+			consumed += size
+			batch, size = batch[:0], 0
+		}
+	}
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
 			}
-		} else {
-			_, err = writer.WriteString(line2 + "\n")
+			return consumed, fmt.Errorf("read wal err: %s", err)
+		}
+		lineSize := int64(len(line)) + 1
+		line, t.walCipher, err = t.openWalLine(line, t.walCipher)
+		if err != nil {
+			return consumed, fmt.Errorf("wal data err: %w", err)
+		}
+		if line == "" {
+			// a key header, never written inside a batch
+			dropBatch()
+			consumed += lineSize
+			continue
+		}
+		rec, err := decodeRecord(line)
+		if err != nil {
+			return consumed, fmt.Errorf("wal data err: %s", err)
+		}
+		if rec.seq > t.lastSequence {
+			// the numbers of the dropped records aren't given again
+			t.lastSequence = rec.seq
+		}
+		if len(batch) > 0 && rec.batch != batch[0].batch {
+			dropBatch()
+		}
+		batch = append(batch, rec)
+		size += lineSize
+		if rec.batch != 0 && rec.seq != rec.batch {
+			// the rest of the batch is still to come
+			continue
+		}
+		for _, rec := range batch {
+			err = t.applyWalRecord(rec)
 			if err != nil {
-				return fmt.Errorf("write file err: %s", err)
-			}
-			line2, err = reader2.ReadLine()
-			if err != nil && !errors.Is(err, io.EOF) {
-				return err
+				return consumed, fmt.Errorf("wal record of key: %s err: %w", rec.key, err)
 			}
 		}
+		consumed += size
+		batch, size = batch[:0], 0
 	}
+	return consumed, nil
+}
 
-	err = writer.Sync()
+// applyWalRecord applies rec to the memtable of its column family, records
+// of dropped families are skipped, and so are the ones a flush already
+// wrote to the segments, whose WAL was not cleared before a crash: merge
+// operands must not be applied twice.
+func (t *Tree) applyWalRecord(rec *record) error {
+	if rec.seq > t.lastSequence {
+		t.lastSequence = rec.seq
+	}
+	target := t.familyTree(rec.cf)
+	if target == nil || (rec.seq != 0 && rec.seq <= target.flushedSequence) {
+		return nil
+	}
+	return target.applyRecord(rec)
+}
+
+// merge writes the records of segment1 and of the newer segment2 to a new
+// segment, whose name it returns.
+func (t *Tree) merge(segment1, segment2 string) (string, error) {
+	merged, err := t.newSegmentName()
 	if err != nil {
-		return fmt.Errorf("flush file err: %s", err)
+		return "", err
 	}
-	err = writer.Close()
+	writer, err := t.createSegment(t.segmentPath(merged))
 	if err != nil {
-		return fmt.Errorf("close file err: %s", err)
+		return "", err
 	}
-	err = reader1.Close()
+	tombstones, records, err := t.writeMerged(writer, segment1, segment2)
 	if err != nil {
-		return fmt.Errorf("close file err: %s", err)
+		writer.file.Close()
+	} else {
+		err = writer.Close()
 	}
-	err = reader2.Close()
 	if err != nil {
-		return fmt.Errorf("close file err: %s", err)
+		// nothing references the unfinished file
+		t.opts.FS.Remove(writer.path)
+		return "", err
 	}
+	if len(tombstones) > 0 {
+		t.segmentTombstones[merged] = tombstones
+	}
+	t.segmentKeys[merged] = records
+	return merged, nil
+}
 
-	err = os.Remove(path1)
+// writeMerged writes the records of segment1 and of the newer segment2 to
+// writer and returns the range tombstones and the number of records it
+// wrote.
+func (t *Tree) writeMerged(writer *segmentWriter, segment1, segment2 string) ([]rangeTombstone, int, error) {
+	now := t.opts.Clock.Now()
+	level1, level2 := t.segmentLevel(segment1), t.segmentLevel(segment2)
+	reader1, err := t.openSegment(segment1, 0)
 	if err != nil {
-		return fmt.Errorf("remove file err: %s", err)
+		return nil, 0, err
 	}
-	err = os.Remove(path2)
+	defer reader1.Close()
+	reader2, err := t.openSegment(segment2, 0)
 	if err != nil {
-		return fmt.Errorf("remove file err: %s", err)
+		return nil, 0, err
 	}
-	err = os.Rename(newPath, path1)
+	defer reader2.Close()
+	tombstones1, rec1, err := readTombstones(reader1)
 	if err != nil {
-		return fmt.Errorf("rename file err: %s", err)
+		return nil, 0, err
 	}
-	return nil
+	tombstones2, rec2, err := readTombstones(reader2)
+	if err != nil {
+		return nil, 0, err
+	}
+	// the tombstones mask the older segments, the oldest has none
+	var tombstones []rangeTombstone
+	if len(t.segments) > 0 && t.segments[0] != segment1 {
+		tombstones = append(append(tombstones, tombstones1...), tombstones2...)
+	}
+	for _, tombstone := range tombstones {
+		err = writer.WriteString(tombstone.record().encode())
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	records := 0
+	// keys are compared decoded, escaping does not keep their order
+	for rec1 != nil || rec2 != nil {
+		if rec2 != nil && (rec1 == nil || t.opts.Comparator.Compare(rec2.key, rec1.key) <= 0) {
+			if rec1 != nil && rec1.key == rec2.key {
+				// the newer segment wins
+				rec1, err = reader1.readRecord()
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+			err = t.writeMergedRecord(writer, rec2, level2, now, &records)
+			if err != nil {
+				return nil, 0, err
+			}
+			rec2, err = reader2.readRecord()
+		} else {
+			// the tombstones of the newer segment drop the keys they mask
+			if !coveredBy(tombstones2, rec1.key, t.opts.Comparator) {
+				err = t.writeMergedRecord(writer, rec1, level1, now, &records)
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+			rec1, err = reader1.readRecord()
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return tombstones, records, nil
+}
+
+// writeMergedRecord writes rec to the merge output unless compaction drops
+// it, and counts it in records.
+func (t *Tree) writeMergedRecord(writer *segmentWriter, rec *record, level int, now time.Time, records *int) error {
+	rec, err := t.compactRecord(rec, level, now)
+	if err != nil || rec == nil {
+		return err
+	}
+	*records++
+	return writer.WriteString(rec.encode())
+}
+
+// mergeSegments folds every segment into a single one.
+func (t *Tree) mergeSegments() error {
+	for len(t.segments) > 1 {
+		merged, err := t.merge(t.segments[0], t.segments[1])
+		if err != nil {
+			return err
+		}
+		t.obsolete = append(t.obsolete, t.segments[0], t.segments[1])
+		t.segments = append([]string{merged}, t.segments[2:]...)
+	}
+	return t.repopulateIndex()
 }
 
 func (t *Tree) repopulateIndex() error {
-	t.index = rbtree.NewTree()
+	t.index = newOrderedTree(t.opts.Comparator)
 	for _, segment := range t.segments {
-		path := t.segmentPath(segment)
 		counter := t.sparsity()
 		bytes := 0
 
-		err := t.iterLineOfSegmentFile(path, func(key, val string) (bool, error) {
+		err := t.iterLineOfSegment(segment, func(rec *record) (bool, error) {
+			if rec.kind == kindRangeDelete {
+				bytes += len(rec.encode())
+				return false, nil
+			}
 			if counter == 1 {
-				t.index.Insert(keyType(key), &indexItem{
+				t.index.Insert(t.index.key(rec.key), &indexItem{
 					Segment: segment,
 					Offset:  int64(bytes),
-					Val:     val,
+					Val:     rec.value,
 				})
 				counter = t.sparsity() + 1
 			}
-			bytes += sizeof(t.toLogEntry(key, val))
+			bytes += len(rec.encode())
 			counter -= 1
 			return false, nil
 		})
@@ -589,40 +1550,38 @@ func (t *Tree) repopulateIndex() error {
 	return nil
 }
 
-func (t *Tree) incrementedSegmentName() string {
-	parts := strings.Split(t.currentSegment, "-")
-	if len(parts) != 2 {
-		panic("segment name not valid")
-	}
-	num, err := strconv.Atoi(parts[1])
-	if err != nil {
-		panic("segment name not valid")
+// openSegment returns a line reader positioned at offset of segment.
+// Secondaries read through the handles pinned by the last catch up, so
+// files the primary has since compacted away stay readable.
+func (t *Tree) openSegment(segment string, offset int64) (*LineReader, error) {
+	if file, size, ok := t.secondary.pinned(segment); ok {
+		return t.newSegmentLineReader(file, io.NopCloser(file), size, offset)
 	}
-	return fmt.Sprintf("%s-%d", parts[0], num+1)
+	return t.openSegmentFile(t.segmentPath(segment), offset)
 }
 
-func (t *Tree) setThreshold(threshold int) {
-	t.threshold = threshold
-}
-
-func (t *Tree) setSparsityFactor(factor int) {
-	t.sparsityFactor = factor
-}
-
-func (t *Tree) setBloomFilterNumItems(numItems int) {
-	t.bloomFilter = NewBloomFilter(numItems, t.bloomFilter.falsePositivePob)
-}
+// readSegment returns the whole content of segment.
+func (t *Tree) readSegment(segment string) ([]byte, error) {
+	reader, err := t.openSegment(segment, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
 
-func (t *Tree) setBloomFilterFalsePosProb(probability float64) {
-	t.bloomFilter = NewBloomFilter(t.bloomFilter.numItems, probability)
+	allBytes, err := io.ReadAll(reader.inner)
+	if err != nil {
+		return nil, fmt.Errorf("read file err: %s", err)
+	}
+	return allBytes, nil
 }
 
+// sparsity returns the number of keys between two sparse index entries, at
+// least 1 when the sparsity factor exceeds the memtable size.
 func (t *Tree) sparsity() int {
-	return t.threshold / t.sparsityFactor
-}
-
-func (t *Tree) toLogEntry(key, value string) string {
-	return key + "," + value + "\n"
+	if n := t.threshold / t.sparsityFactor; n > 1 {
+		return n
+	}
+	return 1
 }
 
 // Returns the path to the memtable write ahead log.
@@ -630,11 +1589,6 @@ func (t *Tree) memtableWalPath() string {
 	return t.segmentsDirectory + t.walBasename
 }
 
-// Returns the path to the memtable write ahead log.
-func (t *Tree) currentSegmentPath() string {
-	return t.segmentsDirectory + t.currentSegment
-}
-
 // Returns the path to the given segment_name.
 func (t *Tree) segmentPath(segmentName string) string {
 	return t.segmentsDirectory + segmentName
@@ -642,5 +1596,15 @@ func (t *Tree) segmentPath(segmentName string) string {
 
 // Returns the path to the treeMetadata backup file.
 func (t *Tree) metadataPath() string {
-	return t.segmentsDirectory + "database_metadata"
+	return t.segmentsDirectory + metadataFilename
+}
+
+// Returns the path to the OPTIONS file.
+func (t *Tree) optionsPath() string {
+	return t.segmentsDirectory + optionsFilename
+}
+
+// Returns the path to the LOCK file.
+func (t *Tree) lockPath() string {
+	return t.segmentsDirectory + lockFilename
 }
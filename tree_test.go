@@ -53,6 +53,21 @@ func cleanup() {
 	}
 }
 
+// readFileLines returns the complete lines of the file at path, with their
+// newline, nil when it can't be read.
+func readFileLines(path string) []string {
+	data, err := readFile(OSFS, path)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	return lines[:len(lines)-1]
+}
+
+func exists(path string) bool {
+	return fileExists(OSFS, path)
+}
+
 func Test_Set_stores_pair_in_memtable(t *testing.T) {
 	assert := assert.New(t)
 	db, err := NewTree(testFilename, testBasePath, bkupName)
@@ -84,7 +99,7 @@ func Test_Set_flushes_to_disk_past_threshold(t *testing.T) {
 	err = db.Set("3", "cl")
 	assert.Nil(err)
 
-	bytes, err := ioutil.ReadFile(testPath)
+	bytes, err := ioutil.ReadFile(testBasePath + segmentFileName(1))
 	assert.Nil(err)
 
 	lines := strings.Split(string(bytes), "\n")
@@ -155,7 +170,7 @@ func Test_flush_memtable_to_disk_flushes_memtable_to_disk(t *testing.T) {
 	assert.Nil(err)
 	db.memtable.Set("chris", "lessard")
 	db.memtable.Set("daniel", "lessard")
-	err = db.flushMemtableToDisk(testPath)
+	err = db.flushMemtableToDisk(testFilename)
 	assert.Nil(err)
 
 	lines := readFileLines(testPath)
@@ -216,8 +231,32 @@ func Test_Get_handles_miss(t *testing.T) {
 	db.Set("adrian", "lessard")
 
 	val, err := db.Get("debra")
+	assert.Equal(err, ErrNotFound)
+	assert.Equal(val, "")
+}
+
+func Test_Has_tells_present_keys_apart_from_empty_values(t *testing.T) {
+	assert := assert.New(t)
+	db, err := NewTree(testFilename, testBasePath, bkupName)
+	defer cleanup()
+	assert.Nil(err)
+	db.threshold = 20
+	db.Set("chris", "lessard")
+	db.Set("empty", "")
+	db.Set("daniel", "lessard")
+	db.Set("charles", "lessard")
+	assert.True(len(db.segments) > 0)
+
+	for key, want := range map[string]bool{"chris": true, "empty": true, "charles": true, "debra": false} {
+		ok, err := db.Has(key)
+		assert.Nil(err)
+		assert.Equal(ok, want, key)
+	}
+	val, err := db.Get("empty")
 	assert.Nil(err)
 	assert.Equal(val, "")
+	_, err = db.GetBytes([]byte("debra"))
+	assert.Equal(err, ErrNotFound)
 }
 
 func Test_Get_retrieves_most_recent_val(t *testing.T) {
@@ -285,7 +324,8 @@ func Test_Set_uses_new_segments(t *testing.T) {
 	db.Set("def", "fed")
 
 	assert.Equal(db.memtable.GetTotalSize(), 6)
-	assert.Equal(db.currentSegment, "test_file-2")
+	assert.Equal(db.nextFileNumber, uint64(2))
+	assert.Equal(db.segments, []string{segmentFileName(1)})
 }
 
 func Test_search_segment_key_present1(t *testing.T) {
@@ -402,15 +442,18 @@ func Test_merge_merges_two_segments(t *testing.T) {
 	s.WriteString("3,test5\n")
 
 	db.segments = segments
+	db.nextFileNumber = 3
 
-	err = db.merge(segments[0], segments[1])
+	merged, err := db.merge(segments[0], segments[1])
 	assert.Nil(err)
+	assert.Equal(merged, "000003.sst")
 
-	segmentLines := readFileLines(testBasePath + "test_file-1")
+	segmentLines := readFileLines(testBasePath + merged)
 	expectedContents := []string{"1,test5\n", "2,test6\n", "3,test5\n", "4,test6\n"}
 	assert.Equal(segmentLines, expectedContents)
 
-	assert.Equal(exists(testFilename+segments[1]), false)
+	// the inputs are removed once the metadata no longer references them
+	assert.True(exists(testBasePath + segments[1]))
 }
 
 func Test_save_metadata_saves_metadata(t *testing.T) {
@@ -434,7 +477,8 @@ func Test_save_metadata_saves_metadata(t *testing.T) {
 	err = meta.load(bytes)
 	assert.Nil(err)
 
-	assert.Equal(meta.CurrentSegment, testFilename)
+	assert.Equal(meta.NextFileNumber, uint64(1))
+	assert.Equal(meta.CurrentSegment, "")
 	assert.Equal(meta.Segments, segments)
 
 	b := &BloomFilter{}
@@ -453,13 +497,13 @@ func Test_load_metadata_loads_segments_at_init_time(t *testing.T) {
 	assert.Nil(err)
 	segments := []string{"segment-1", "segment-2", "segment-3"}
 	db.segments = segments
-	db.currentSegment = segments[len(segments)-1]
+	db.nextFileNumber = 4
 
 	db.Set("chris", "lessard")
 	db.Set("daniel", "lessard")
 	db.bloomFilter.falsePositivePob = 0.5
 	db.bloomFilter.numItems = 100
-	db.index.Insert(keyType("john"), &indexItem{
+	db.index.Insert(db.index.key("john"), &indexItem{
 		Segment: "segment-1",
 		Offset:  5,
 		Val:     nil,
@@ -467,6 +511,8 @@ func Test_load_metadata_loads_segments_at_init_time(t *testing.T) {
 
 	err = db.saveMetadata()
 	assert.Nil(err)
+	err = db.Close()
+	assert.Nil(err)
 
 	db, err = NewTree(testFilename, testBasePath, bkupName)
 	assert.Nil(err)
@@ -474,10 +520,10 @@ func Test_load_metadata_loads_segments_at_init_time(t *testing.T) {
 	assert.Nil(err)
 
 	assert.Equal(db.segments, segments)
-	assert.Equal(db.currentSegment, segments[len(segments)-1])
+	assert.Equal(db.nextFileNumber, uint64(4))
 	assert.Equal(db.bloomFilter.falsePositivePob, 0.5)
 	assert.Equal(db.bloomFilter.numItems, 100)
-	assert.True(db.index.Contains(keyType("john")))
+	assert.True(db.index.Contains(db.index.key("john")))
 }
 
 func Test_restore_memtable_loads_memtable_from_wal(t *testing.T) {
@@ -490,6 +536,8 @@ func Test_restore_memtable_loads_memtable_from_wal(t *testing.T) {
 	assert.Nil(err)
 	db.Set("sad", "mad")
 	db.Set("pad", "tad")
+	err = db.Close()
+	assert.Nil(err)
 
 	db, err = NewTree(testFilename, testBasePath, bkupName)
 	assert.Nil(err)
@@ -519,12 +567,12 @@ func Test_flush_memtable_to_disk_populates_index(t *testing.T) {
 	db.Set("stu", "901")
 	db.Set("vwx", "234")
 
-	err = db.flushMemtableToDisk(testPath)
+	err = db.flushMemtableToDisk(testFilename)
 	assert.Nil(err)
 
 	assert.Equal(db.index.Size(), 2)
-	assert.True(db.index.Contains(keyType("jkl")))
-	assert.True(db.index.Contains(keyType("vwx")))
+	assert.True(db.index.Contains(db.index.key("jkl")))
+	assert.True(db.index.Contains(db.index.key("vwx")))
 }
 
 func Test_flush_memtable_to_disk_writes_most_recent_keys(t *testing.T) {
@@ -541,7 +589,7 @@ func Test_flush_memtable_to_disk_writes_most_recent_keys(t *testing.T) {
 	db.Set("ghi", "567")
 	db.Set("ghi", "GHI")
 
-	err = db.flushMemtableToDisk(testPath)
+	err = db.flushMemtableToDisk(testFilename)
 	assert.Nil(err)
 
 	lines := readFileLines(testPath)
@@ -565,7 +613,7 @@ func Test_flush_memtable_to_disk_stores_segment_in_index(t *testing.T) {
 	db.Set("ghi", "789")
 	db.Set("jkl", "012")
 
-	err = db.flushMemtableToDisk(testPath)
+	err = db.flushMemtableToDisk(testFilename)
 	assert.Nil(err)
 
 	db.Set("mno", "345")
@@ -574,14 +622,13 @@ func Test_flush_memtable_to_disk_stores_segment_in_index(t *testing.T) {
 	db.Set("vwx", "234")
 
 	db.segments = []string{"test_file-1", "test_file-2"}
-	db.currentSegment = "test_file-2"
-	err = db.flushMemtableToDisk(testPath)
+	err = db.flushMemtableToDisk("test_file-2")
 	assert.Nil(err)
 
-	segment1 := db.index.Find(keyType("jkl")).(*indexItem).Segment
-	segment2 := db.index.Find(keyType("vwx")).(*indexItem).Segment
+	segment1 := db.index.Find(db.index.key("jkl")).(*indexItem).Segment
+	segment2 := db.index.Find(db.index.key("vwx")).(*indexItem).Segment
 
-	assert.Equal(segment1, "test_file-1") // TODO fix?
+	assert.Equal(segment1, "test_file-1")
 	assert.Equal(segment2, "test_file-2")
 }
 
@@ -602,11 +649,11 @@ func Test_flush_memtable_to_disk_stores_correct_index_offsets(t *testing.T) {
 	db.Set("stu", "901")
 	db.Set("vwx", "234")
 
-	err = db.flushMemtableToDisk(testPath)
+	err = db.flushMemtableToDisk(testFilename)
 	assert.Nil(err)
 
-	offset1 := db.index.Find(keyType("jkl")).(*indexItem).Offset
-	offset2 := db.index.Find(keyType("vwx")).(*indexItem).Offset
+	offset1 := db.index.Find(db.index.key("jkl")).(*indexItem).Offset
+	offset2 := db.index.Find(db.index.key("vwx")).(*indexItem).Offset
 
 	assert.Equal(offset1, int64(24))
 	assert.Equal(offset2, int64(56))
@@ -643,7 +690,7 @@ func Test_db_get_uses_index_with_floor(t *testing.T) {
 	s.WriteString("christian,dior\n")
 	s.WriteString("daniel,lessard\n")
 
-	db.index.Insert(keyType("chris"), &indexItem{
+	db.index.Insert(db.index.key("chris"), &indexItem{
 		Segment: "segment2",
 		Offset:  0,
 		Val:     "lessard",
@@ -663,10 +710,10 @@ func Test_repopulate_index_stores_correst_offsets(t *testing.T) {
 	db, err := NewTree(testFilename, testBasePath, bkupName)
 	defer cleanup()
 	assert.Nil(err)
-	db.index.Insert(keyType("chris"), &indexItem{
+	db.index.Insert(db.index.key("chris"), &indexItem{
 		Offset: 10,
 	})
-	db.index.Insert(keyType("lessard"), &indexItem{
+	db.index.Insert(db.index.key("lessard"), &indexItem{
 		Offset: 52,
 	})
 	db.segments = []string{"segment1", "segment2"}
@@ -693,7 +740,7 @@ func Test_repopulate_index_stores_correst_offsets(t *testing.T) {
 	err = db.repopulateIndex()
 	assert.Nil(err)
 
-	blueNode := db.index.Find(keyType("blue"))
+	blueNode := db.index.Find(db.index.key("blue"))
 	assert.Equal(blueNode.(*indexItem).Offset, int64(6))
 
 	s, err = os.Open(testBasePath + blueNode.(*indexItem).Segment)
@@ -705,7 +752,7 @@ func Test_repopulate_index_stores_correst_offsets(t *testing.T) {
 	line := string(buf[:bytes.IndexByte(buf, '\n')])
 	assert.Equal(line, "blue,2")
 
-	magentaNode := db.index.Find(keyType("magenta"))
+	magentaNode := db.index.Find(db.index.key("magenta"))
 	assert.Equal(magentaNode.(*indexItem).Offset, int64(7))
 
 	s, err = os.Open(testBasePath + magentaNode.(*indexItem).Segment)
@@ -736,10 +783,12 @@ func Test_delete_keys_from_segment_deletes_one_key_from_file(t *testing.T) {
 		s.WriteString(line)
 	}
 
-	err = db.deleteKeysFromSegment(keys, file)
+	db.nextFileNumber = 2
+	segment, err := db.deleteKeysFromSegment(keys, "test_file-1", nil)
 	assert.Nil(err)
+	assert.Equal(segment, "000002.sst")
 
-	alteredLines := readFileLines(file)
+	alteredLines := readFileLines(testBasePath + segment)
 	assert.Equal(alteredLines, []string{"red,1\n", "blue,2\n", "yellow,4\n"})
 }
 
@@ -763,10 +812,12 @@ func Test_delete_keys_from_segment_deletes_multiple_keys_from_file(t *testing.T)
 		s.WriteString(line)
 	}
 
-	err = db.deleteKeysFromSegment(keys, file)
+	db.nextFileNumber = 2
+	segment, err := db.deleteKeysFromSegment(keys, "test_file-1", nil)
 	assert.Nil(err)
+	assert.Equal(segment, "000002.sst")
 
-	alteredLines := readFileLines(file)
+	alteredLines := readFileLines(testBasePath + segment)
 	assert.Equal(alteredLines, []string{"red,1\n", "yellow,4\n"})
 }
 
@@ -789,8 +840,13 @@ func Test_delete_keys_from_segments_deletes_one_key(t *testing.T) {
 		}
 	}
 
-	err = db.deleteKeysFromSegments(keys, files)
+	db.segments = files[:]
+	db.nextFileNumber = 4
+	err = db.deleteKeysFromSegments(keys)
 	assert.Nil(err)
+	// rewritten newest first
+	assert.Equal(db.segments, []string{"000006.sst", "000005.sst", "000004.sst"})
+	assert.Equal(db.obsolete, []string{"test_file-3", "test_file-2", "test_file-1"})
 
 	expectedLines := []string{
 		"red,1\n",
@@ -798,8 +854,8 @@ func Test_delete_keys_from_segments_deletes_one_key(t *testing.T) {
 		"yellow,4\n",
 	}
 
-	for _, file := range files {
-		l := readFileLines(testBasePath + file)
+	for _, segment := range db.segments {
+		l := readFileLines(testBasePath + segment)
 		assert.Equal(l, expectedLines)
 	}
 }
@@ -824,15 +880,20 @@ func Test_delete_keys_from_segments_deletes_many_keys(t *testing.T) {
 		}
 	}
 
-	err = db.deleteKeysFromSegments(keys, files)
+	db.segments = files[:]
+	db.nextFileNumber = 4
+	err = db.deleteKeysFromSegments(keys)
 	assert.Nil(err)
+	// rewritten newest first
+	assert.Equal(db.segments, []string{"000006.sst", "000005.sst", "000004.sst"})
+	assert.Equal(db.obsolete, []string{"test_file-3", "test_file-2", "test_file-1"})
 
 	expectedLines := []string{
 		"blue,2\n",
 		"yellow,4\n",
 	}
-	for _, file := range files {
-		l := readFileLines(testBasePath + file)
+	for _, segment := range db.segments {
+		l := readFileLines(testBasePath + segment)
 		assert.Equal(l, expectedLines)
 	}
 }
@@ -855,6 +916,7 @@ func Test_compact_dropes_one_key(t *testing.T) {
 	}
 
 	db.segments = files[:]
+	db.nextFileNumber = 4
 
 	for _, line := range lines {
 		parts := strings.Split(line, ",")
@@ -866,8 +928,8 @@ func Test_compact_dropes_one_key(t *testing.T) {
 	err = db.compact()
 	assert.Nil(err)
 	expectedLines := []string{"red,1\n", "blue,2\n", "yellow,4\n"}
-	for _, file := range files {
-		l := readFileLines(testBasePath + file)
+	for _, segment := range db.segments {
+		l := readFileLines(testBasePath + segment)
 		assert.Equal(l, expectedLines)
 	}
 }
@@ -890,6 +952,7 @@ func Test_compact_drops_multiple_keys(t *testing.T) {
 	}
 
 	db.segments = files[:]
+	db.nextFileNumber = 4
 
 	for _, line := range lines {
 		parts := strings.Split(line, ",")
@@ -903,8 +966,8 @@ func Test_compact_drops_multiple_keys(t *testing.T) {
 	err = db.compact()
 	assert.Nil(err)
 	expectedLines := []string{"yellow,4\n"}
-	for _, file := range files {
-		l := readFileLines(testBasePath + file)
+	for _, segment := range db.segments {
+		l := readFileLines(testBasePath + segment)
 		assert.Equal(l, expectedLines)
 	}
 }
@@ -931,6 +994,9 @@ func Test_db_set_calls_compaction_algorithm(t *testing.T) {
 
 	db.Set("scoon", "coons")
 
-	lines := readFileLines(testBasePath + "test_file-2")
+	// the second segment lost fring, it was rewritten to a new file
+	assert.NotEqual(db.segments[1], segmentFileName(2))
+	lines := readFileLines(testBasePath + db.segments[1])
 	assert.Equal(lines, []string{"sides,seeds\n"})
+	assert.False(exists(testBasePath + segmentFileName(2)))
 }
@@ -0,0 +1,124 @@
+package simplekv
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetWithTTLExpiresKeys(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	db, err := Open(testBasePath, &Options{Clock: clock})
+	defer cleanup()
+	assert.Nil(err)
+
+	err = db.SetWithTTL("session", "abc", time.Minute)
+	assert.Nil(err)
+	val, err := db.Get("session")
+	assert.Nil(err)
+	assert.Equal(val, "abc")
+
+	clock.Advance(time.Minute)
+	val, err = db.Get("session")
+	assert.Equal(err, ErrNotFound)
+	assert.Equal(val, "")
+
+	assert.NotNil(db.SetWithTTL("session", "abc", 0))
+	assert.Nil(db.Close())
+}
+
+func TestSetWithTTLSurvivesRestart(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	db, err := Open(testBasePath, &Options{Clock: clock})
+	defer cleanup()
+	assert.Nil(err)
+	err = db.SetWithTTL("session", "abc", time.Minute)
+	assert.Nil(err)
+	assert.Nil(db.Close())
+
+	db, err = Open(testBasePath, &Options{Clock: clock})
+	assert.Nil(err)
+	val, err := db.Get("session")
+	assert.Nil(err)
+	assert.Equal(val, "abc")
+	clock.Advance(time.Hour)
+	val, err = db.Get("session")
+	assert.Equal(err, ErrNotFound)
+	assert.Equal(val, "")
+	assert.Nil(db.Close())
+}
+
+func TestExpiredKeysAreDroppedByCompaction(t *testing.T) {
+	assert := assert.New(t)
+	for _, strategy := range []CompactionStrategy{CompactionDeleteKeys, CompactionMergeSegments} {
+		clock := &fakeClock{now: time.Unix(1000, 0)}
+		db, err := Open(testBasePath, &Options{
+			MemtableSize:       40,
+			SparsityFactor:     10,
+			CompactionStrategy: strategy,
+			Clock:              clock,
+		})
+		assert.Nil(err)
+
+		// an expiring write hides the value flushed before it
+		err = db.Set("session", "old")
+		assert.Nil(err)
+		for i := 0; i < 10; i++ {
+			err = db.Set("key"+strconv.Itoa(i), "v")
+			assert.Nil(err)
+		}
+		err = db.SetWithTTL("session", "new", time.Minute)
+		assert.Nil(err)
+		for i := 10; i < 20; i++ {
+			err = db.Set("key"+strconv.Itoa(i), "v")
+			assert.Nil(err)
+		}
+		clock.Advance(time.Hour)
+		for i := 20; i < 40; i++ {
+			err = db.Set("key"+strconv.Itoa(i), "v")
+			assert.Nil(err)
+		}
+
+		val, err := db.Get("session")
+		assert.Equal(err, ErrNotFound, strategy.String())
+		assert.Equal(val, "", strategy.String())
+		for _, segment := range db.segments {
+			for _, line := range readFileLines(db.segmentPath(segment)) {
+				assert.False(strings.HasPrefix(line, "session,"), strategy.String())
+			}
+		}
+		assert.Nil(db.Close())
+		cleanup()
+	}
+}
+
+func TestIteratorSkipsExpiredKeys(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	db, err := Open(testBasePath, &Options{MemtableSize: 30, Clock: clock})
+	defer cleanup()
+	assert.Nil(err)
+
+	assert.Nil(db.Set("a", "1"))
+	assert.Nil(db.SetWithTTL("b", "2", time.Minute))
+	assert.Nil(db.Set("c", "3"))
+	assert.Nil(db.SetWithTTL("d", "4", time.Hour))
+	assert.Nil(db.Set("e", "5"))
+	clock.Advance(2 * time.Minute)
+
+	it, err := db.NewIterator()
+	assert.Nil(err)
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key()+"="+it.Value())
+	}
+	assert.Nil(it.Err())
+	assert.Nil(it.Close())
+	assert.Equal(keys, []string{"a=1", "c=3", "d=4", "e=5"})
+	assert.Nil(db.Close())
+}
@@ -8,6 +8,9 @@ func sizeof(v interface{}) int {
 	if s, ok := v.(string); ok {
 		return len(s)
 	}
+	if s, ok := v.(interface{ size() int }); ok {
+		return s.size()
+	}
 	bytes, err := json.Marshal(v)
 	if err != nil {
 		return 0
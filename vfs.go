@@ -0,0 +1,616 @@
+package simplekv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File an open file of an FS, *os.File satisfies it.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Sync() error
+	Stat() (os.FileInfo, error)
+	// Truncate changes the size of the file, it doesn't move the offset.
+	Truncate(size int64) error
+}
+
+// FS file system a tree stores its files in. Every file access of the
+// tree, its WAL, checkpoints and backups goes through it.
+type FS interface {
+	// OpenFile opens name with the os.O_* flags of flag.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldname, newname string) error
+	// Link makes newname another name of the file oldname.
+	Link(oldname, newname string) error
+	MkdirAll(dir string, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir lists dir sorted by name.
+	ReadDir(dir string) ([]os.FileInfo, error)
+	// Lock takes an exclusive lock on name, creating it when missing. It
+	// fails with ErrLocked when the lock is held, Close releases it.
+	Lock(name string) (io.Closer, error)
+}
+
+// OSFS the FS of the operating system, it is the default.
+var OSFS FS = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// a nil *os.File must not turn into a non nil File
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) MkdirAll(dir string, perm os.FileMode) error {
+	return os.MkdirAll(dir, perm)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFileDescriptor(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return osLock{file: file}, nil
+}
+
+type osLock struct {
+	file *os.File
+}
+
+func (l osLock) Close() error {
+	err := unlockFileDescriptor(l.file)
+	if err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// MemFS FS held in memory, nothing touches the disk. Like on unix, open
+// files stay readable after they are renamed or removed.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]bool
+	locks map[string]bool
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: map[string]*memNode{},
+		dirs:  map[string]bool{},
+		locks: map[string]bool{},
+	}
+}
+
+// memNode content of a file, shared by its hard links
+type memNode struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func cleanPath(name string) string {
+	return path.Clean(name)
+}
+
+// dirExists tells whether dir exists, fs.mu must be held.
+func (fs *MemFS) dirExists(dir string) bool {
+	return dir == "." || dir == "/" || fs.dirs[dir]
+}
+
+func (fs *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = cleanPath(name)
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if fs.dirExists(name) {
+		if writable || flag&os.O_CREATE != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		}
+		// a directory is only opened to be synced
+		return &memFile{name: name, node: &memNode{}}, nil
+	}
+	node, ok := fs.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if !fs.dirExists(path.Dir(name)) {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		node = &memNode{modTime: time.Now()}
+		fs.files[name] = node
+	}
+	if writable && flag&os.O_TRUNC != 0 {
+		node.mu.Lock()
+		node.data = nil
+		node.modTime = time.Now()
+		node.mu.Unlock()
+	}
+	return &memFile{
+		name:     name,
+		node:     node,
+		readable: flag&os.O_WRONLY == 0,
+		writable: writable,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (fs *MemFS) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = cleanPath(name)
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if !fs.dirs[name] {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if len(fs.children(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(fs.dirs, name)
+	return nil
+}
+
+func (fs *MemFS) RemoveAll(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = cleanPath(name)
+	prefix := name + "/"
+	for file := range fs.files {
+		if file == name || strings.HasPrefix(file, prefix) {
+			delete(fs.files, file)
+		}
+	}
+	for dir := range fs.dirs {
+		if dir == name || strings.HasPrefix(dir, prefix) {
+			delete(fs.dirs, dir)
+		}
+	}
+	return nil
+}
+
+func (fs *MemFS) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldname, newname = cleanPath(oldname), cleanPath(newname)
+	if !fs.dirExists(path.Dir(newname)) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if node, ok := fs.files[oldname]; ok {
+		if fs.dirs[newname] {
+			return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: errors.New("is a directory")}
+		}
+		delete(fs.files, oldname)
+		fs.files[newname] = node
+		return nil
+	}
+	if !fs.dirs[oldname] {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok := fs.files[newname]; ok || len(fs.children(newname)) > 0 {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	// a directory moves with everything below it
+	oldPrefix, newPrefix := oldname+"/", newname+"/"
+	for file, node := range fs.files {
+		if strings.HasPrefix(file, oldPrefix) {
+			delete(fs.files, file)
+			fs.files[newPrefix+strings.TrimPrefix(file, oldPrefix)] = node
+		}
+	}
+	for dir := range fs.dirs {
+		if dir == oldname || strings.HasPrefix(dir, oldPrefix) {
+			delete(fs.dirs, dir)
+			fs.dirs[newname+strings.TrimPrefix(dir, oldname)] = true
+		}
+	}
+	return nil
+}
+
+func (fs *MemFS) Link(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldname, newname = cleanPath(oldname), cleanPath(newname)
+	node, ok := fs.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok := fs.files[newname]; ok || fs.dirs[newname] {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	if !fs.dirExists(path.Dir(newname)) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	fs.files[newname] = node
+	return nil
+}
+
+func (fs *MemFS) MkdirAll(dir string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for dir = cleanPath(dir); !fs.dirExists(dir); dir = path.Dir(dir) {
+		if _, ok := fs.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		fs.dirs[dir] = true
+	}
+	return nil
+}
+
+func (fs *MemFS) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = cleanPath(name)
+	if node, ok := fs.files[name]; ok {
+		return node.stat(name), nil
+	}
+	if fs.dirExists(name) {
+		return &memFileInfo{name: path.Base(name), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir = cleanPath(dir)
+	if !fs.dirExists(dir) {
+		return nil, &os.PathError{Op: "readdir", Path: dir, Err: os.ErrNotExist}
+	}
+	return fs.children(dir), nil
+}
+
+// children lists the entries of dir, fs.mu must be held.
+func (fs *MemFS) children(dir string) []os.FileInfo {
+	var infos []os.FileInfo
+	for file, node := range fs.files {
+		if path.Dir(file) == dir {
+			infos = append(infos, node.stat(file))
+		}
+	}
+	for sub := range fs.dirs {
+		if sub != dir && path.Dir(sub) == dir {
+			infos = append(infos, &memFileInfo{name: path.Base(sub), dir: true})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos
+}
+
+func (fs *MemFS) Lock(name string) (io.Closer, error) {
+	file, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	name = cleanPath(name)
+	if fs.locks[name] {
+		return nil, fmt.Errorf("%w: %s", ErrLocked, name)
+	}
+	fs.locks[name] = true
+	return &memLock{fs: fs, name: name}, nil
+}
+
+type memLock struct {
+	fs   *MemFS
+	name string
+}
+
+func (l *memLock) Close() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+
+	delete(l.fs.locks, l.name)
+	return nil
+}
+
+func (n *memNode) stat(name string) *memFileInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return &memFileInfo{name: path.Base(name), size: int64(len(n.data)), modTime: n.modTime, node: n}
+}
+
+// memFile handle of a MemFS file
+type memFile struct {
+	name     string
+	node     *memNode
+	pos      int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+var errFileClosed = errors.New("file already closed")
+
+func (f *memFile) check(op string, allowed bool) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: errFileClosed}
+	}
+	if !allowed {
+		return &os.PathError{Op: op, Path: f.name, Err: errors.New("bad file descriptor")}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read", f.readable); err != nil {
+		return 0, err
+	}
+	f.node.mu.RLock()
+	defer f.node.mu.RUnlock()
+
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if err := f.check("write", f.writable); err != nil {
+		return 0, err
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	if f.append {
+		f.pos = int64(len(f.node.data))
+	}
+	if end := f.pos + int64(len(p)); end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	copy(f.node.data[f.pos:], p)
+	f.pos += int64(len(p))
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check("seek", true); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.node.mu.RLock()
+		offset += int64(len(f.node.data))
+		f.node.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errors.New("negative offset")}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Sync() error {
+	return f.check("sync", true)
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if err := f.check("truncate", f.writable); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: errors.New("negative size")}
+	}
+	f.node.mu.Lock()
+	defer f.node.mu.Unlock()
+
+	data := make([]byte, size)
+	copy(data, f.node.data)
+	f.node.data = data
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if err := f.check("stat", true); err != nil {
+		return nil, err
+	}
+	return f.node.stat(f.name), nil
+}
+
+func (f *memFile) Close() error {
+	if err := f.check("close", true); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+	node    *memNode
+}
+
+func (i *memFileInfo) Name() string {
+	return i.name
+}
+
+func (i *memFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0777
+	}
+	return 0666
+}
+
+func (i *memFileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i *memFileInfo) IsDir() bool {
+	return i.dir
+}
+
+// Sys returns the node of a file, which tells links to it apart.
+func (i *memFileInfo) Sys() any {
+	return i.node
+}
+
+// sameFile tells whether a and b, returned by the same FS, describe the
+// same file.
+func sameFile(a, b os.FileInfo) bool {
+	if node, ok := a.Sys().(*memNode); ok {
+		return node == b.Sys()
+	}
+	return os.SameFile(a, b)
+}
+
+// readFile returns the content of name.
+func readFile(fs FS, name string) ([]byte, error) {
+	file, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// writeFile replaces the content of name with data and syncs it.
+func writeFile(fs FS, name string, data []byte) error {
+	file, err := fs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeFileAtomically replaces name with a file holding data, a crash
+// leaves either the old or the new content.
+func writeFileAtomically(fs FS, name string, data []byte) error {
+	temp := name + ".tmp"
+	err := writeFile(fs, temp, data)
+	if err != nil {
+		return err
+	}
+	return fs.Rename(temp, name)
+}
+
+// syncDir syncs dir, so that the files created or renamed in it survive a
+// crash.
+func syncDir(fs FS, dir string) error {
+	file, err := fs.OpenFile(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("open dir: %s err: %s", dir, err)
+	}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("sync dir: %s err: %s", dir, err)
+	}
+	return file.Close()
+}
+
+// fileExists tells whether name exists in fs.
+func fileExists(fs FS, name string) bool {
+	if _, err := fs.Stat(name); err != nil && errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	return true
+}
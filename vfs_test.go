@@ -0,0 +1,136 @@
+package simplekv
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFSFiles(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+
+	_, err := fs.OpenFile("db/a", os.O_CREATE|os.O_WRONLY, 0666)
+	assert.True(errors.Is(err, os.ErrNotExist))
+	assert.Nil(fs.MkdirAll("db/sub", 0777))
+	assert.Nil(writeFile(fs, "db/a", []byte("hello")))
+	assert.Nil(writeFile(fs, "db/sub/b", []byte("b")))
+
+	file, err := fs.OpenFile("db/a", os.O_APPEND|os.O_WRONLY, 0666)
+	assert.Nil(err)
+	_, err = io.WriteString(file, " world!!")
+	assert.Nil(err)
+	// appends go to the end of the truncated file
+	assert.Nil(file.Truncate(10))
+	_, err = io.WriteString(file, "d")
+	assert.Nil(err)
+	assert.Nil(file.Close())
+	data, err := readFile(fs, "db/a")
+	assert.Nil(err)
+	assert.Equal(string(data), "hello world")
+
+	_, err = fs.OpenFile("db/a", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	assert.True(errors.Is(err, os.ErrExist))
+
+	// directories are opened to be synced only
+	assert.Nil(syncDir(fs, "db/sub"))
+	assert.Nil(syncDir(OSFS, os.TempDir()))
+	_, err = fs.OpenFile("db/sub", os.O_WRONLY, 0666)
+	assert.NotNil(err)
+
+	infos, err := fs.ReadDir("db")
+	assert.Nil(err)
+	assert.Equal(len(infos), 2)
+	assert.Equal(infos[0].Name(), "a")
+	assert.Equal(infos[1].Name(), "sub")
+	assert.True(infos[1].IsDir())
+
+	// links share their content, renaming a dir moves what it holds
+	assert.Nil(fs.Link("db/a", "db/sub/c"))
+	a, _ := fs.Stat("db/a")
+	c, _ := fs.Stat("db/sub/c")
+	assert.True(sameFile(a, c))
+	assert.Nil(fs.Rename("db/sub", "db/moved"))
+	assert.False(fileExists(fs, "db/sub/b"))
+	data, err = readFile(fs, "db/moved/c")
+	assert.Nil(err)
+	assert.Equal(string(data), "hello world")
+
+	assert.Nil(fs.RemoveAll("db/moved"))
+	assert.False(fileExists(fs, "db/moved/b"))
+	assert.True(fileExists(fs, "db/a"))
+}
+
+func TestMemFSOpenFileOutlivesRemove(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	assert.Nil(writeFile(fs, "wal", []byte("old")))
+
+	file, err := fs.OpenFile("wal", os.O_RDONLY, 0)
+	assert.Nil(err)
+	assert.Nil(writeFile(fs, "wal.tmp", []byte("new")))
+	assert.Nil(fs.Rename("wal.tmp", "wal"))
+	data, err := io.ReadAll(file)
+	assert.Nil(err)
+	assert.Equal(string(data), "old")
+	assert.Nil(file.Close())
+	_, err = file.Read(make([]byte, 1))
+	assert.NotNil(err)
+
+	assert.Nil(fs.Remove("wal"))
+	assert.NotNil(fs.Remove("wal"))
+}
+
+func TestMemFSLock(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	lock, err := fs.Lock("LOCK")
+	assert.Nil(err)
+	_, err = fs.Lock("LOCK")
+	assert.True(errors.Is(err, ErrLocked))
+	assert.Nil(lock.Close())
+	lock, err = fs.Lock("LOCK")
+	assert.Nil(err)
+	assert.Nil(lock.Close())
+}
+
+func TestTreeOnMemFS(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+	fs := NewMemFS()
+	opts := &Options{MemtableSize: 100, SparsityFactor: 2, FS: fs}
+	db, err := Open("db", opts)
+	assert.Nil(err)
+	_, err = Open("db", opts)
+	assert.True(errors.Is(err, ErrLocked))
+	for i := 0; i < 30; i++ {
+		assert.Nil(db.Set("key"+strconv.Itoa(i), "value"+strconv.Itoa(i)))
+	}
+	assert.True(len(db.segments) > 0)
+	assert.Nil(db.Checkpoint("checkpoint"))
+	engine, err := OpenBackupEngineFS(fs, "backups/")
+	assert.Nil(err)
+	id, err := engine.CreateNewBackup(db)
+	assert.Nil(err)
+	assert.Nil(db.Close())
+	assert.False(exists("db"))
+
+	assert.Nil(engine.RestoreDBFromBackup(id, "restored"))
+	for _, dir := range []string{"db", "checkpoint", "restored"} {
+		db, err = Open(dir, opts)
+		assert.Nil(err)
+		for i := 0; i < 30; i++ {
+			val, err := db.Get("key" + strconv.Itoa(i))
+			assert.Nil(err, dir)
+			assert.Equal(val, "value"+strconv.Itoa(i))
+		}
+		assert.Nil(db.Close())
+	}
+}
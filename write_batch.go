@@ -0,0 +1,114 @@
+package simplekv
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// WriteBatch groups writes, across column families, that Tree.Write
+// applies atomically: after a crash either all of them or none are found.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	cf  *ColumnFamily
+	rec *record
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Set sets key to value in the default column family.
+func (b *WriteBatch) Set(key, value string) {
+	b.SetCF(nil, key, value)
+}
+
+// Delete removes key from the default column family.
+func (b *WriteBatch) Delete(key string) {
+	b.DeleteCF(nil, key)
+}
+
+// SetCF sets key to value in cf, nil meaning the default column family.
+func (b *WriteBatch) SetCF(cf *ColumnFamily, key, value string) {
+	b.ops = append(b.ops, batchOp{cf: cf, rec: &record{key: key, value: value}})
+}
+
+// DeleteCF removes key from cf, nil meaning the default column family.
+func (b *WriteBatch) DeleteCF(cf *ColumnFamily, key string) {
+	b.ops = append(b.ops, batchOp{cf: cf, rec: &record{key: key, kind: kindDelete}})
+}
+
+// Count returns the number of writes of the batch.
+func (b *WriteBatch) Count() int {
+	return len(b.ops)
+}
+
+// Write applies b atomically. Its records are appended to the shared WAL in
+// a single write, each one carrying the sequence number of the last one, so
+// that the replay skips a batch torn by a crash.
+func (t *Tree) Write(b *WriteBatch) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	if b.Count() == 0 {
+		return nil
+	}
+	root := t.root()
+	defer root.observeWrite("write_batch", time.Now())
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	targets := make([]*Tree, len(b.ops))
+	added := map[*Tree]int{}
+	for i, op := range b.ops {
+		target := root
+		if op.cf != nil {
+			if op.cf.tree.root() != root {
+				return fmt.Errorf("%w: %s belongs to another tree", ErrColumnFamilyNotFound, op.cf.name)
+			}
+			target = op.cf.tree
+		}
+		// checked holding root.mu, the family can't be dropped before the
+		// batch is written
+		if err := target.checkFamily(); err != nil {
+			return err
+		}
+		targets[i] = target
+		if target.memtable.Get(op.rec.key) == nil {
+			added[target] += len(op.rec.key) + sizeof(op.rec.memtableValue())
+		}
+	}
+	for target, size := range added {
+		if target.memtable.GetTotalSize()+size > target.threshold {
+			if err := target.flushForWrite(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	var entries strings.Builder
+	last := root.lastSequence + uint64(len(b.ops))
+	for i, op := range b.ops {
+		op.rec.cf = targets[i].cfID
+		op.rec.seq = root.nextSequence()
+		op.rec.batch = 0
+		if len(b.ops) > 1 {
+			op.rec.batch = last
+		}
+		entries.WriteString(op.rec.encode())
+	}
+	if err := root.writeLog(entries.String()); err != nil {
+		return err
+	}
+	root.stats.sets.add(int64(len(b.ops)))
+	for i, op := range b.ops {
+		if err := targets[i].applyRecord(op.rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}